@@ -0,0 +1,216 @@
+// Package cleaner embeds the MARIA cleaning on Go programs. The reads of an
+// io.Reader are cleaned on parallel and the kept ones written on an
+// io.Writer in the input order. Nothing is printed and the process never
+// exits: errors are returned and messages go to the slog default logger.
+//
+//	c, err := cleaner.New(cleaner.Options{Tech: "OxfordNanopore", QC: true})
+//	result, err := c.Clean(ctx, in, out)
+package cleaner
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"MARIA/config"
+	"MARIA/core/utils"
+	"MARIA/maria"
+)
+
+// Options of a Cleaner, the zero value detects the technology and uses all
+// the cores.
+type Options struct {
+	Tech           string  // Illumina, OxfordNanopore, PacBio or IonTorrent; empty detects it from the first reads
+	Profile        string  // sub-profile of quality.json (NovaSeq, MiSeq, R10, HiFi...), it must exist; empty detects it
+	MinConfidence  float64 // minimum confidence (0-1) of the detection, 0 uses 0.7
+	ConfigDir      string  // folder of adapters.json and quality.json, empty uses the embedded defaults
+	Threads        int     // 0 uses all the cores
+	ChunkSize      int     // reads per chunk, 0 starts with 1000 and adapts to the throughput
+	SplitChimeras  bool    // split reads on internal adapters instead of cutting at the first one
+	QC             bool    // collect QC metrics before and after cleaning
+	Plugins        string  // plugins with the syntax of -plugins
+	SampleFraction float64 // keep each read with this probability before cleaning, 0 keeps all
+	Seed           int64   // seed of SampleFraction
+	// OnRecord receives every read: the kept reads of each chunk, as written,
+	// followed by the rejected ones. It is called in chunk order from one
+	// goroutine, an error stops the run.
+	OnRecord func(Record) error
+}
+
+// Record is a read given to OnRecord, Rejected is the filter that discarded
+// it (invalid, adapter_only, low_quality, too_short, homopolymer), empty when
+// it is kept.
+type Record struct {
+	maria.Read
+	Rejected string
+}
+
+// Result are the counts of a run.
+type Result struct {
+	Tech         string           `json:"tech"`
+	Confidence   float64          `json:"confidence"`
+	Profile      string           `json:"profile"`
+	ReadsIn      int64            `json:"reads_in"`
+	ReadsOut     int64            `json:"reads_out"`
+	BasesIn      int64            `json:"bases_in"`
+	BasesOut     int64            `json:"bases_out"`
+	TrimmedBases int64            `json:"trimmed_bases"`
+	Rejected     map[string]int64 `json:"rejected"`
+	AdapterHits  map[string]int64 `json:"adapter_hits"`
+	QC           *QCReport        `json:"qc,omitempty"`
+}
+
+// QCReport are the QC metrics before and after cleaning when Options.QC is set.
+type QCReport = utils.QCReport
+
+// Cleaner cleans reads with the same options, it can be used by several
+// goroutines at the same time.
+type Cleaner struct {
+	opts Options
+}
+
+// New validates the options.
+func New(opts Options) (*Cleaner, error) {
+	if opts.Tech != "" {
+		tech, err := utils.NormalizeTech(opts.Tech)
+		if err != nil {
+			return nil, err
+		}
+		opts.Tech = tech
+	}
+	switch {
+	case opts.MinConfidence < 0 || opts.MinConfidence > 1:
+		return nil, fmt.Errorf("min confidence %g, want 0-1", opts.MinConfidence)
+	case opts.SampleFraction < 0 || opts.SampleFraction > 1:
+		return nil, fmt.Errorf("sample fraction %g, want 0-1", opts.SampleFraction)
+	case opts.Threads < 0 || opts.ChunkSize < 0:
+		return nil, errors.New("threads and chunk size can't be negative")
+	}
+	if opts.MinConfidence == 0 {
+		opts.MinConfidence = utils.DefaultTechConfidence
+	}
+	return &Cleaner{opts: opts}, nil
+}
+
+// Clean reads FASTQ or FASTA (split on the '>' headers, a wrapped sequence is
+// joined on one line) from in and writes the kept reads on out in the same
+// format, nil discards them. Cancelling ctx stops the run with ctx.Err().
+func (c *Cleaner) Clean(ctx context.Context, in io.Reader, out io.Writer) (*Result, error) {
+	reader := bufio.NewReaderSize(in, 4<<20)
+	sample := peekLines(reader, 400)
+	result := &Result{Tech: c.opts.Tech, Confidence: 1}
+	if result.Tech == "" {
+		best := utils.ClassifySequencingTech(sample).Best()
+		if best.Tech == "" || best.Probability < c.opts.MinConfidence {
+			return nil, fmt.Errorf("technology not confident (%.1f%% %s), set Options.Tech", best.Probability*100, best.Tech)
+		}
+		result.Tech, result.Confidence = best.Tech, best.Probability
+	}
+	subProfile := c.opts.Profile
+	if subProfile == "" {
+		subProfile, _ = utils.DetectSubProfile(result.Tech, sample)
+	}
+	profile, err := c.loadProfile(result.Tech, subProfile)
+	// a detected sub-profile without entry uses the technology entry, a
+	// forced one must exist
+	if errors.Is(err, utils.ErrUnknownSubProfile) && c.opts.Profile == "" {
+		profile, err = c.loadProfile(result.Tech, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Profile = profile.Name
+	opts := utils.CleanOptions{
+		Profile: profile, ChunkSize: c.opts.ChunkSize, Threads: c.opts.Threads, Plugins: c.opts.Plugins,
+		SplitChimeras: c.opts.SplitChimeras, QC: c.opts.QC, AdaptChunks: c.opts.ChunkSize == 0,
+	}
+	if len(sample) > 0 && strings.HasPrefix(sample[0], ">") {
+		opts.LinesPerRead = 2
+	}
+	if c.opts.SampleFraction > 0 {
+		if opts.Sampler, err = utils.NewFractionSampler(c.opts.SampleFraction, c.opts.Seed); err != nil {
+			return nil, err
+		}
+	}
+	var onRecord func(utils.Sequence, utils.RejectReason) error
+	if c.opts.OnRecord != nil {
+		onRecord = func(seq utils.Sequence, reason utils.RejectReason) error {
+			return c.opts.OnRecord(Record{Read: copyRead(seq), Rejected: string(reason)})
+		}
+	}
+	stats, err := utils.CleanStream(ctx, reader, out, opts, onRecord)
+	if err != nil {
+		return nil, err
+	}
+	result.ReadsIn, result.ReadsOut = stats.ReadsIn, stats.ReadsOut
+	result.BasesIn, result.BasesOut, result.TrimmedBases = stats.BasesIn, stats.BasesOut, stats.TrimmedBases
+	result.Rejected = map[string]int64{}
+	for reason, reads := range stats.Rejected {
+		result.Rejected[string(reason)] = reads
+	}
+	result.AdapterHits = stats.AdapterHits
+	result.QC = stats.QCReport()
+	return result, nil
+}
+
+// loadProfile reads the profile from ConfigDir, or from the embedded
+// defaults.
+func (c *Cleaner) loadProfile(tech, subProfile string) (utils.Profile, error) {
+	if c.opts.ConfigDir != "" {
+		return utils.LoadProfileFrom(c.opts.ConfigDir, tech, subProfile)
+	}
+	return utils.LoadProfileFS(config.Files, tech, subProfile)
+}
+
+// CleanFile cleans inputPath on outputPath.
+func (c *Cleaner) CleanFile(ctx context.Context, inputPath, outputPath string) (*Result, error) {
+	in, err := os.Open(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.Clean(ctx, in, out)
+	if closeErr := out.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		return nil, err
+	}
+	return result, nil
+}
+
+// peekLines returns the first lines buffered by reader without consuming them.
+func peekLines(reader *bufio.Reader, n int) []string {
+	data, _ := reader.Peek(reader.Size())
+	lines := strings.SplitAfter(string(data), "\n")
+	if last := lines[len(lines)-1]; last == "" || (!strings.HasSuffix(last, "\n") && len(data) == reader.Size()) {
+		lines = lines[:len(lines)-1] // empty or cut by the buffer
+	}
+	if len(lines) > n {
+		lines = lines[:n]
+	}
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], "\r\n")
+	}
+	return lines
+}
+
+// copyRead copies the sequence of the stream, so the record can be kept after
+// OnRecord returns.
+func copyRead(seq utils.Sequence) maria.Read {
+	return maria.Read{
+		ID:      strings.Clone(seq.ID),
+		Bases:   strings.Clone(seq.Bases),
+		Plus:    strings.Clone(seq.Plus),
+		Quality: strings.Clone(seq.Quality),
+	}
+}
@@ -0,0 +1,138 @@
+package cleaner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{"zero", Options{}, false},
+		{"tech alias", Options{Tech: "ont"}, false},
+		{"unknown tech", Options{Tech: "sanger"}, true},
+		{"confidence", Options{MinConfidence: 1.5}, true},
+		{"fraction", Options{SampleFraction: -0.1}, true},
+		{"threads", Options{Threads: -1}, true},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.opts); (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCleanProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		want    string
+		wantErr bool
+	}{
+		// the headers of illuminaReads are of a NovaSeq
+		{"detected", "", "Illumina.NovaSeq", false},
+		{"forced", "MiSeq", "Illumina.MiSeq", false},
+		{"forced unknown", "NovaSek", "", true},
+	}
+	for _, tt := range tests {
+		c, err := New(Options{Tech: "Illumina", Profile: tt.profile})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := c.Clean(context.Background(), strings.NewReader(illuminaReads(10)), nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && result.Profile != tt.want {
+			t.Errorf("%s: profile %s, want %s", tt.name, result.Profile, tt.want)
+		}
+	}
+}
+
+func illuminaReads(n int) string {
+	var out strings.Builder
+	for i := 0; i < n; i++ {
+		bases := strings.Repeat("ACGTTGCAAC", 15)
+		fmt.Fprintf(&out, "@A00123:8:H5KJ3DSXX:1:1101:%d:1000 1:N:0:ACGT\n%s\n+\n%s\n", i, bases, strings.Repeat("F", len(bases)))
+	}
+	// too short
+	fmt.Fprintf(&out, "@A00123:8:H5KJ3DSXX:1:1101:%d:1000 1:N:0:ACGT\nACGT\n+\nFFFF\n", n)
+	return out.String()
+}
+
+func TestClean(t *testing.T) {
+	tests := []struct {
+		name      string
+		configDir string
+		wantErr   bool
+	}{
+		// the tests run on cleaner/, the defaults are embedded
+		{"embedded config", "", false},
+		{"config folder", "../config", false},
+		{"missing folder", "no_config", true},
+	}
+	for _, tt := range tests {
+		var kept, rejected int
+		c, err := New(Options{ConfigDir: tt.configDir, Threads: 2, QC: true, OnRecord: func(r Record) error {
+			if r.Rejected == "" {
+				kept++
+			} else {
+				rejected++
+			}
+			return nil
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		result, err := c.Clean(context.Background(), strings.NewReader(illuminaReads(300)), &out)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if tt.wantErr {
+			continue
+		}
+		if result.Tech != "Illumina" || result.ReadsIn != 301 || result.ReadsOut != 300 || result.Rejected["too_short"] != 1 {
+			t.Errorf("%s: %+v", tt.name, result)
+		}
+		if kept != 300 || rejected != 1 || strings.Count(out.String(), "\n") != 1200 {
+			t.Errorf("%s: %d kept and %d rejected records, %d lines written", tt.name, kept, rejected, strings.Count(out.String(), "\n"))
+		}
+		if result.QC == nil || result.QC.Before.Reads != 301 {
+			t.Errorf("%s: QC %+v", tt.name, result.QC)
+		}
+	}
+}
+
+func TestCleanFasta(t *testing.T) {
+	var single, wrapped strings.Builder
+	for i := 0; i < 20; i++ {
+		bases := strings.Repeat("ACGTTGCAAC", 15)
+		fmt.Fprintf(&single, ">r%d\n%s\n", i, bases)
+		fmt.Fprintf(&wrapped, ">r%d\n%s\n%s\n", i, bases[:60], bases[60:])
+	}
+	for name, input := range map[string]string{"single line": single.String(), "wrapped": wrapped.String()} {
+		c, err := New(Options{Tech: "Illumina", Threads: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		result, err := c.Clean(context.Background(), strings.NewReader(input), &out)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if result.ReadsIn != 20 || result.ReadsOut != 20 || result.BasesOut != 20*150 {
+			t.Errorf("%s: %+v", name, result)
+		}
+		if out.String() != single.String() {
+			t.Errorf("%s: output %q", name, out.String()[:40])
+		}
+	}
+}
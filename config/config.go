@@ -0,0 +1,8 @@
+// Package config embeds the default adapters.json and quality.json, they are
+// used by the cleaner package when no config folder is given.
+package config
+
+import "embed"
+
+//go:embed adapters.json quality.json
+var Files embed.FS
@@ -1,73 +1,561 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"MARIA/core/utils"
 )
 
 func main() {
-	fmt.Println("Hello to MARIA: A novel bioinformatic toolkit making on golang to clean sequences")
+	if len(os.Args) > 1 && os.Args[1] == "demux" {
+		runDemux(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		runStats(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		runVerify(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "plugins" {
+		runPlugins(os.Args[2:])
+		return
+	}
 	input := flag.String("in", "", "(.fastq, .fq, .fasta, .fa) -> File compatible with: Illumina, Oxford Nanopore, PacBio, and Ion Torrent")
 	output := flag.String("out", "", "Path of clean file")
 	pluginList := flag.String("plugins", "", "List of plugins separate for comma (order acendent execution)")
 	preWorker := flag.Bool("preworker", false, "Active order per worker execution")
-	details := flag.Bool("details", false, "Generates reports and folders with files of: adapters, invalid sequences, primers and low-quality sequences.")
+	pluginDir := flag.String("plugin-dir", "", "Folders of plugins separate for comma, searched before MARIA_PLUGIN_PATH and plugins/")
+	pluginTimeout := flag.Duration("plugin-timeout", utils.PluginTimeout, "Time an external plugin has to answer a batch of reads before it is killed")
+	pluginProcs := flag.Int("plugin-procs", 0, "Processes per external plugin (0 one per thread)")
+	details := flag.Bool("details", false, "Write the rejected reads per filter (invalid, adapter_only, low_quality, too_short, homopolymer) and a summary on a details folder")
 	threads := flag.Int("threads", 0, "Number of threads for use (0 use all)")
 	useDisk := flag.Bool("disk", false, "Use disk cache (default RAM)")
-	chunkSize := flag.Int("chunk", 0, "Number of lines per chunk")
+	chunkSize := flag.Int("chunk", 0, "Reads per chunk (0 estimates it from the start of the input and adapts it during the run)")
+	splitChimeras := flag.Bool("split-chimeras", false, "Split reads on internal adapters into sub-reads (readid_1, readid_2) instead of cutting at the first adapter")
+	targetBases := flag.String("target-bases", "", "Keep the best reads (length and mean quality) up to this number of bases, e.g. 500M")
+	genomeSize := flag.String("genome-size", "", "Genome size to target -coverage instead of -target-bases, e.g. 5M")
+	coverage := flag.Float64("coverage", 0, "Target coverage over -genome-size")
+	sampleFraction := flag.Float64("sample-fraction", 0, "Random subsample: keep each read with this probability (0-1)")
+	sampleCount := flag.Int("sample-count", 0, "Random subsample: keep exactly this number of input reads (pairs on interleaved input)")
+	sampleCoverage := flag.Float64("sample-coverage", 0, "Random subsample: keep reads for this coverage over -genome-size")
+	seed := flag.Int64("seed", 11, "Seed of the random subsample, the same seed selects the same read names on R1 and R2, interleaved mates are kept together")
+	techFlag := flag.String("tech", "", "Force the technology instead of detection: Illumina, OxfordNanopore, PacBio, IonTorrent")
+	profileFlag := flag.String("profile", "", "Force the instrument or chemistry sub-profile of quality.json, e.g. NovaSeq, MiSeq, R10, HiFi")
+	minConfidence := flag.Float64("min-confidence", utils.DefaultTechConfidence, "Minimum confidence (0-1) of the technology detection to continue")
+	qc := flag.Bool("qc", true, "Collect QC metrics before and after cleaning (quality per position, lengths, GC, N, duplication)")
+	compress := flag.Bool("compress", false, "Compress the output as <out>.gz (BGZF, parallel) and write its sha256")
+	compressLevel := flag.Int("compress-level", 6, "Compression level of -compress, 1 (fast) to 9 (small)")
+	compressThreads := flag.Int("compress-threads", 0, "Threads of -compress (0 use all)")
+	compressRemove := flag.Bool("compress-remove", false, "Remove the uncompressed output once the .gz is verified")
+	reportPath := flag.String("report", "", "Path of the JSON run report (default <out>_report.json)")
+	sampleName := flag.String("sample-name", "", "Sample name of the reports (default derived from -in)")
+	multiqcDir := flag.String("multiqc", "", "Folder for MultiQC custom content files (*_mqc.json), shared by the runs of all samples")
+	logging := addLogFlags(flag.CommandLine)
 	flag.Parse()
+	logging.setup()
+	utils.PluginTimeout, utils.PluginProcesses = *pluginTimeout, *pluginProcs
+	setPluginDirs(*pluginDir)
 
 	if *input == "" || *output == "" {
 		fmt.Println("Use with Go: go run core/main.go -in raw(.fastq, .fq, .fasta, .fa) -out clean.fastq -plugins=compressFile -disk=true -chunk=100000")
 		fmt.Println("Use with build: ./maria -in raw(.fastq, .fq, .fasta, .fa) -out clean.fastq -plugins=compressFile -disk=true -chunk=100000")
 		os.Exit(1)
 	}
+	if *compress && (*compressLevel < 1 || *compressLevel > 9) {
+		fatal("invalid compression", fmt.Errorf("-compress-level %d, want 1-9", *compressLevel))
+	}
+	run := utils.NewRunLog()
+	report := &utils.RunReport{StartedAt: time.Now(), Sample: *sampleName, Command: os.Args, Output: *output}
+	if report.Sample == "" {
+		report.Sample = utils.SampleName(*input)
+	}
+	checksum := checksumAsync(*input)
+	budget, err := targetBudget(*targetBases, *genomeSize, *coverage)
+	if err != nil {
+		fatal("invalid target", err)
+	}
+	if budget > 0 {
+		slog.Info("target bases", "bases", budget)
+	}
+	sampler, err := newSampler(*input, *sampleFraction, *sampleCount, *sampleCoverage, *genomeSize, *seed)
+	if err != nil {
+		fatal("invalid subsample", err)
+	}
 	fileFormat, fileLines := utils.CheckFileFormat(*input)
 	sample, err := utils.PeekFirstReads(*input, 100)
 	if err != nil {
-		log.Fatalf("Error read file")
-		return
+		fatal("can't read input", err)
 	}
 	// check tecnology
-	fmt.Printf("Cores Aveables: %d\n", utils.AvailableCPU())
-	fmt.Printf("RAM total: %d GB\n", utils.AvailableRAM()/1e9)
-	fmt.Printf("RAM usable (~75%%): %d GB\n", utils.UsableRAM()/1e9)
+	slog.Info("system", "cores", utils.AvailableCPU(), "ram_gb", utils.AvailableRAM()/1e9, "usable_ram_gb", utils.UsableRAM()/1e9)
 
-	if *chunkSize == 0 {
-		size, totalChunks, memory := utils.AutoEstimateChunks(*input, fileLines)
-		fmt.Printf("Lines per chunk: %d (%.2f MB per core)\n", size, memory)
-		fmt.Printf("Total chunks: %d\n", totalChunks)
-		*chunkSize = size
+	adaptChunks := *chunkSize == 0
+	if adaptChunks {
+		*chunkSize = estimateChunks(*input, fileLines, *threads)
 	}
-	tech := utils.DetectSequencingTech(sample)
-	if tech == "" {
-		log.Fatalf("Error secuence technology")
-	}
-	fmt.Println("Technology detect:", tech)
-	utils.NextPhase("Valid type technology", 1)
+	tech := resolveTech(sample, *techFlag, *minConfidence)
+	profile := resolveProfile(tech.Tech, sample, *profileFlag)
+	run.NextPhase("Valid type technology", 1)
 	ramOK := utils.SystemHasEnoughRAM()
 	nvme := utils.IsNVMeMounted()
 	useDiskCache := !ramOK && nvme
-	fmt.Printf("RAM: %v | NVMe: %v | Cache on disk: %v\n", ramOK, nvme, useDiskCache)
-
-	utils.NextPhase("Generating temporal directory", 2)
-	tempDir := filepath.Join(os.TempDir(), "maria_clean_chunks")
-	fmt.Printf("Temporal files on: %v \n", tempDir)
-	os.MkdirAll(tempDir, 0o755)
-
-	utils.NextPhase("Valid format of secuence", 3)
-	if fileFormat == "fastq" {
-		utils.ParallelClean(*input, *output, *chunkSize, tech, *useDisk, *threads, tempDir, *pluginList, *preWorker, *details)
-	} else if fileFormat == "fasta" {
-		utils.ParallelClean(*input, *output, *chunkSize, tech, *useDisk, *threads, tempDir, *pluginList, *preWorker, *details)
+	slog.Info("cache", "ram_ok", ramOK, "nvme", nvme, "disk_cache", useDiskCache)
+	report.Technology, report.Profile = tech, profile
+	report.System = utils.SystemInfo{Cores: utils.AvailableCPU(), RAM: utils.AvailableRAM(), UsableRAM: utils.UsableRAM(), NVMe: nvme, DiskCache: useDiskCache}
+	report.Settings = map[string]any{
+		"chunk": *chunkSize, "threads": *threads, "disk": *useDisk, "plugins": *pluginList, "preworker": *preWorker,
+		"plugin_timeout": pluginTimeout.String(), "plugin_procs": *pluginProcs,
+		"details": *details, "split_chimeras": *splitChimeras, "target_bases": budget, "sample_fraction": *sampleFraction,
+		"sample_count": *sampleCount, "sample_coverage": *sampleCoverage, "genome_size": *genomeSize, "seed": *seed,
+		"min_confidence": *minConfidence, "qc": *qc, "compress": *compress, "compress_level": *compressLevel,
+		"compress_remove": *compressRemove,
+	}
+
+	run.NextPhase("Generating temporal directory", 2)
+	tempDir := makeTempDir("maria_clean_")
+	defer os.RemoveAll(tempDir)
+	slog.Info("temporal files", "path", tempDir)
+
+	run.NextPhase("Valid format of secuence", 3)
+	if fileFormat != "fastq" && fileFormat != "fasta" {
+		fatal("format not supported", fmt.Errorf("%s", fileFormat))
+	}
+	// Ctrl-C stops the workers and removes the temporal chunks
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report.Stats, err = utils.ParallelClean(ctx, *input, *output, utils.CleanOptions{
+		Profile: profile, ChunkSize: *chunkSize, Threads: *threads, TempDir: tempDir, Plugins: *pluginList, PreWorker: *preWorker,
+		Details: *details, SplitChimeras: *splitChimeras, TargetBases: budget, Sampler: sampler, QC: *qc,
+		AdaptChunks: adaptChunks, LinesPerRead: fileLines, Run: run,
+	})
+	if err != nil {
+		fatal("cleaning failed", err)
+	}
+	if *compress {
+		run.NextPhase("Compressing output", 8)
+		compressed, err := utils.CompressFile(*output, utils.CompressOptions{Level: *compressLevel, Threads: *compressThreads, RemoveOriginal: *compressRemove, Run: run})
+		if err != nil {
+			fatal("compression failed", err)
+		}
+		report.Compressed = &compressed
+	}
+	report.QC = report.Stats.QCReport()
+	if !*logging.quiet {
+		report.Stats.PrintRejected()
+		if report.QC != nil && (tech.Tech == "Oxford Nanopore" || tech.Tech == "PacBio") {
+			report.QC.PrintLengthStats()
+		}
+	}
+	report.Inputs = []utils.FileChecksum{<-checksum}
+	writeReport(run, report, *reportPath, strings.TrimSuffix(*output, filepath.Ext(*output))+"_report.json")
+	writeMultiQC(run, report, *multiqcDir)
+	writeManifest(run, strings.TrimSuffix(*output, filepath.Ext(*output))+"_manifest.json", report.Sample)
+	slog.Info("thank for use MARIA, process finished")
+}
+
+// logFlags are the logging flags shared by the commands.
+type logFlags struct {
+	level  *string
+	format *string
+	quiet  *bool
+}
+
+func addLogFlags(cmd *flag.FlagSet) logFlags {
+	return logFlags{
+		level:  cmd.String("log-level", "info", "Log level: debug (chunks and workers), info, warn, error"),
+		format: cmd.String("log-format", "text", "Log format on stderr: text or json"),
+		quiet:  cmd.Bool("quiet", false, "Only log errors, without progress and summary tables"),
+	}
+}
+
+func (l logFlags) setup() {
+	if err := utils.SetupLogger(*l.level, *l.format, *l.quiet); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+// runTempDir is the temporal folder of the run, removed by fatal too.
+var runTempDir string
+
+// makeTempDir creates a new temporal folder for the chunks of this run, so
+// runs at the same time do not share their chunks.
+func makeTempDir(prefix string) string {
+	dir, err := os.MkdirTemp("", prefix)
+	if err != nil {
+		fatal("can't create temporal directory", err)
+	}
+	runTempDir = dir
+	return dir
+}
+
+// fatal logs the error that stops the run, removes the temporal folder and
+// exits with code 1.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	if runTempDir != "" {
+		os.RemoveAll(runTempDir)
+	}
+	os.Exit(1)
+}
+
+// estimateChunks returns the reads per chunk from a sample of the input.
+func estimateChunks(input string, fileLines, threads int) int {
+	size, totalChunks, memory, err := utils.AutoEstimateChunks(input, fileLines, threads)
+	if err != nil {
+		fatal("can't estimate chunks", err)
+	}
+	slog.Info("chunks", "reads_per_chunk", size, "mb_per_core", fmt.Sprintf("%.2f", memory), "total", totalChunks)
+	return size
+}
+
+// checksumAsync computes the checksum of the input while the file is processed.
+func checksumAsync(path string) <-chan utils.FileChecksum {
+	result := make(chan utils.FileChecksum, 1)
+	go func() {
+		checksum, err := utils.ChecksumFile(path)
+		if err != nil {
+			slog.Warn("checksum failed", "path", path, "error", err)
+		}
+		result <- checksum
+	}()
+	return result
+}
+
+func writeReport(run *utils.RunLog, report *utils.RunReport, path, defaultPath string) {
+	if path == "" {
+		path = defaultPath
+	}
+	report.Phases = run.PhaseTimings()
+	if err := report.Write(path); err != nil {
+		slog.Error("can't write report", "error", err)
+		return
+	}
+	slog.Info("run report written", "path", path)
+	recordFile(run, "report", path)
+	htmlPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".html"
+	if err := report.WriteHTML(htmlPath); err != nil {
+		slog.Error("can't write HTML report", "error", err)
+		return
+	}
+	slog.Info("HTML report written", "path", htmlPath)
+	recordFile(run, "report", htmlPath)
+}
+
+// recordFile adds a file to the run manifest, a failure is only logged.
+func recordFile(run *utils.RunLog, kind, path string) {
+	if err := run.RecordFile(kind, path); err != nil {
+		slog.Warn("can't hash file for the manifest", "path", path, "error", err)
+	}
+}
+
+// writeManifest saves the files produced by the run with their checksums.
+func writeManifest(run *utils.RunLog, path, sample string) {
+	if err := run.WriteManifest(path, sample); err != nil {
+		slog.Error("can't write manifest", "error", err)
+		return
+	}
+	slog.Info("manifest written", "path", path)
+}
+
+// writeMultiQC saves the MultiQC custom content when a folder was given.
+func writeMultiQC(run *utils.RunLog, report *utils.RunReport, dir string) {
+	if dir == "" {
+		return
+	}
+	paths, err := report.WriteMultiQC(dir)
+	if err != nil {
+		slog.Error("can't write MultiQC files", "error", err)
+		return
+	}
+	slog.Info("MultiQC files written", "files", len(paths), "path", dir)
+	for _, path := range paths {
+		recordFile(run, "multiqc", path)
+	}
+}
+
+// targetBudget returns the bases to keep from -target-bases or genome size x coverage (0 keep all).
+func targetBudget(targetBases, genomeSize string, coverage float64) (int64, error) {
+	if targetBases != "" {
+		return utils.ParseBases(targetBases)
+	}
+	if coverage <= 0 {
+		return 0, nil
+	}
+	if genomeSize == "" {
+		return 0, fmt.Errorf("-coverage needs -genome-size")
+	}
+	size, err := utils.ParseBases(genomeSize)
+	if err != nil {
+		return 0, err
+	}
+	return int64(float64(size) * coverage), nil
+}
+
+// newSampler returns the random subsample selected by the flags, nil without subsample.
+func newSampler(input string, fraction float64, count int, coverage float64, genomeSize string, seed int64) (*utils.Sampler, error) {
+	switch {
+	case fraction > 0:
+		return utils.NewFractionSampler(fraction, seed)
+	case count > 0:
+		slog.Info("selecting random reads", "count", count, "seed", seed)
+		return utils.NewCountSampler(count, seed)
+	case coverage > 0:
+		if genomeSize == "" {
+			return nil, fmt.Errorf("-sample-coverage needs -genome-size")
+		}
+		size, err := utils.ParseBases(genomeSize)
+		if err != nil {
+			return nil, err
+		}
+		return utils.NewCoverageSampler(input, size, coverage, seed)
+	}
+	return nil, nil
+}
+
+// resolveTech uses the -tech override or the detected technology, the run
+// stops with the ranking when the detection is not confident.
+func resolveTech(sample []string, override string, minConfidence float64) utils.TechScore {
+	if override != "" {
+		tech, err := utils.NormalizeTech(override)
+		if err != nil {
+			fatal("invalid technology", err)
+		}
+		slog.Info("technology forced", "tech", tech)
+		return utils.TechScore{Tech: tech, Probability: 1, Evidence: []string{"forced with -tech"}}
+	}
+	detection := utils.ClassifySequencingTech(sample)
+	best := detection.Best()
+	slog.Debug("technology detection", "reads", detection.Reads, "ranking", detection.String())
+	if best.Probability < minConfidence {
+		fmt.Fprintf(os.Stderr, "Technology detection on %d reads:\n%s", detection.Reads, detection)
+		fatal("technology not confident, the reads do not look like a single known technology; use -tech to force the technology or -min-confidence to accept a lower confidence",
+			fmt.Errorf("confidence %.1f%% is under %.1f%%", best.Probability*100, minConfidence*100))
+	}
+	slog.Info("technology detected", "tech", best.Tech, "confidence", fmt.Sprintf("%.1f%%", best.Probability*100))
+	return best
+}
+
+// resolveProfile loads the quality.json entry of the detected (or forced) sub-profile.
+func resolveProfile(tech string, sample []string, override string) utils.Profile {
+	subProfile, evidence := override, "forced"
+	if subProfile == "" {
+		subProfile, evidence = utils.DetectSubProfile(tech, sample)
+	}
+	if subProfile != "" {
+		slog.Info("sub-profile detected", "profile", subProfile, "evidence", evidence)
+	}
+	profile, err := utils.LoadProfile(tech, subProfile)
+	// a detected sub-profile without entry uses the technology entry, a
+	// forced one must exist
+	if errors.Is(err, utils.ErrUnknownSubProfile) && override == "" {
+		slog.Warn("sub-profile not found on quality.json", "profile", subProfile, "using", tech)
+		profile, err = utils.LoadProfile(tech, "")
+	}
+	if err != nil {
+		fatal("can't load profile", err)
+	}
+	slog.Info("cleaning profile", "name", profile.Name)
+	return profile
+}
+
+// demux command: clean and split the reads per sample barcode
+func runDemux(args []string) {
+	cmd := flag.NewFlagSet("demux", flag.ExitOnError)
+	input := cmd.String("in", "", "(.fastq, .fq) -> File with the reads of all samples")
+	sheet := cmd.String("sheet", "", "CSV sample sheet: sample,index[,index2]")
+	ontKit := cmd.String("ont-kit", "", "Oxford Nanopore barcode kit instead of sample sheet: NBD, RBK, PCB")
+	bothEnds := cmd.Bool("both-ends", false, "Oxford Nanopore: require the same barcode at both ends of the read")
+	outDir := cmd.String("outdir", "demux", "Folder for the files per sample")
+	mismatches := cmd.Int("mismatches", 1, "Mismatches allowed per index")
+	inline := cmd.Bool("inline", false, "Barcodes on the sequence (index at start, index2 at end) instead of the header")
+	details := cmd.Bool("details", false, "Write the rejected reads per filter (invalid, adapter_only, low_quality, too_short, homopolymer) and a summary on a details folder")
+	threads := cmd.Int("threads", 0, "Number of threads for use (0 use all)")
+	chunkSize := cmd.Int("chunk", 0, "Reads per chunk (0 estimates it from the start of the input)")
+	splitChimeras := cmd.Bool("split-chimeras", false, "Split reads on internal adapters into sub-reads (readid_1, readid_2) instead of cutting at the first adapter")
+	techFlag := cmd.String("tech", "", "Force the technology instead of detection: Illumina, OxfordNanopore, PacBio, IonTorrent")
+	profileFlag := cmd.String("profile", "", "Force the instrument or chemistry sub-profile of quality.json, e.g. NovaSeq, MiSeq, R10, HiFi")
+	minConfidence := cmd.Float64("min-confidence", utils.DefaultTechConfidence, "Minimum confidence (0-1) of the technology detection to continue")
+	reportPath := cmd.String("report", "", "Path of the JSON run report (default <outdir>/report.json)")
+	sampleName := cmd.String("sample-name", "", "Run name of the reports (default derived from -in)")
+	multiqcDir := cmd.String("multiqc", "", "Folder for MultiQC custom content files (*_mqc.json)")
+	logging := addLogFlags(cmd)
+	cmd.Parse(args)
+	logging.setup()
+
+	if *input == "" || (*sheet == "" && *ontKit == "") {
+		fmt.Println("Use: ./maria demux -in raw.fastq -sheet samples.csv -outdir demux -mismatches=1")
+		fmt.Println("Use with Oxford Nanopore kits: ./maria demux -in raw.fastq -ont-kit NBD -both-ends -outdir demux")
+		os.Exit(1)
+	}
+	run := utils.NewRunLog()
+	report := &utils.RunReport{StartedAt: time.Now(), Sample: *sampleName, Command: os.Args, Output: *outDir}
+	if report.Sample == "" {
+		report.Sample = utils.SampleName(*input)
+	}
+	checksum := checksumAsync(*input)
+	var demuxer utils.ReadAssigner
+	if *ontKit != "" {
+		barcoder, err := utils.NewONTBarcoder(*ontKit, *bothEnds)
+		if err != nil {
+			fatal("invalid barcode kit", err)
+		}
+		slog.Info("barcode kit", "kit", barcoder.Kit.Name, "barcodes", len(barcoder.Kit.Barcodes))
+		demuxer = barcoder
 	} else {
-		fmt.Println("Format not supported")
+		samples, err := utils.LoadSampleSheet(*sheet)
+		if err != nil {
+			fatal("invalid sample sheet", err)
+		}
+		slog.Info("sample sheet", "samples", len(samples))
+		demuxer = &utils.Demuxer{Samples: samples, Mismatches: *mismatches, Inline: *inline}
+	}
+	_, fileLines := utils.CheckFileFormat(*input)
+	sample, err := utils.PeekFirstReads(*input, 100)
+	if err != nil {
+		fatal("can't read input", err)
+	}
+	adaptChunks := *chunkSize == 0
+	if adaptChunks {
+		*chunkSize = estimateChunks(*input, fileLines, *threads)
+	}
+	tech := resolveTech(sample, *techFlag, *minConfidence)
+	profile := resolveProfile(tech.Tech, sample, *profileFlag)
+	report.Technology, report.Profile = tech, profile
+	report.System = utils.SystemInfo{Cores: utils.AvailableCPU(), RAM: utils.AvailableRAM(), UsableRAM: utils.UsableRAM()}
+	report.Settings = map[string]any{
+		"chunk": *chunkSize, "threads": *threads, "sheet": *sheet, "ont_kit": *ontKit, "both_ends": *bothEnds,
+		"mismatches": *mismatches, "inline": *inline, "details": *details, "split_chimeras": *splitChimeras,
+		"min_confidence": *minConfidence,
 	}
 
-	fmt.Println("Thank for Use MARIA - Finish process.")
+	tempDir := makeTempDir("maria_demux_")
+	defer os.RemoveAll(tempDir)
+	counts, stats, err := utils.ParallelDemux(*input, *outDir, *chunkSize, profile, *threads, tempDir, demuxer, *details, *splitChimeras, run)
+	if err != nil {
+		fatal("demultiplexing failed", err)
+	}
+	if !*logging.quiet {
+		stats.PrintRejected()
+		utils.PrintDemuxCounts(counts)
+	}
+	report.Stats, report.Samples = stats, counts
+	report.Inputs = []utils.FileChecksum{<-checksum}
+	writeReport(run, report, *reportPath, filepath.Join(*outDir, "report.json"))
+	writeMultiQC(run, report, *multiqcDir)
+	writeManifest(run, filepath.Join(*outDir, "manifest.json"), report.Sample)
+	slog.Info("thank for use MARIA, process finished")
+}
+
+// runStats computes the read metrics (yield, N50, lengths, quality) of a file without cleaning.
+func runStats(args []string) {
+	cmd := flag.NewFlagSet("stats", flag.ExitOnError)
+	input := cmd.String("in", "", "(.fastq, .fq, .fasta, .fa) -> File to summarize")
+	threads := cmd.Int("threads", 0, "Number of threads for use (0 use all)")
+	chunkSize := cmd.Int("chunk", 0, "Reads per chunk (0 estimates it from the start of the input)")
+	jsonPath := cmd.String("json", "", "Also save the metrics as JSON on this path")
+	logging := addLogFlags(cmd)
+	cmd.Parse(args)
+	logging.setup()
+
+	if *input == "" {
+		fmt.Println("Use: ./maria stats -in reads.fastq [-json stats.json]")
+		os.Exit(1)
+	}
+	fileFormat, fileLines := utils.CheckFileFormat(*input)
+	if *chunkSize == 0 {
+		*chunkSize = estimateChunks(*input, fileLines, *threads)
+	}
+	qc, err := utils.ParallelStats(*input, *chunkSize, *threads, fileFormat == "fasta")
+	if err != nil {
+		fatal("stats failed", err)
+	}
+	summary := qc.Summary()
+	if !*logging.quiet {
+		utils.PrintStats(summary)
+	}
+	if *jsonPath != "" {
+		data, err := json.MarshalIndent(summary, "", "  ")
+		if err == nil {
+			err = os.WriteFile(*jsonPath, append(data, '\n'), 0o644)
+		}
+		if err != nil {
+			fatal("can't write stats", err)
+		}
+		slog.Info("stats written", "path", *jsonPath)
+	}
+}
+
+// runPlugins lists the plugins found on the search path.
+func runPlugins(args []string) {
+	if len(args) == 0 || args[0] != "list" {
+		fmt.Println("Use: ./maria plugins list [-plugin-dir dir1,dir2]")
+		os.Exit(1)
+	}
+	cmd := flag.NewFlagSet("plugins list", flag.ExitOnError)
+	pluginDir := cmd.String("plugin-dir", "", "Folders of plugins separate for comma, searched before MARIA_PLUGIN_PATH and plugins/")
+	logging := addLogFlags(cmd)
+	cmd.Parse(args[1:])
+	logging.setup()
+	setPluginDirs(*pluginDir)
+	list, err := utils.ListPlugins()
+	if err != nil {
+		fatal("can't list plugins", err)
+	}
+	utils.PrintPlugins(list)
+}
+
+func setPluginDirs(value string) {
+	for _, dir := range strings.Split(value, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			utils.PluginDirs = append(utils.PluginDirs, dir)
+		}
+	}
+}
+
+// runVerify checks again the size and checksums of the files of a manifest.
+func runVerify(args []string) {
+	cmd := flag.NewFlagSet("verify", flag.ExitOnError)
+	manifest := cmd.String("manifest", "", "Manifest of the run (<out>_manifest.json or <outdir>/manifest.json)")
+	logging := addLogFlags(cmd)
+	cmd.Parse(args)
+	logging.setup()
+	if *manifest == "" && cmd.NArg() > 0 {
+		*manifest = cmd.Arg(0)
+	}
+	if *manifest == "" {
+		fmt.Println("Use: ./maria verify -manifest clean_manifest.json")
+		os.Exit(1)
+	}
+	results, err := utils.VerifyManifest(*manifest)
+	if err != nil {
+		fatal("can't verify", err)
+	}
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("FAILED %s: %v\n", result.Path, result.Err)
+		} else if !*logging.quiet {
+			fmt.Printf("OK     %s\n", result.Path)
+		}
+	}
+	if failed > 0 {
+		fatal("verify failed", fmt.Errorf("%d of %d files do not match", failed, len(results)))
+	}
+	slog.Info("all files verified", "files", len(results))
 }
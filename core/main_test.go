@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestTargetBudget(t *testing.T) {
+	tests := []struct {
+		name        string
+		targetBases string
+		genomeSize  string
+		coverage    float64
+		want        int64
+		wantErr     bool
+	}{
+		{"keep all", "", "", 0, 0, false},
+		{"target bases", "500M", "", 0, 500000000, false},
+		{"target bases win", "1.5Gb", "5M", 30, 1500000000, false},
+		{"coverage", "", "5M", 30, 150000000, false},
+		{"coverage without genome", "", "", 30, 0, true},
+		{"invalid genome", "", "5X", 30, 0, true},
+		{"invalid target", "lots", "", 0, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := targetBudget(tt.targetBases, tt.genomeSize, tt.coverage)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: got %d, %v; want %d, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
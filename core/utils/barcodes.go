@@ -0,0 +1,278 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ONT native barcodes NB01-NB24, PCR and rapid barcodes are the reverse complement.
+var ontNativeBarcodes = []string{
+	"CACAAAGACACCGACAACTTTCTT",
+	"ACAGACGACTACAAACGGAATCGA",
+	"CCTGGTAACTGGGACACAAGACTC",
+	"TAGGGAAACACGATAGAATCCGAA",
+	"AAGGTTACACAAACCCTGGACAAG",
+	"GACTACTTTCTGCCTTTGCGAGAA",
+	"AAGGATTCATTCCCACGGTAACAC",
+	"ACGTAACTTGGTTTGTTCCCTGAA",
+	"AACCAAGACTCGCTGTGCCTAGTT",
+	"GAGAGGACAAAGGTTTCAACGCTT",
+	"TCCATTCCCTCCGATAGATGAAAC",
+	"TCCGATTCTGCTTCTTTCTACCTG",
+	"AGAACGACTTCCATACTCGTGTGA",
+	"AACGAGTCTCTTGGGACCCATAGA",
+	"AGGTCTACCTCGCTAACACCACTG",
+	"CGTCAACTGACAGTGGTTCGTACT",
+	"ACCCTCCAGGAAAGTACCTCTGAT",
+	"CCAAACCCAACAACCTAGATAGGC",
+	"GTTCCTCGTGCAGTGTCAAGAGAT",
+	"TTGCGTCCTGTTACGAGAACTCAT",
+	"GAGCCTCTCATTGTCCGTTCTCTA",
+	"ACCACTGCCATGTATCAAAGTACG",
+	"CTTACTACCCAGAACACACTGGAG",
+	"GCATAGTTCTGCATGATGGGTTAG",
+}
+
+// ONTKit describes a barcoding kit: the barcode is flanked by Left and Right
+// on the 5' end of the read and by their reverse complement on the 3' end.
+type ONTKit struct {
+	Name     string
+	Left     string
+	Right    string
+	BothEnds bool // rapid kits only attach the barcode on the 5' end
+	Barcodes []DemuxSample
+}
+
+func ontBarcodeSet(prefix string, count int, native bool) []DemuxSample {
+	barcodes := make([]DemuxSample, count)
+	for i := 0; i < count; i++ {
+		seq := ontNativeBarcodes[i]
+		if !native {
+			seq = reverseComplement(seq)
+		}
+		barcodes[i] = DemuxSample{Name: fmt.Sprintf("%s%02d", prefix, i+1), Index1: seq}
+	}
+	return barcodes
+}
+
+// ONTKits are the built-in barcode kits by short name.
+var ONTKits = map[string]ONTKit{
+	"NBD": {
+		Name:     "Native barcoding (SQK-NBD)",
+		Left:     "AAGGTTAA",
+		Right:    "CAGCACCT",
+		BothEnds: true,
+		Barcodes: ontBarcodeSet("NB", 24, true),
+	},
+	"RBK": {
+		Name:     "Rapid barcoding (SQK-RBK)",
+		Left:     "GCTTGGGTGTTTAACC",
+		Right:    "GTTTTCGCATTTATCGTGAAACGCTTTCGCGTTTTTCGTGCGCCGCTTCA",
+		BothEnds: false,
+		Barcodes: ontBarcodeSet("RB", 24, false),
+	},
+	"PCB": {
+		Name:     "PCR barcoding (SQK-PCB)",
+		Left:     "GGTGCTG",
+		Right:    "TTAACCT",
+		BothEnds: true,
+		Barcodes: ontBarcodeSet("BP", 12, false),
+	},
+}
+
+func reverseComplement(seq string) string {
+	out := make([]byte, len(seq))
+	for i := 0; i < len(seq); i++ {
+		var c byte
+		switch seq[i] {
+		case 'A':
+			c = 'T'
+		case 'T', 'U':
+			c = 'A'
+		case 'C':
+			c = 'G'
+		case 'G':
+			c = 'C'
+		default:
+			c = 'N'
+		}
+		out[len(seq)-1-i] = c
+	}
+	return string(out)
+}
+
+// alignRows are the dynamic programming rows of alignInRead, a worker gets
+// them from alignScratch once per read and reuses them for every barcode.
+type alignRows struct {
+	prev, cur, prevStart, curStart []int
+}
+
+var alignScratch = sync.Pool{New: func() any { return new(alignRows) }}
+
+// reset sizes the rows for a query of n bases.
+func (r *alignRows) reset(n int) {
+	if cap(r.prev) < n+1 {
+		r.prev, r.cur = make([]int, n+1), make([]int, n+1)
+		r.prevStart, r.curStart = make([]int, n+1), make([]int, n+1)
+	}
+	r.prev, r.cur = r.prev[:n+1], r.cur[:n+1]
+	r.prevStart, r.curStart = r.prevStart[:n+1], r.curStart[:n+1]
+}
+
+// alignInRead finds query inside text with a semi-global alignment (free gaps
+// at both ends of text), returns identity (0-100) and start/end of the hit on text.
+func (r *alignRows) alignInRead(query, text string) (float64, int, int) {
+	n := len(query)
+	if n == 0 {
+		return 0, 0, 0
+	}
+	r.reset(n)
+	prev, cur, prevStart, curStart := r.prev, r.cur, r.prevStart, r.curStart
+	for i := 0; i <= n; i++ {
+		prev[i], prevStart[i] = i, 0
+	}
+	bestDist, bestStart, bestEnd := prev[n], 0, 0
+	for j := 1; j <= len(text); j++ {
+		cur[0], curStart[0] = 0, j
+		for i := 1; i <= n; i++ {
+			cost := 1
+			if query[i-1] == text[j-1] {
+				cost = 0
+			}
+			dist, start := prev[i-1]+cost, prevStart[i-1]
+			if cur[i-1]+1 < dist {
+				dist, start = cur[i-1]+1, curStart[i-1]
+			}
+			if prev[i]+1 < dist {
+				dist, start = prev[i]+1, prevStart[i]
+			}
+			cur[i], curStart[i] = dist, start
+		}
+		if cur[n] < bestDist {
+			bestDist, bestStart, bestEnd = cur[n], curStart[n], j
+		}
+		prev, cur = cur, prev
+		prevStart, curStart = curStart, prevStart
+	}
+	identity := float64(n-bestDist) * 100 / float64(n)
+	return identity, bestStart, bestEnd
+}
+
+type barcodeHit struct {
+	Barcode  int
+	Identity float64
+	Start    int
+	End      int
+}
+
+// ONTBarcoder assigns nanopore reads to a barcode of the kit and trims
+// barcodes and adapters, like the Porechop barcode binning.
+type ONTBarcoder struct {
+	Kit         ONTKit
+	RequireBoth bool    // barcode must be found on both ends with the same call
+	MinIdentity float64 // minimum identity of the barcode alignment
+	MinDiff     float64 // identity difference between the best and second barcode
+	SearchLen   int     // bases on each end of the read where the barcode is searched
+	starts      []string
+	ends        []string
+}
+
+func NewONTBarcoder(kitName string, requireBoth bool) (*ONTBarcoder, error) {
+	kit, ok := ONTKits[strings.ToUpper(kitName)]
+	if !ok {
+		names := make([]string, 0, len(ONTKits))
+		for name := range ONTKits {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown ONT kit %q (available: %s)", kitName, strings.Join(names, ", "))
+	}
+	if requireBoth && !kit.BothEnds {
+		return nil, fmt.Errorf("kit %s only has barcodes on the 5' end", kitName)
+	}
+	b := &ONTBarcoder{Kit: kit, RequireBoth: requireBoth, MinIdentity: 75, MinDiff: 5, SearchLen: 150}
+	for _, barcode := range kit.Barcodes {
+		construct := kit.Left + barcode.Index1 + kit.Right
+		b.starts = append(b.starts, construct)
+		b.ends = append(b.ends, reverseComplement(construct))
+	}
+	return b, nil
+}
+
+func (b *ONTBarcoder) Targets() []DemuxSample {
+	return b.Kit.Barcodes
+}
+
+// bestHit returns the best barcode on region and if it is clearly above the second one.
+func (b *ONTBarcoder) bestHit(rows *alignRows, constructs []string, region string) (barcodeHit, bool) {
+	best := barcodeHit{Barcode: -1}
+	second := 0.0
+	for i, construct := range constructs {
+		identity, start, end := rows.alignInRead(construct, region)
+		if identity > best.Identity {
+			second = best.Identity
+			best = barcodeHit{Barcode: i, Identity: identity, Start: start, End: end}
+		} else if identity > second {
+			second = identity
+		}
+	}
+	ok := best.Barcode != -1 && best.Identity >= b.MinIdentity && best.Identity-second >= b.MinDiff
+	return best, ok
+}
+
+// Assign returns the barcode name of the read and the read without barcodes and adapters.
+func (b *ONTBarcoder) Assign(read [4]string) (string, [4]string) {
+	bases := strings.ToUpper(strings.TrimSpace(read[1]))
+	quality := strings.TrimSpace(read[3])
+	searchLen := b.SearchLen
+	if searchLen > len(bases) {
+		searchLen = len(bases)
+	}
+	rows := alignScratch.Get().(*alignRows)
+	defer alignScratch.Put(rows)
+	startHit, startOK := b.bestHit(rows, b.starts, bases[:searchLen])
+	endOK := false
+	var endHit barcodeHit
+	endOffset := len(bases) - searchLen
+	if b.Kit.BothEnds {
+		endHit, endOK = b.bestHit(rows, b.ends, bases[endOffset:])
+	}
+
+	barcode := -1
+	switch {
+	case b.RequireBoth:
+		if startOK && endOK && startHit.Barcode == endHit.Barcode {
+			barcode = startHit.Barcode
+		}
+	case startOK && endOK:
+		// different calls on both ends are chimeras or ambiguous
+		if startHit.Barcode == endHit.Barcode {
+			barcode = startHit.Barcode
+		}
+	case startOK:
+		barcode = startHit.Barcode
+	case endOK:
+		barcode = endHit.Barcode
+	}
+	if barcode == -1 {
+		return UndeterminedSample, read
+	}
+
+	// trim everything from the read start to the barcode flank and after the 3' barcode
+	from, to := 0, len(bases)
+	if startOK && startHit.Barcode == barcode {
+		from = startHit.End
+	}
+	if endOK && endHit.Barcode == barcode && endOffset+endHit.Start > from {
+		to = endOffset + endHit.Start
+	}
+	// a quality of other length than the bases is left untrimmed, the invalid
+	// filter rejects the read
+	if len(quality) == len(bases) {
+		read[1] = strings.TrimSpace(read[1])[from:to] + "\n"
+		read[3] = quality[from:to] + "\n"
+	}
+	return b.Kit.Barcodes[barcode].Name, read
+}
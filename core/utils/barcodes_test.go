@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAlignInRead(t *testing.T) {
+	tests := []struct {
+		name        string
+		query, text string
+		identity    float64
+		start, end  int
+	}{
+		{"exact", "ACGTACGT", "TTTTACGTACGTTTTT", 100, 4, 12},
+		{"at the start", "ACGTACGT", "ACGTACGTGGGG", 100, 0, 8},
+		{"at the end", "ACGTACGT", "GGGGACGTACGT", 100, 4, 12},
+		{"mismatch", "ACGTACGT", "TTTTACGAACGTTTTT", 87.5, 4, 12},
+		{"deletion on text", "ACGTACGT", "TTTTACGACGTTTTT", 87.5, 4, 11},
+		{"insertion on text", "ACGTACGT", "TTTTACGTTACGTTTTT", 87.5, 4, 13},
+		{"empty query", "", "ACGT", 0, 0, 0},
+		{"empty text", "ACGT", "", 0, 0, 0},
+	}
+	rows := new(alignRows)
+	for _, tt := range tests {
+		// the rows are reused between the calls
+		identity, start, end := rows.alignInRead(tt.query, tt.text)
+		if identity != tt.identity || start != tt.start || end != tt.end {
+			t.Errorf("%s: got %.1f%% [%d,%d), want %.1f%% [%d,%d)", tt.name, identity, start, end, tt.identity, tt.start, tt.end)
+		}
+	}
+}
+
+func TestAlignRowsReset(t *testing.T) {
+	rows := new(alignRows)
+	rows.reset(30)
+	rows.reset(5)
+	if len(rows.prev) != 6 || len(rows.curStart) != 6 || cap(rows.prev) < 31 {
+		t.Errorf("rows of %d (cap %d), want 6 reusing the 31", len(rows.prev), cap(rows.prev))
+	}
+}
+
+func TestONTBarcoderAssign(t *testing.T) {
+	barcoder, err := NewONTBarcoder("nbd", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kit := barcoder.Kit
+	insert := strings.Repeat("ACGTTGCA", 40)
+	start := "TTGA" + kit.Left + kit.Barcodes[2].Index1 + kit.Right
+	end := reverseComplement(kit.Left + kit.Barcodes[2].Index1 + kit.Right)
+	otherEnd := reverseComplement(kit.Left + kit.Barcodes[5].Index1 + kit.Right)
+	tests := []struct {
+		name        string
+		bases       string
+		requireBoth bool
+		want        string
+		trimmed     string
+	}{
+		{"both ends", start + insert + end + "GG", false, "NB03", insert},
+		{"start only", start + insert, false, "NB03", insert},
+		{"end only", insert + end, false, "NB03", insert},
+		{"both required", start + insert, true, UndeterminedSample, ""},
+		{"different ends", start + insert + otherEnd, false, UndeterminedSample, ""},
+		{"no barcode", insert, false, UndeterminedSample, ""},
+	}
+	for _, tt := range tests {
+		barcoder.RequireBoth = tt.requireBoth
+		read := [4]string{"@r1\n", tt.bases + "\n", "+\n", strings.Repeat("I", len(tt.bases)) + "\n"}
+		name, out := barcoder.Assign(read)
+		if name != tt.want {
+			t.Errorf("%s: assigned to %s, want %s", tt.name, name, tt.want)
+			continue
+		}
+		if tt.trimmed == "" {
+			if out != read {
+				t.Errorf("%s: undetermined read was changed", tt.name)
+			}
+			continue
+		}
+		if out[1] != tt.trimmed+"\n" || len(out[3]) != len(out[1]) {
+			t.Errorf("%s: trimmed to %q (quality %d bytes), want %q", tt.name, out[1], len(out[3]), tt.trimmed)
+		}
+	}
+}
+
+func TestONTBarcoderQualityLength(t *testing.T) {
+	barcoder, err := NewONTBarcoder("NBD", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kit := barcoder.Kit
+	bases := kit.Left + kit.Barcodes[0].Index1 + kit.Right + strings.Repeat("ACGTTGCA", 20)
+	// a quality of other length than the bases is not trimmed
+	read := [4]string{"@r1\n", bases + "\n", "+\n", "IIII\n"}
+	name, out := barcoder.Assign(read)
+	if name != "NB01" || out != read {
+		t.Errorf("got %s %q, want NB01 with the read untrimmed", name, out)
+	}
+}
+
+func TestNewONTBarcoder(t *testing.T) {
+	tests := []struct {
+		kit         string
+		requireBoth bool
+		ok          bool
+	}{
+		{"NBD", true, true},
+		{"pcb", false, true},
+		{"RBK", false, true},
+		{"RBK", true, false},
+		{"XYZ", false, false},
+	}
+	for _, tt := range tests {
+		_, err := NewONTBarcoder(tt.kit, tt.requireBoth)
+		if (err == nil) != tt.ok {
+			t.Errorf("NewONTBarcoder(%s, %v): error %v", tt.kit, tt.requireBoth, err)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// inputBlock is a piece of the input of the size of a chunk, cut anywhere. The reads
+// whose header starts on the block belong to it, the worker of the block
+// finds them and completes the last one with the next blocks.
+type inputBlock struct {
+	id        int
+	offset    int64 // of the first byte on the input
+	data      []byte
+	lineStart bool // data starts a line
+	next      *inputBlock
+	last      bool
+}
+
+// blockSource reads the blocks in order. The dispatcher and the workers
+// that need the following block of a read share it, the first one to ask
+// reads it.
+type blockSource struct {
+	mu       sync.Mutex
+	reader   io.Reader
+	size     func() int // bytes of the next block
+	offset   int64
+	ended    bool
+	lastByte byte
+	err      error
+	progress *Progress
+}
+
+func newBlockSource(reader io.Reader, size func() int, progress *Progress) *blockSource {
+	return &blockSource{reader: reader, size: size, progress: progress}
+}
+
+// following returns the block after b (the first one when b is nil), nil at
+// the end of the input or after an error.
+func (s *blockSource) following(b *inputBlock) *inputBlock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b != nil && (b.next != nil || b.last) {
+		return b.next
+	}
+	if s.ended {
+		return nil
+	}
+	data := make([]byte, s.size())
+	n, err := io.ReadFull(s.reader, data)
+	s.progress.add(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		s.ended = true
+	} else if err != nil {
+		s.ended, s.err = true, err
+		return nil
+	}
+	if n == 0 {
+		if b != nil {
+			b.last = true
+		}
+		return nil
+	}
+	block := &inputBlock{
+		offset:    s.offset,
+		data:      data[:n],
+		lineStart: s.offset == 0 || s.lastByte == '\n',
+		last:      s.ended,
+	}
+	if b != nil {
+		block.id = b.id + 1
+		b.next = block
+	}
+	s.offset += int64(n)
+	s.lastByte = data[n-1]
+	return block
+}
+
+func (s *blockSource) failed() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// recordStart returns the offset of the first read of the block, the length
+// of the block when a read of a previous block covers it. A quality line can
+// also start with '@', so a header is a line starting with '@' whose third
+// line starts with '+': after a quality the third line is a sequence.
+// When the input ends before, a truncated last read, the second line must
+// be a sequence (after a quality it would be a header); blank lines at the
+// end of the input are the end.
+func (s *blockSource) recordStart(b *inputBlock) int {
+	off := 0
+	if !b.lineStart {
+		i := bytes.IndexByte(b.data, '\n')
+		if i < 0 {
+			return len(b.data)
+		}
+		off = i + 1
+	}
+	for off < len(b.data) {
+		if b.data[off] == '@' {
+			if s.isHeader(b, off) {
+				return off
+			}
+		}
+		i := bytes.IndexByte(b.data[off:], '\n')
+		if i < 0 {
+			break
+		}
+		off += i + 1
+	}
+	return len(b.data)
+}
+
+func (s *blockSource) isHeader(b *inputBlock, off int) bool {
+	c := blockCursor{source: s, block: b, off: off}
+	if !c.skipLines(1) {
+		return false
+	}
+	second := c.peek()
+	if c.skipLines(1) && !c.blankToEnd() {
+		return c.peek() == '+'
+	}
+	return second != 0 && second != '@'
+}
+
+// blockCursor walks the lines of the input across the blocks.
+type blockCursor struct {
+	source *blockSource
+	block  *inputBlock
+	off    int
+}
+
+// skipLines moves after n line breaks, false at the end of the input.
+func (c *blockCursor) skipLines(n int) bool {
+	for n > 0 {
+		if i := bytes.IndexByte(c.block.data[c.off:], '\n'); i >= 0 {
+			c.off += i + 1
+			n--
+			continue
+		}
+		next := c.source.following(c.block)
+		if next == nil {
+			return false
+		}
+		c.block, c.off = next, 0
+	}
+	return true
+}
+
+// blankToEnd reports if the input only has spaces and line breaks from the
+// cursor, the cursor does not move.
+func (c blockCursor) blankToEnd() bool {
+	for {
+		if c.off < len(c.block.data) {
+			if len(bytes.TrimLeft(c.block.data[c.off:], " \t\r\n")) > 0 {
+				return false
+			}
+		}
+		next := c.source.following(c.block)
+		if next == nil {
+			return true
+		}
+		c.block, c.off = next, 0
+	}
+}
+
+// peek returns the byte of the cursor, 0 at the end of the input.
+func (c *blockCursor) peek() byte {
+	for c.off >= len(c.block.data) {
+		next := c.source.following(c.block)
+		if next == nil {
+			return 0
+		}
+		c.block, c.off = next, 0
+	}
+	return c.block.data[c.off]
+}
+
+// load finds the reads of a block chunk, it runs on the worker. The reads are
+// groups of 4 lines from the first header of the block; the last one can
+// continue on the next blocks and is copied on the chunk buffer. The end of
+// the last read must be the first header found by the worker of the block
+// where it ends, otherwise the input is not a FASTQ of 4 lines per read.
+func (c *readChunk) load() error {
+	b := c.block
+	if b == nil {
+		return nil
+	}
+	c.buf = getRecordBuffer()
+	off := 0
+	if b.id > 0 {
+		off = c.source.recordStart(b)
+	}
+	// covered by a read of a previous block
+	if off == len(b.data) {
+		return nil
+	}
+	end, endOff := b, off
+	for off < len(b.data) {
+		if next, ok := groupEnd(b.data, off); ok {
+			record := c.trimLast(b.data[off:next], b, next)
+			c.buf.reads = append(c.buf.reads, splitRecord(record))
+			off, endOff = next, next
+			continue
+		}
+		var err error
+		if end, endOff, err = c.spill(off); err != nil {
+			return err
+		}
+		break
+	}
+	c.Reads = c.buf.reads
+	for end != nil && endOff == len(end.data) {
+		end, endOff = c.source.following(end), 0
+	}
+	if end == nil || c.source.recordStart(end) == endOff {
+		return nil
+	}
+	// the last lines without header (truncated read, blank lines) are the
+	// last read, like a group of less than 4 lines
+	if tail, ok := c.tail(end, endOff); ok {
+		if tail = trimBlankLines(tail); len(tail) > 0 {
+			c.buf.reads = append(c.buf.reads, splitRecord(tail))
+			c.Reads = c.buf.reads
+		}
+		return nil
+	}
+	return fmt.Errorf("input is not a FASTQ of 4 lines per read near byte %d", end.offset+int64(endOff))
+}
+
+// spill copies the last read of the block, from off, with the lines that
+// follow on the next blocks. Returns the block and offset where it ends.
+func (c *readChunk) spill(off int) (*inputBlock, int, error) {
+	block, end := c.block, len(c.block.data)
+	data := append(c.buf.data[:0], block.data[off:]...)
+	lines := bytes.Count(data, []byte{'\n'})
+	for lines < 4 {
+		next := c.source.following(block)
+		if next == nil {
+			break
+		}
+		block, end = next, 0
+		for lines < 4 {
+			i := bytes.IndexByte(next.data[end:], '\n')
+			if i < 0 {
+				end = len(next.data)
+				break
+			}
+			end += i + 1
+			lines++
+		}
+		// a block inside the read can not have a header
+		if lines < 4 && c.source.recordStart(next) != len(next.data) {
+			return nil, 0, fmt.Errorf("input is not a FASTQ of 4 lines per read near byte %d", next.offset)
+		}
+		data = append(data, next.data[:end]...)
+	}
+	c.buf.data = data
+	// the input ended: blank lines after the last read are not a read
+	if lines < 4 {
+		data = trimBlankLines(data)
+	} else {
+		data = c.trimLast(data, block, end)
+	}
+	if len(data) > 0 {
+		c.buf.reads = append(c.buf.reads, splitRecord(data))
+	}
+	return block, end, nil
+}
+
+// tail returns the input from off of block to the end when it has less than
+// 4 lines and no header.
+func (c *readChunk) tail(block *inputBlock, off int) ([]byte, bool) {
+	var data []byte
+	for ; block != nil; block = c.source.following(block) {
+		if c.source.recordStart(block) != len(block.data) {
+			return nil, false
+		}
+		data = append(data, block.data[off:]...)
+		if bytes.Count(data, []byte{'\n'}) >= 4 {
+			return nil, false
+		}
+		off = 0
+	}
+	return data, true
+}
+
+// trimLast removes the blank lines at the end of a read of 4 lines when
+// only blank lines follow it up to the end of the input (block from off).
+func (c *readChunk) trimLast(record []byte, block *inputBlock, off int) []byte {
+	trimmed := trimBlankLines(record)
+	if len(trimmed) == len(record) {
+		return record
+	}
+	if (blockCursor{source: c.source, block: block, off: off}).blankToEnd() {
+		return trimmed
+	}
+	return record
+}
+
+// trimBlankLines returns data without the blank lines at its end, empty when
+// all of them are blank.
+func trimBlankLines(data []byte) []byte {
+	end := len(bytes.TrimRight(data, " \t\r\n"))
+	if end == 0 {
+		return nil
+	}
+	if i := bytes.IndexByte(data[end:], '\n'); i >= 0 {
+		end += i + 1
+	}
+	return data[:end]
+}
+
+// groupEnd returns the offset after the 4th line break from off, false when
+// the block ends before.
+func groupEnd(data []byte, off int) (int, bool) {
+	for lines := 0; lines < 4; lines++ {
+		i := bytes.IndexByte(data[off:], '\n')
+		if i < 0 {
+			return 0, false
+		}
+		off += i + 1
+	}
+	return off, true
+}
+
+// splitRecord returns the lines of data (up to 4) with their line break,
+// like ReadString, as views on data.
+func splitRecord(data []byte) [4]string {
+	var read [4]string
+	for i := 0; i < 4 && len(data) > 0; i++ {
+		n := bytes.IndexByte(data, '\n') + 1
+		if n == 0 {
+			n = len(data)
+		}
+		read[i] = byteView(data[:n])
+		data = data[n:]
+	}
+	return read
+}
+
+// headBytes is the head of the input sampled for the bytes per read of the
+// first block.
+const headBytes = 64 << 10
+
+// headRecordBytes is the bytes per read of the head of the input.
+func headRecordBytes(head []byte) float64 {
+	if lines := bytes.Count(head, []byte{'\n'}); lines >= 4 {
+		return float64(len(head)) * 4 / float64(lines)
+	}
+	return float64(len(head))
+}
+
+// readChunks sends the chunks of reader to jobs, of the size given by sizer.
+// linesPerRead is 4 on FASTQ and 2 on FASTA, whose records are split on the
+// '>' headers (fastaChunks). FASTQ is cut on blocks of bytes parsed by the
+// workers (readChunk.load), so parsing scales with the threads; an input that
+// does not start with '@' is grouped by 4 lines by processChunks.
+func readChunks(reader *bufio.Reader, jobs chan<- readChunk, sizer *chunkSizer, linesPerRead int, progress *Progress, abort *runAbort) {
+	// Peek is limited to the buffer, a smaller reader only shows a part of
+	// the head
+	reader = bufio.NewReaderSize(reader, headBytes)
+	head, _ := reader.Peek(headBytes)
+	if linesPerRead == 2 {
+		fastaChunks(reader, jobs, sizer, progress, abort)
+		return
+	}
+	if len(head) > 0 && head[0] == '>' {
+		close(jobs)
+		abort.fail(errors.New("input starts with '>', it is a FASTA and not a FASTQ"))
+		return
+	}
+	if len(head) == 0 || head[0] != '@' {
+		processChunks(reader, jobs, sizer, progress, abort)
+		return
+	}
+	defer close(jobs)
+	recordBytes := headRecordBytes(head)
+	source := newBlockSource(reader, func() int { return sizer.blockBytes(recordBytes) }, progress)
+	for block := source.following(nil); block != nil; block = source.following(block) {
+		select {
+		case jobs <- readChunk{ID: block.id, lines: 4, block: block, source: source}:
+			slog.Debug("sent block to jobs", "block", block.id, "bytes", len(block.data))
+		case <-abort.done:
+			return
+		}
+	}
+	if err := source.failed(); err != nil {
+		abort.fail(fmt.Errorf("error reading input: %w", err))
+	}
+}
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// loadBlocks cuts data on blocks of size bytes and loads them like the
+// workers, in order, returning a copy of the reads.
+func loadBlocks(data []byte, size int) ([][4]string, error) {
+	source := newBlockSource(bytes.NewReader(data), func() int { return size }, nil)
+	var reads [][4]string
+	for block := source.following(nil); block != nil; block = source.following(block) {
+		chunk := readChunk{ID: block.id, block: block, source: source}
+		err := chunk.load()
+		for _, read := range chunk.Reads {
+			for i := range read {
+				read[i] = strings.Clone(read[i])
+			}
+			reads = append(reads, read)
+		}
+		chunk.buf.release()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return reads, source.failed()
+}
+
+func TestLoadBlocks(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  [][4]string
+	}{
+		{
+			name:  "reads",
+			input: "@r1\nACGT\n+\nIIII\n@r2\nGGCC\n+\nJJJJ\n",
+			want:  [][4]string{{"@r1\n", "ACGT\n", "+\n", "IIII\n"}, {"@r2\n", "GGCC\n", "+\n", "JJJJ\n"}},
+		},
+		{
+			name:  "quality starting with @",
+			input: "@r1\nACGT\n+\n@@II\n@r2\nGGCC\n+\n@JJJ\n@r3\nTTAA\n+r3\n@@@@\n",
+			want: [][4]string{
+				{"@r1\n", "ACGT\n", "+\n", "@@II\n"},
+				{"@r2\n", "GGCC\n", "+\n", "@JJJ\n"},
+				{"@r3\n", "TTAA\n", "+r3\n", "@@@@\n"},
+			},
+		},
+		{
+			name:  "no final line break",
+			input: "@r1\nACGT\n+\nIIII\n@r2\nGGCC\n+\nJJJJ",
+			want:  [][4]string{{"@r1\n", "ACGT\n", "+\n", "IIII\n"}, {"@r2\n", "GGCC\n", "+\n", "JJJJ"}},
+		},
+		{
+			name:  "truncated last read",
+			input: "@r1\nACGT\n+\nIIII\n@r2\nGGCC\n",
+			want:  [][4]string{{"@r1\n", "ACGT\n", "+\n", "IIII\n"}, {"@r2\n", "GGCC\n"}},
+		},
+		{
+			name:  "trailing blank lines",
+			input: "@r1\nACGT\n+\nIIII\n@r2\nGGCC\n+\nJJJJ\n\n\n",
+			want:  [][4]string{{"@r1\n", "ACGT\n", "+\n", "IIII\n"}, {"@r2\n", "GGCC\n", "+\n", "JJJJ\n"}},
+		},
+		{
+			name:  "truncated read and a blank line",
+			input: "@r1\nACGT\n+\nIIII\n@r2\nGGCC\n\n",
+			want:  [][4]string{{"@r1\n", "ACGT\n", "+\n", "IIII\n"}, {"@r2\n", "GGCC\n"}},
+		},
+		{
+			name:  "truncated read and blank lines",
+			input: "@r1\nACGT\n+\nIIII\n@r2\nGGCC\n\n \n\n",
+			want:  [][4]string{{"@r1\n", "ACGT\n", "+\n", "IIII\n"}, {"@r2\n", "GGCC\n"}},
+		},
+	}
+	for _, tt := range tests {
+		// every block size cuts the reads on a different place
+		for size := 1; size <= len(tt.input)+1; size++ {
+			got, err := loadBlocks([]byte(tt.input), size)
+			if err != nil {
+				t.Fatalf("%s, blocks of %d: %v", tt.name, size, err)
+			}
+			if !equalReads(got, tt.want) {
+				t.Fatalf("%s, blocks of %d: got %q, want %q", tt.name, size, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestLoadBlocksNotFastq(t *testing.T) {
+	// a read of 5 lines is found where the next block starts
+	input := "@r1\nACGT\nACGT\n+\nIIII\n@r2\nGGCC\n+\nJJJJ\n"
+	if _, err := loadBlocks([]byte(input), 8); err == nil {
+		t.Fatal("want an error on a read of 5 lines")
+	}
+}
+
+func TestTrimBlankLines(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"\n\n", ""},
+		{" \t\r\n", ""},
+		{"@r\nAC\n", "@r\nAC\n"},
+		{"@r\nAC\n\n \n", "@r\nAC\n"},
+		{"@r\nAC", "@r\nAC"},
+	}
+	for _, tt := range tests {
+		if got := string(trimBlankLines([]byte(tt.in))); got != tt.want {
+			t.Errorf("trimBlankLines(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
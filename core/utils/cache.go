@@ -1,14 +1,17 @@
 package utils
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 )
 
-func WriteTempFile(dir string, name string, content string) string {
+func WriteTempFile(dir string, name string, content []byte) (string, error) {
 	path := filepath.Join(dir, name)
-	_ = os.WriteFile(path, []byte(content), 0o644)
-	return path
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		return path, fmt.Errorf("error write temporal file: %w", err)
+	}
+	return path, nil
 }
 
 func ReadTempFile(path string) string {
@@ -0,0 +1,285 @@
+package utils
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type FileChecksum struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5,omitempty"`
+	SHA256 string `json:"sha256"`
+}
+
+func ChecksumFile(path string) (FileChecksum, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileChecksum{Path: path}, err
+	}
+	defer f.Close()
+	w := newChecksumWriter(io.Discard)
+	if _, err := io.Copy(w, f); err != nil {
+		return FileChecksum{Path: path}, fmt.Errorf("error read %s: %w", path, err)
+	}
+	return w.checksum(path), nil
+}
+
+// checksumWriter computes md5 and sha256 of the bytes written to w, so the
+// outputs are hashed while they are written.
+type checksumWriter struct {
+	w      io.Writer
+	md5    hash.Hash
+	sha256 hash.Hash
+	size   int64
+}
+
+func newChecksumWriter(w io.Writer) *checksumWriter {
+	return &checksumWriter{w: w, md5: md5.New(), sha256: sha256.New()}
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.md5.Write(p[:n])
+	c.sha256.Write(p[:n])
+	c.size += int64(n)
+	return n, err
+}
+
+func (c *checksumWriter) checksum(path string) FileChecksum {
+	return FileChecksum{Path: path, Size: c.size, MD5: hex.EncodeToString(c.md5.Sum(nil)), SHA256: hex.EncodeToString(c.sha256.Sum(nil))}
+}
+
+// WriteChecksumFiles saves <path>.md5 and <path>.sha256 on the format of
+// md5sum and sha256sum.
+func WriteChecksumFiles(checksum FileChecksum) error {
+	name := filepath.Base(checksum.Path)
+	for ext, sum := range map[string]string{".md5": checksum.MD5, ".sha256": checksum.SHA256} {
+		if err := os.WriteFile(checksum.Path+ext, []byte(sum+"  "+name+"\n"), 0o644); err != nil {
+			return fmt.Errorf("can't write checksum: %w", err)
+		}
+	}
+	return nil
+}
+
+// Artifact is a file produced by the run, Reads is set on sequence files.
+type Artifact struct {
+	Kind string `json:"kind"`
+	FileChecksum
+	Reads *int64 `json:"reads,omitempty"`
+}
+
+// RunManifest lists the files produced by a run, the paths are relative to
+// the folder of the manifest when they are inside it.
+type RunManifest struct {
+	Tool      string     `json:"tool"`
+	Sample    string     `json:"sample"`
+	CreatedAt time.Time  `json:"created_at"`
+	Files     []Artifact `json:"files"`
+}
+
+// RunLog is the state of one run: the timings of its phases and the files it
+// produces for the manifest. A run creates one with NewRunLog and passes it on
+// its options, a nil RunLog only logs the phases.
+type RunLog struct {
+	mu        sync.Mutex
+	phases    []PhaseTiming
+	artifacts []Artifact
+}
+
+func NewRunLog() *RunLog {
+	return &RunLog{}
+}
+
+// RecordArtifact adds a produced file to the manifest of the run, a file
+// recorded again replaces the previous entry. reads < 0 when it has no reads.
+func (l *RunLog) RecordArtifact(kind string, checksum FileChecksum, reads int64) {
+	if l == nil {
+		return
+	}
+	artifact := Artifact{Kind: kind, FileChecksum: checksum}
+	if reads >= 0 {
+		artifact.Reads = &reads
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.artifacts {
+		if l.artifacts[i].Path == checksum.Path {
+			l.artifacts[i] = artifact
+			return
+		}
+	}
+	l.artifacts = append(l.artifacts, artifact)
+}
+
+// RecordFile hashes a file written without checksumWriter and records it.
+func (l *RunLog) RecordFile(kind, path string) error {
+	if l == nil {
+		return nil
+	}
+	checksum, err := ChecksumFile(path)
+	if err != nil {
+		return err
+	}
+	l.RecordArtifact(kind, checksum, -1)
+	return nil
+}
+
+// forgetArtifact removes a file deleted by the run.
+func (l *RunLog) forgetArtifact(path string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.artifacts {
+		if l.artifacts[i].Path == path {
+			l.artifacts = append(l.artifacts[:i], l.artifacts[i+1:]...)
+			return
+		}
+	}
+}
+
+// artifactReads returns the reads of a recorded file, -1 when unknown.
+func (l *RunLog) artifactReads(path string) int64 {
+	if l == nil {
+		return -1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, artifact := range l.artifacts {
+		if artifact.Path == path && artifact.Reads != nil {
+			return *artifact.Reads
+		}
+	}
+	return -1
+}
+
+// recordPluginOutputs records, with their checksum files, the files next to
+// the output whose name starts with the output name and that were written
+// by the plugins since start. <output>.gz is the compressed output with its
+// reads.
+func (l *RunLog) recordPluginOutputs(outputPath string, since time.Time, reads int64) error {
+	if l == nil {
+		return nil
+	}
+	dir, prefix := filepath.Dir(outputPath), filepath.Base(outputPath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	recorded := map[string]bool{}
+	l.mu.Lock()
+	for _, artifact := range l.artifacts {
+		recorded[artifact.Path] = true
+	}
+	l.mu.Unlock()
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || recorded[path] || strings.HasSuffix(name, ".md5") || strings.HasSuffix(name, ".sha256") {
+			continue
+		}
+		// the file systems stamp the files with a coarse clock, a file
+		// written just after since can have an older time
+		info, err := entry.Info()
+		if err != nil || info.ModTime().Before(since.Add(-time.Second)) {
+			continue
+		}
+		checksum, err := ChecksumFile(path)
+		if err != nil {
+			return err
+		}
+		if err := WriteChecksumFiles(checksum); err != nil {
+			return err
+		}
+		if path == outputPath+".gz" {
+			l.RecordArtifact("compressed", checksum, reads)
+		} else {
+			l.RecordArtifact("plugin", checksum, -1)
+		}
+		slog.Info("plugin output recorded", "path", path)
+	}
+	return nil
+}
+
+// WriteManifest saves the files recorded by the run on path.
+func (l *RunLog) WriteManifest(path, sample string) error {
+	manifest := RunManifest{Tool: "MARIA", Sample: sample, CreatedAt: time.Now()}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if l != nil {
+		l.mu.Lock()
+		for _, artifact := range l.artifacts {
+			if abs, err := filepath.Abs(artifact.Path); err == nil {
+				if rel, err := filepath.Rel(dir, abs); err == nil && !strings.HasPrefix(rel, "..") {
+					artifact.Path = rel
+				}
+			}
+			manifest.Files = append(manifest.Files, artifact)
+		}
+		l.mu.Unlock()
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encode manifest: %w", err)
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// VerifyResult is the check of a file of a manifest, Err is nil when the
+// size, md5 and sha256 match.
+type VerifyResult struct {
+	Path string
+	Err  error
+}
+
+// VerifyManifest hashes again the files of a manifest.
+func VerifyManifest(path string) ([]VerifyResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read manifest: %w", err)
+	}
+	var manifest RunManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	dir := filepath.Dir(path)
+	results := make([]VerifyResult, 0, len(manifest.Files))
+	for _, file := range manifest.Files {
+		filePath := file.Path
+		if !filepath.IsAbs(filePath) {
+			filePath = filepath.Join(dir, filePath)
+		}
+		result := VerifyResult{Path: file.Path}
+		actual, err := ChecksumFile(filePath)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			result.Err = errors.New("missing")
+		case err != nil:
+			result.Err = err
+		case actual.Size != file.Size:
+			result.Err = fmt.Errorf("size %d, manifest %d", actual.Size, file.Size)
+		case file.MD5 != "" && actual.MD5 != file.MD5:
+			result.Err = errors.New("md5 mismatch")
+		case actual.SHA256 != file.SHA256:
+			result.Err = errors.New("sha256 mismatch")
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChecksumFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := ChecksumFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FileChecksum{
+		Path:   path,
+		Size:   3,
+		MD5:    "900150983cd24fb0d6963f7d28e17f72",
+		SHA256: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+	}
+	if checksum != want {
+		t.Errorf("got %+v, want %+v", checksum, want)
+	}
+}
+
+func TestRunLogArtifacts(t *testing.T) {
+	run := NewRunLog()
+	run.RecordArtifact("output", FileChecksum{Path: "out.fastq", Size: 1}, 10)
+	run.RecordArtifact("report", FileChecksum{Path: "report.json", Size: 2}, -1)
+	// recorded again replaces the entry
+	run.RecordArtifact("output", FileChecksum{Path: "out.fastq", Size: 3}, 7)
+	if reads := run.artifactReads("out.fastq"); reads != 7 {
+		t.Errorf("reads %d, want 7", reads)
+	}
+	if reads := run.artifactReads("report.json"); reads != -1 {
+		t.Errorf("reads of a report %d, want -1", reads)
+	}
+	run.forgetArtifact("out.fastq")
+	if len(run.artifacts) != 1 || run.artifacts[0].Path != "report.json" {
+		t.Errorf("artifacts %+v, want only report.json", run.artifacts)
+	}
+	// the runs do not share their files
+	if other := NewRunLog(); other.artifactReads("report.json") != -1 || len(other.artifacts) != 0 {
+		t.Error("a new run has the files of another run")
+	}
+	// a nil run records nothing
+	var none *RunLog
+	none.RecordArtifact("output", FileChecksum{Path: "x"}, 1)
+	if none.artifactReads("x") != -1 || none.PhaseTimings() != nil {
+		t.Error("nil run recorded")
+	}
+}
+
+func TestRunLogPhases(t *testing.T) {
+	run := NewRunLog()
+	run.NextPhase("first", 1)
+	run.NextPhase("second", 2)
+	phases := run.PhaseTimings()
+	if len(phases) != 2 || phases[0].Title != "first" || phases[1].Phase != 2 {
+		t.Fatalf("phases %+v", phases)
+	}
+	if phases[1].Start.Before(phases[0].Start) || phases[0].Seconds < 0 {
+		t.Errorf("phases out of order: %+v", phases)
+	}
+}
+
+func TestRecordPluginOutputs(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "clean.fastq")
+	start := time.Now()
+	for _, name := range []string{"clean.fastq.gz", "clean.fastq.tsv", "clean.fastq.gz.md5", "other.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := NewRunLog()
+	if err := run.recordPluginOutputs(output, start, 12); err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[string]string{}
+	for _, artifact := range run.artifacts {
+		kinds[filepath.Base(artifact.Path)] = artifact.Kind
+	}
+	want := map[string]string{"clean.fastq.gz": "compressed", "clean.fastq.tsv": "plugin"}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("recorded %v, want %v", kinds, want)
+	}
+	if reads := run.artifactReads(output + ".gz"); reads != 12 {
+		t.Errorf("reads of the compressed output %d, want 12", reads)
+	}
+	if reads := run.artifactReads(output + ".tsv"); reads != -1 {
+		t.Errorf("reads of a plugin file %d, want -1", reads)
+	}
+}
+
+func TestVerifyManifest(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"clean.fastq": "@r1\nACGT\n+\nIIII\n", "size.txt": "abc", "same.txt": "abc", "gone.txt": "x"}
+	run := NewRunLog()
+	for _, name := range []string{"clean.fastq", "size.txt", "same.txt", "gone.txt"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(files[name]), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := run.RecordFile("output", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifestPath := filepath.Join(dir, "clean_manifest.json")
+	if err := run.WriteManifest(manifestPath, "clean"); err != nil {
+		t.Fatal(err)
+	}
+	// the paths inside the folder of the manifest are relative
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest RunManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 4 || manifest.Files[0].Path != "clean.fastq" || manifest.Sample != "clean" {
+		t.Fatalf("manifest %+v", manifest)
+	}
+
+	os.WriteFile(filepath.Join(dir, "size.txt"), []byte("abcd"), 0o644)
+	os.WriteFile(filepath.Join(dir, "same.txt"), []byte("abd"), 0o644)
+	os.Remove(filepath.Join(dir, "gone.txt"))
+	results, err := VerifyManifest(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"clean.fastq": "",
+		"size.txt":    "size 4, manifest 3",
+		"same.txt":    "md5 mismatch",
+		"gone.txt":    "missing",
+	}
+	if len(results) != len(want) {
+		t.Fatalf("%d results, want %d", len(results), len(want))
+	}
+	for _, result := range results {
+		got := ""
+		if result.Err != nil {
+			got = result.Err.Error()
+		}
+		if got != want[result.Path] {
+			t.Errorf("%s: %q, want %q", result.Path, got, want[result.Path])
+		}
+	}
+	if _, err := VerifyManifest(filepath.Join(dir, "none.json")); err == nil {
+		t.Error("want an error without manifest")
+	}
+}
@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+const (
+	chunkSampleBytes   = 8 << 20 // head of the input read to estimate the chunk size
+	minChunkReads      = 10
+	maxChunksPerThread = 100 // one temporal file per chunk
+	chunksInFlight     = 4   // per thread: queued, on the worker and waiting to be written
+	chunkAdaptRange    = 16  // the adapted size stays between initial/16 and initial*16
+	chunkTimeMin       = 100 * time.Millisecond
+	chunkTimeTarget    = 300 * time.Millisecond
+	chunkTimeMax       = time.Second
+)
+
+// AutoEstimateChunks returns the reads per chunk, the estimated number of
+// chunks and the usable memory per core (MB) without reading the whole
+// input: the bytes per read of the first chunkSampleBytes and the size of the
+// file give its reads. A chunk takes the memory target of a thread, at least
+// enough reads to have maxChunksPerThread chunks per thread and at most the
+// share of a thread or the memory budget of the chunks in flight.
+func AutoEstimateChunks(filepath string, lines, threads int) (int, int, float64, error) {
+	if threads <= 0 {
+		threads = AvailableCPU()
+	}
+	memory := availableMemPerCore() / 1024.0 / 1024.0
+	info, err := infoFile(filepath)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	recordBytes, err := sampleRecordBytes(filepath, lines)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("error read file: %w", err)
+	}
+	if recordBytes == 0 {
+		return 1000, 0, memory, nil
+	}
+	reads := int(float64(info.Size()) / recordBytes)
+	chunkSize := int(targetMemPerThread() / recordBytes)
+	if minSize := reads / (threads * maxChunksPerThread); chunkSize < minSize {
+		chunkSize = minSize
+	}
+	// every thread gets a chunk
+	if share := reads / threads; chunkSize > share {
+		chunkSize = share
+	}
+	if maxSize := maxChunkReads(recordBytes, threads); chunkSize > maxSize {
+		chunkSize = maxSize
+	}
+	if chunkSize < minChunkReads {
+		chunkSize = minChunkReads
+	}
+	totalChunks := int(math.Ceil(float64(reads) / float64(chunkSize)))
+	return chunkSize, totalChunks, memory, nil
+}
+
+// sampleRecordBytes returns the mean bytes per read of the first
+// chunkSampleBytes of the file, 0 when it is empty.
+func sampleRecordBytes(filename string, linesPerSeq int) (float64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	sample := make([]byte, chunkSampleBytes)
+	n, err := io.ReadFull(file, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	sample = sample[:n]
+	if n == 0 {
+		return 0, nil
+	}
+	lines := bytes.Count(sample, []byte{'\n'})
+	if n == chunkSampleBytes {
+		// only the complete lines of a cut sample
+		sample = sample[:bytes.LastIndexByte(sample, '\n')+1]
+	} else if sample[n-1] != '\n' {
+		lines++
+	}
+	// a line longer than the sample
+	if lines == 0 {
+		return float64(n), nil
+	}
+	return float64(len(sample)) / float64(lines) * float64(linesPerSeq), nil
+}
+
+// maxChunkReads is the chunk that keeps the chunks in flight of all the
+// threads on the usable RAM.
+func maxChunkReads(recordBytes float64, threads int) int {
+	usable := UsableRAM()
+	if usable == 0 || recordBytes <= 0 {
+		return math.MaxInt32
+	}
+	return int(float64(usable) / float64(threads*chunksInFlight) / recordBytes)
+}
+
+// chunkSizer gives the reads of the next chunk to the reader. When adapt is
+// on the workers report each chunk and the size moves so a chunk takes
+// chunkTimeTarget on a worker when it is out of [chunkTimeMin, chunkTimeMax],
+// and it is halved while the heap is over the usable RAM.
+type chunkSizer struct {
+	mu          sync.Mutex
+	reads       int
+	initial     int
+	adapt       bool
+	threads     int
+	budget      uint64
+	secPerRead  float64 // moving average of the workers
+	recordBytes float64 // moving average of the chunks
+}
+
+func newChunkSizer(reads int, adapt bool, threads int) *chunkSizer {
+	if reads <= 0 {
+		reads = 1000
+	}
+	return &chunkSizer{reads: reads, initial: reads, adapt: adapt, threads: threads, budget: UsableRAM()}
+}
+
+// size returns the reads of the next chunk.
+func (s *chunkSizer) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads
+}
+
+// blockBytes returns the bytes of the next block, recordBytes is used until
+// the workers report chunks. An adapted size is kept between 1 MB and 256 MB,
+// a size given by the user is taken as it is.
+func (s *chunkSizer) blockBytes(recordBytes float64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.recordBytes > 0 {
+		recordBytes = s.recordBytes
+	}
+	size := max(int(float64(s.reads)*recordBytes), 1)
+	if !s.adapt {
+		return size
+	}
+	return min(max(size, 1<<20), 256<<20)
+}
+
+// observe adds a chunk of reads (size bytes of input) loaded and cleaned by a
+// worker in elapsed.
+func (s *chunkSizer) observe(reads, size int, elapsed time.Duration) {
+	if !s.adapt || reads == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secPerRead = movingAverage(s.secPerRead, elapsed.Seconds()/float64(reads))
+	s.recordBytes = movingAverage(s.recordBytes, float64(size)/float64(reads))
+
+	next := s.reads
+	chunkTime := time.Duration(s.secPerRead * float64(s.reads) * float64(time.Second))
+	if chunkTime < chunkTimeMin || chunkTime > chunkTimeMax {
+		next = int(chunkTimeTarget.Seconds() / s.secPerRead)
+	}
+	heap := heapBytes()
+	if s.budget > 0 && heap > s.budget && next >= s.reads {
+		next = s.reads / 2
+	} else if s.budget > 0 && heap > s.budget/2 && next > s.reads {
+		next = s.reads // no room to grow
+	}
+	if maxSize := maxChunkReads(s.recordBytes, s.threads); next > maxSize {
+		next = maxSize
+	}
+	if next > s.initial*chunkAdaptRange {
+		next = s.initial * chunkAdaptRange
+	}
+	if next < s.initial/chunkAdaptRange {
+		next = s.initial / chunkAdaptRange
+	}
+	if next < minChunkReads {
+		next = minChunkReads
+	}
+	if next != s.reads {
+		slog.Debug("chunk size adapted", "reads", next, "previous", s.reads, "chunk_ms", chunkTime.Milliseconds(), "heap_mb", heap>>20)
+		s.reads = next
+	}
+}
+
+// logFinal reports the size reached when it moved from the initial one.
+func (s *chunkSizer) logFinal() {
+	if reads := s.size(); reads != s.initial {
+		slog.Info("chunk size adapted", "initial", s.initial, "final", reads)
+	}
+}
+
+func movingAverage(average, value float64) float64 {
+	if average == 0 {
+		return value
+	}
+	return 0.7*average + 0.3*value
+}
+
+// heapBytes returns the memory of the live and not yet swept objects.
+func heapBytes() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestChunkSizerBlockBytes(t *testing.T) {
+	tests := []struct {
+		name        string
+		reads       int
+		adapt       bool
+		recordBytes float64
+		want        int
+	}{
+		{"given size", 500, false, 300, 150000},
+		{"given size over the limit", 2000000, false, 300, 600000000},
+		{"adapted under 1 MB", 500, true, 300, 1 << 20},
+		{"adapted", 10000, true, 300, 3000000},
+		{"adapted over 256 MB", 2000000, true, 300, 256 << 20},
+	}
+	for _, tt := range tests {
+		sizer := newChunkSizer(tt.reads, tt.adapt, 4)
+		if got := sizer.blockBytes(tt.recordBytes); got != tt.want {
+			t.Errorf("%s: %d bytes, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestChunkSizerObserve(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial int
+		adapt   bool
+		budget  uint64 // 0 does not check the heap
+		reads   int
+		elapsed time.Duration
+		want    int
+	}{
+		{"given size", 1000, false, 0, 1000, 10 * time.Millisecond, 1000},
+		{"empty chunk", 1000, true, 0, 0, time.Second, 1000},
+		{"in range", 1000, true, 0, 1000, 300 * time.Millisecond, 1000},
+		// to the size that takes 300 ms
+		{"slow", 1000, true, 0, 1000, 3 * time.Second, 100},
+		{"fast", 1000, true, 0, 1000, 50 * time.Millisecond, 6000},
+		{"up to 16 times", 1000, true, 0, 1000, time.Millisecond, 16000},
+		{"down to 1/16", 1000, true, 0, 1000, time.Minute, 62},
+		{"at least 10 reads", 100, true, 0, 100, time.Minute, minChunkReads},
+		// the heap is always over 1 byte
+		{"heap over the budget", 1000, true, 1, 1000, 300 * time.Millisecond, 500},
+	}
+	for _, tt := range tests {
+		sizer := newChunkSizer(tt.initial, tt.adapt, 4)
+		sizer.budget = tt.budget
+		sizer.observe(tt.reads, tt.reads*300, tt.elapsed)
+		// one read of rounding on the seconds per read
+		if got := sizer.size(); got < tt.want-1 || got > tt.want+1 {
+			t.Errorf("%s: %d reads, want %d", tt.name, got, tt.want)
+		}
+	}
+	// the bytes per read of the chunks are a moving average
+	sizer := newChunkSizer(1000, true, 4)
+	sizer.budget = 0
+	sizer.observe(1000, 300000, 300*time.Millisecond)
+	sizer.observe(1000, 100000, 300*time.Millisecond)
+	if got := sizer.blockBytes(1000); got != 1<<20 || sizer.recordBytes != 240 {
+		t.Errorf("%d bytes per block, %f per read", got, sizer.recordBytes)
+	}
+}
+
+func TestReadChunksGivenSize(t *testing.T) {
+	data := syntheticReads(5000)
+	sizer := newChunkSizer(500, false, 2)
+	jobs := make(chan readChunk, 100)
+	readChunks(bufio.NewReader(bytes.NewReader(data)), jobs, sizer, 4, nil, newRunAbort())
+	chunks, reads := 0, 0
+	for chunk := range jobs {
+		if err := chunk.load(); err != nil {
+			t.Fatal(err)
+		}
+		// the blocks are bytes for 500 reads of the head, the names of the
+		// next reads have more digits
+		if n := len(chunk.Reads); chunk.ID < 9 && (n < 490 || n > 510) {
+			t.Errorf("chunk %d: %d reads, want about 500", chunk.ID, n)
+		}
+		chunks++
+		reads += len(chunk.Reads)
+		chunk.buf.release()
+	}
+	if chunks < 10 || chunks > 11 || reads != 5000 {
+		t.Errorf("%d chunks of %d reads, want 10 of 5000", chunks, reads)
+	}
+}
@@ -1,81 +1,77 @@
 package utils
 
-import (
-	"log"
-)
-
-func cleanIllumina(seqs []Sequence, details bool) ([]Sequence, error) {
-	adapters, err := loadAdapters("config/adapters.json")
-	qualities, errQ := loadQualities("config/quality.json")
-	if err != nil {
-		log.Fatalf("Error to load adapters: %v", err)
+// filterSequence applies the filters of the profile on the trimmed read and
+// returns the first one that rejects it.
+func filterSequence(original, trimmed Sequence, profile Profile) RejectReason {
+	if reason := invalidFilter(original); reason != "" {
+		return reason
+	}
+	if reason := adapterOnlyFilter(original, trimmed); reason != "" {
+		return reason
+	}
+	if reason := qualityFilter(trimmed, profile.Threshold, profile.MaxBadBases); reason != "" {
+		return reason
 	}
-	if errQ != nil {
-		log.Fatalf("Error to load qualities: %v", err)
+	if reason := lengthFilter(trimmed, profile.Minbases); reason != "" {
+		return reason
 	}
-	var cleaned []Sequence
+	return homopolymerFilter(trimmed, profile.Homo)
+}
+
+// The clean functions append the reads that pass to cleaned and the others to
+// rejected, the slices are reused between reads.
+func cleanIllumina(seqs []Sequence, profile Profile, stats *CleanStats, cleaned []Sequence, rejected []RejectedRead) ([]Sequence, []RejectedRead) {
 	for _, seq := range seqs {
-		seq = trimAdapters(seq, adapters["Illumina"])
-		if validateQuality(seq.Quality, qualities["Illumina"].Threshold, qualities["Illumina"].MaxBadBases) && isValidLength(seq.Bases, qualities["Illumina"].Minbases) && !hasHomopolymer(seq.Bases, qualities["Illumina"].Homo) {
-			cleaned = append(cleaned, seq)
+		trimmed, adapter := trimAdapters(seq, profile.Adapters)
+		stats.countAdapter(adapter)
+		// two color instruments (NovaSeq, NextSeq)
+		if profile.PolyG > 0 {
+			trimmed = trimPolyG(trimmed, profile.PolyG)
+		}
+		if reason := filterSequence(seq, trimmed, profile); reason != "" {
+			rejected = append(rejected, RejectedRead{Seq: seq, Reason: reason})
+			continue
 		}
+		cleaned = append(cleaned, trimmed)
 	}
-	return cleaned, err
+	return cleaned, rejected
 }
 
-func cleanNanopore(seqs []Sequence, details bool) ([]Sequence, error) {
-	adapters, err := loadAdapters("config/adapters.json")
-	qualities, errQ := loadQualities("config/quality.json")
-	if err != nil {
-		log.Fatalf("Error to load adapters: %v", err)
-	}
-	if errQ != nil {
-		log.Fatalf("Error to load qualities: %v", err)
-	}
-	var cleaned []Sequence
+func cleanNanopore(seqs []Sequence, profile Profile, stats *CleanStats, cleaned []Sequence, rejected []RejectedRead) ([]Sequence, []RejectedRead) {
 	for _, seq := range seqs {
-		seq = trimAdapters(seq, adapters["OxfordNanopore"])
-		if validateQuality(seq.Quality, qualities["OxfordNanopore"].Threshold, qualities["OxfordNanopore"].MaxBadBases) && isValidLength(seq.Bases, qualities["OxfordNanopore"].Minbases) && !hasHomopolymer(seq.Bases, qualities["OxfordNanopore"].Homo) {
-			cleaned = append(cleaned, seq)
+		trimmed, adapter := trimAdapters(seq, profile.Adapters)
+		stats.countAdapter(adapter)
+		if reason := filterSequence(seq, trimmed, profile); reason != "" {
+			rejected = append(rejected, RejectedRead{Seq: seq, Reason: reason})
+			continue
 		}
+		cleaned = append(cleaned, trimmed)
 	}
-	return cleaned, err
+	return cleaned, rejected
 }
 
-func cleanPacBio(seqs []Sequence, details bool) ([]Sequence, error) {
-	adapters, err := loadAdapters("config/adapters.json")
-	qualities, errQ := loadQualities("config/quality.json")
-	if err != nil {
-		log.Fatalf("Error to load adapters: %v", err)
-	}
-	if errQ != nil {
-		log.Fatalf("Error to load qualities: %v", err)
-	}
-	var cleaned []Sequence
+func cleanPacBio(seqs []Sequence, profile Profile, stats *CleanStats, cleaned []Sequence, rejected []RejectedRead) ([]Sequence, []RejectedRead) {
 	for _, seq := range seqs {
-		seq = trimAdapters(seq, adapters["PacBio"])
-		if validateQuality(seq.Quality, qualities["PacBio"].Threshold, qualities["PacBio"].MaxBadBases) && isValidLength(seq.Bases, qualities["PacBio"].Minbases) && !hasHomopolymer(seq.Bases, qualities["PacBio"].Homo) {
-			cleaned = append(cleaned, seq)
+		trimmed, adapter := trimAdapters(seq, profile.Adapters)
+		stats.countAdapter(adapter)
+		if reason := filterSequence(seq, trimmed, profile); reason != "" {
+			rejected = append(rejected, RejectedRead{Seq: seq, Reason: reason})
+			continue
 		}
+		cleaned = append(cleaned, trimmed)
 	}
-	return cleaned, err
+	return cleaned, rejected
 }
 
-func cleanIonTorrent(seqs []Sequence, details bool) ([]Sequence, error) {
-	adapters, err := loadAdapters("config/adapters.json")
-	qualities, errQ := loadQualities("config/quality.json")
-	if err != nil {
-		log.Fatalf("Error to load adapters: %v", err)
-	}
-	if errQ != nil {
-		log.Fatalf("Error to load qualities: %v", err)
-	}
-	var cleaned []Sequence
+func cleanIonTorrent(seqs []Sequence, profile Profile, stats *CleanStats, cleaned []Sequence, rejected []RejectedRead) ([]Sequence, []RejectedRead) {
 	for _, seq := range seqs {
-		seq = trimAdapters(seq, adapters["IonTorrent"])
-		if validateQuality(seq.Quality, qualities["IonTorrent"].Threshold, qualities["IonTorrent"].MaxBadBases) && isValidLength(seq.Bases, qualities["IonTorrent"].Minbases) && !hasHomopolymer(seq.Bases, qualities["IonTorrent"].Homo) {
-			cleaned = append(cleaned, seq)
+		trimmed, adapter := trimAdapters(seq, profile.Adapters)
+		stats.countAdapter(adapter)
+		if reason := filterSequence(seq, trimmed, profile); reason != "" {
+			rejected = append(rejected, RejectedRead{Seq: seq, Reason: reason})
+			continue
 		}
+		cleaned = append(cleaned, trimmed)
 	}
-	return cleaned, err
+	return cleaned, rejected
 }
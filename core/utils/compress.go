@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// bgzfBlockSize is the uncompressed size of a BGZF block (as htslib), the
+// compressed block always fits on the 16 bits of BSIZE.
+const bgzfBlockSize = 0xff00
+
+// bgzfEOF is the empty block that ends a BGZF file.
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// CompressOptions of CompressFile, Level 0 uses 6 and Threads 0 all the cores.
+type CompressOptions struct {
+	Level          int
+	Threads        int
+	RemoveOriginal bool    // after the compressed file is verified
+	Run            *RunLog // records the compressed file for the manifest
+}
+
+// CompressFile writes path.gz as BGZF: independent gzip blocks compressed on
+// parallel and written in order, readable by gzip, zcat and htslib (bgzip,
+// samtools, tabix). The checksums of the compressed file are returned and
+// saved on path.gz.md5 and path.gz.sha256. With RemoveOriginal the compressed file is read back
+// and compared with the original before it is removed.
+func CompressFile(path string, opts CompressOptions) (FileChecksum, error) {
+	if opts.Level == 0 {
+		opts.Level = 6
+	}
+	if opts.Level < flate.BestSpeed || opts.Level > flate.BestCompression {
+		return FileChecksum{}, fmt.Errorf("compression level %d, want 1-9", opts.Level)
+	}
+	if opts.Threads <= 0 {
+		opts.Threads = AvailableCPU()
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return FileChecksum{}, fmt.Errorf("can't open file to compress: %w", err)
+	}
+	defer src.Close()
+	gzPath := path + ".gz"
+	dst, err := os.Create(gzPath)
+	if err != nil {
+		return FileChecksum{}, fmt.Errorf("can't create compressed file: %w", err)
+	}
+	originalHash, size, checksum, err := writeBGZF(src, dst, opts)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(gzPath)
+		return FileChecksum{}, fmt.Errorf("error compressing %s: %w", path, err)
+	}
+	checksum.Path = gzPath
+	slog.Info("file compressed", "path", gzPath, "bytes_in", size, "bytes_out", checksum.Size, "sha256", checksum.SHA256)
+	if err := WriteChecksumFiles(checksum); err != nil {
+		return checksum, err
+	}
+	opts.Run.RecordArtifact("compressed", checksum, opts.Run.artifactReads(path))
+	if opts.RemoveOriginal {
+		if err := verifyGzip(gzPath, originalHash, size); err != nil {
+			return checksum, fmt.Errorf("compressed file not verified, %s is kept: %w", path, err)
+		}
+		src.Close()
+		if err := os.Remove(path); err != nil {
+			return checksum, fmt.Errorf("can't remove original: %w", err)
+		}
+		os.Remove(path + ".md5")
+		os.Remove(path + ".sha256")
+		opts.Run.forgetArtifact(path)
+		slog.Info("original removed after verification", "path", path)
+	}
+	return checksum, nil
+}
+
+type bgzfBlock struct {
+	data []byte
+	out  chan bgzfResult
+}
+
+type bgzfResult struct {
+	block []byte
+	err   error
+}
+
+// writeBGZF returns the sha256 and size of src and the checksum of the
+// compressed output.
+func writeBGZF(src io.Reader, dst io.Writer, opts CompressOptions) (string, int64, FileChecksum, error) {
+	jobs := make(chan *bgzfBlock, opts.Threads*2)
+	order := make(chan *bgzfBlock, opts.Threads*4)
+	originalHash := sha256.New()
+	var size int64
+	var readErr error
+	// reader: blocks go to the workers and, in the same order, to the writer
+	go func() {
+		defer close(order)
+		defer close(jobs)
+		reader := bufio.NewReaderSize(src, 1<<20)
+		for {
+			data := make([]byte, bgzfBlockSize)
+			n, err := io.ReadFull(reader, data)
+			if n > 0 {
+				originalHash.Write(data[:n])
+				size += int64(n)
+				block := &bgzfBlock{data: data[:n], out: make(chan bgzfResult, 1)}
+				order <- block
+				jobs <- block
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return
+			}
+			if err != nil {
+				readErr = err
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf bytes.Buffer
+			fw, err := flate.NewWriter(&buf, opts.Level)
+			for block := range jobs {
+				if err != nil {
+					block.out <- bgzfResult{err: err}
+					continue
+				}
+				compressed, err := compressBGZFBlock(fw, &buf, block.data)
+				block.out <- bgzfResult{block: compressed, err: err}
+			}
+		}()
+	}
+	compressed := newChecksumWriter(dst)
+	out := bufio.NewWriterSize(compressed, 1<<20)
+	var writeErr error
+	for block := range order {
+		result := <-block.out
+		// keep draining after an error so the reader and workers end
+		if writeErr != nil {
+			continue
+		}
+		if writeErr = result.err; writeErr == nil {
+			_, writeErr = out.Write(result.block)
+		}
+	}
+	wg.Wait()
+	if writeErr == nil {
+		writeErr = readErr
+	}
+	if writeErr == nil {
+		_, writeErr = out.Write(bgzfEOF)
+	}
+	if writeErr == nil {
+		writeErr = out.Flush()
+	}
+	checksum := compressed.checksum("")
+	return hex.EncodeToString(originalHash.Sum(nil)), size, checksum, writeErr
+}
+
+// compressBGZFBlock builds a gzip member with the BC extra field of BGZF,
+// BSIZE is the size of the block minus one.
+func compressBGZFBlock(fw *flate.Writer, buf *bytes.Buffer, data []byte) ([]byte, error) {
+	buf.Reset()
+	buf.Write([]byte{0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43, 0x02, 0x00, 0x00, 0x00})
+	fw.Reset(buf)
+	if _, err := fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[0:4], crc32.ChecksumIEEE(data))
+	binary.LittleEndian.PutUint32(trailer[4:8], uint32(len(data)))
+	buf.Write(trailer[:])
+	block := append([]byte(nil), buf.Bytes()...)
+	binary.LittleEndian.PutUint16(block[16:18], uint16(len(block)-1))
+	return block, nil
+}
+
+// verifyGzip decompresses path and compares it with the original.
+func verifyGzip(path, sha256Hex string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader, err := gzip.NewReader(bufio.NewReaderSize(f, 1<<20))
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, reader)
+	if err != nil {
+		return err
+	}
+	if n != size || hex.EncodeToString(h.Sum(nil)) != sha256Hex {
+		return fmt.Errorf("decompressed %d bytes differ from the original (%d bytes)", n, size)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteBGZF(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 3*bgzfBlockSize+100)
+	rng.Read(random)
+	tests := []struct {
+		name   string
+		data   []byte
+		blocks int // without the EOF block
+	}{
+		{"empty", nil, 0},
+		{"small", []byte("@r1\nACGT\n+\nIIII\n"), 1},
+		{"one block", bytes.Repeat([]byte("A"), bgzfBlockSize), 1},
+		{"blocks", bytes.Repeat([]byte("@r1\nACGT\n+\nIIII\n"), 20000), 5},
+		{"random", random, 4},
+	}
+	for _, tt := range tests {
+		for _, threads := range []int{1, 4} {
+			var out bytes.Buffer
+			hash, size, checksum, err := writeBGZF(bytes.NewReader(tt.data), &out, CompressOptions{Level: 6, Threads: threads})
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			sum := sha256.Sum256(tt.data)
+			if hash != hex.EncodeToString(sum[:]) || size != int64(len(tt.data)) {
+				t.Errorf("%s: original hash %s size %d, want %x %d", tt.name, hash, size, sum, len(tt.data))
+			}
+			if checksum.Size != int64(out.Len()) {
+				t.Errorf("%s: checksum size %d, output %d", tt.name, checksum.Size, out.Len())
+			}
+			if !bytes.HasSuffix(out.Bytes(), bgzfEOF) {
+				t.Errorf("%s: missing BGZF EOF block", tt.name)
+			}
+			if blocks := bgzfBlocks(t, out.Bytes()); blocks != tt.blocks+1 {
+				t.Errorf("%s, %d threads: %d blocks, want %d", tt.name, threads, blocks, tt.blocks+1)
+			}
+			// the members are read back in order by gzip
+			reader, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("%s, %d threads: decompressed data differs", tt.name, threads)
+			}
+		}
+	}
+}
+
+// bgzfBlocks walks the blocks by their BSIZE, as htslib does, and checks the
+// BC extra field of each one.
+func bgzfBlocks(t *testing.T, data []byte) int {
+	t.Helper()
+	blocks := 0
+	for len(data) > 0 {
+		if len(data) < 18 || data[0] != 0x1f || data[1] != 0x8b || data[3]&0x04 == 0 || data[12] != 'B' || data[13] != 'C' {
+			t.Fatalf("block %d is not BGZF", blocks)
+		}
+		size := int(binary.LittleEndian.Uint16(data[16:18])) + 1
+		if size > len(data) {
+			t.Fatalf("block %d: BSIZE %d over the data", blocks, size)
+		}
+		data = data[size:]
+		blocks++
+	}
+	return blocks
+}
+
+func TestCompressFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "reads.fastq")
+	data := bytes.Repeat([]byte("@r1\nACGT\n+\nIIII\n"), 5000)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	run := NewRunLog()
+	run.RecordArtifact("output", FileChecksum{Path: path}, 5000)
+	checksum, err := CompressFile(path, CompressOptions{Threads: 2, RemoveOriginal: true, Run: run})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(path) {
+		t.Error("original not removed")
+	}
+	for _, ext := range []string{"", ".md5", ".sha256"} {
+		if !fileExists(path + ".gz" + ext) {
+			t.Errorf("missing %s.gz%s", path, ext)
+		}
+	}
+	if reads := run.artifactReads(checksum.Path); reads != 5000 {
+		t.Errorf("compressed file recorded with %d reads, want 5000", reads)
+	}
+	if reads := run.artifactReads(path); reads != -1 {
+		t.Error("removed original is still recorded")
+	}
+	if _, err := CompressFile(path+".gz", CompressOptions{Level: 10}); err == nil {
+		t.Error("want an error on level 10")
+	}
+}
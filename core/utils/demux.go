@@ -0,0 +1,382 @@
+package utils
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// UndeterminedSample is the bucket for reads without a unique barcode match.
+const UndeterminedSample = "undetermined"
+
+var sampleNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+type DemuxSample struct {
+	Name   string
+	Index1 string
+	Index2 string // optional, dual index
+}
+
+type DemuxCount struct {
+	Sample  string `json:"sample"`
+	Barcode string `json:"barcode"`
+	Reads   int    `json:"reads"`
+	Kept    int    `json:"kept"`
+}
+
+// ReadAssigner routes each read to one of its targets, it may trim the read.
+// Reads without target are assigned to UndeterminedSample.
+type ReadAssigner interface {
+	Assign(read [4]string) (string, [4]string)
+	Targets() []DemuxSample
+}
+
+// Demuxer assigns reads to samples by barcode.
+// Inline: barcodes are read on the sequence (index1 at 5', index2 at 3') and trimmed,
+// otherwise they are read from the header (Illumina "1:N:0:INDEX1+INDEX2").
+type Demuxer struct {
+	Samples    []DemuxSample
+	Mismatches int
+	Inline     bool
+}
+
+// LoadSampleSheet reads a CSV with the columns: sample,index[,index2]
+// a first line starting with "sample" is taken as header.
+func LoadSampleSheet(filename string) ([]DemuxSample, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	var samples []DemuxSample
+	seen := map[string]bool{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error read sample sheet: %w", err)
+		}
+		if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "sample") {
+			continue
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("line %d: expected sample,index[,index2]", line)
+		}
+		sample := DemuxSample{
+			Name:   strings.TrimSpace(record[0]),
+			Index1: strings.ToUpper(strings.TrimSpace(record[1])),
+		}
+		if len(record) > 2 {
+			sample.Index2 = strings.ToUpper(strings.TrimSpace(record[2]))
+		}
+		if !sampleNamePattern.MatchString(sample.Name) || sample.Name == UndeterminedSample {
+			return nil, fmt.Errorf("line %d: invalid sample name %q", line, sample.Name)
+		}
+		if sample.Index1 == "" {
+			return nil, fmt.Errorf("line %d: sample %s without index", line, sample.Name)
+		}
+		if seen[sample.Name] {
+			return nil, fmt.Errorf("line %d: duplicated sample %s", line, sample.Name)
+		}
+		seen[sample.Name] = true
+		samples = append(samples, sample)
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("sample sheet %s is empty", filename)
+	}
+	return samples, nil
+}
+
+func (d *Demuxer) Targets() []DemuxSample {
+	return d.Samples
+}
+
+func (s DemuxSample) Barcode() string {
+	if s.Index2 == "" {
+		return s.Index1
+	}
+	return s.Index1 + "+" + s.Index2
+}
+
+// hammingDistance counts mismatches, N on the read counts as mismatch.
+func hammingDistance(observed, expected string) int {
+	if len(observed) != len(expected) {
+		return len(expected) + 1
+	}
+	dist := 0
+	for i := 0; i < len(expected); i++ {
+		if observed[i] != expected[i] {
+			dist++
+		}
+	}
+	return dist
+}
+
+// headerIndexes extracts the index from an Illumina header: "@... 1:N:0:ATCACG+GTTTCG".
+func headerIndexes(header string) (string, string) {
+	fields := strings.Fields(header)
+	if len(fields) < 2 {
+		return "", ""
+	}
+	comment := fields[len(fields)-1]
+	pos := strings.LastIndex(comment, ":")
+	if pos == -1 {
+		return "", ""
+	}
+	index := strings.ToUpper(comment[pos+1:])
+	if first, second, ok := strings.Cut(index, "+"); ok {
+		return first, second
+	}
+	return index, ""
+}
+
+// Assign returns the sample of the read and the read without inline barcodes.
+func (d *Demuxer) Assign(read [4]string) (string, [4]string) {
+	bases := strings.TrimSpace(read[1])
+	quality := strings.TrimSpace(read[3])
+	observed1, observed2 := headerIndexes(read[0])
+	best, bestDist, ties := -1, 0, 0
+	for i, sample := range d.Samples {
+		if d.Inline {
+			if len(bases) < len(sample.Index1)+len(sample.Index2) {
+				continue
+			}
+			observed1 = strings.ToUpper(bases[:len(sample.Index1)])
+			observed2 = strings.ToUpper(bases[len(bases)-len(sample.Index2):])
+		}
+		// mismatches are allowed per index
+		dist := hammingDistance(observed1, sample.Index1)
+		if dist > d.Mismatches {
+			continue
+		}
+		if sample.Index2 != "" {
+			dist2 := hammingDistance(observed2, sample.Index2)
+			if dist2 > d.Mismatches {
+				continue
+			}
+			dist += dist2
+		}
+		switch {
+		case best == -1 || dist < bestDist:
+			best, bestDist, ties = i, dist, 0
+		case dist == bestDist:
+			ties++
+		}
+	}
+	// no match or ambiguous match
+	if best == -1 || ties > 0 {
+		return UndeterminedSample, read
+	}
+	sample := d.Samples[best]
+	// a quality of other length than the bases is left untrimmed, the invalid
+	// filter rejects the read
+	if d.Inline && len(quality) == len(bases) {
+		end := len(bases) - len(sample.Index2)
+		read[1] = bases[len(sample.Index1):end] + "\n"
+		read[3] = quality[len(sample.Index1):end] + "\n"
+	}
+	return sample.Name, read
+}
+
+// ParallelDemux cleans the reads and routes them to <outputDir>/<sample>.fastq,
+// the files are recorded on run for the manifest.
+func ParallelDemux(
+	inputPath,
+	outputDir string,
+	chunkSize int,
+	profile Profile,
+	threads int,
+	tempDir string,
+	demuxer ReadAssigner,
+	details bool,
+	splitChimeras bool,
+	run *RunLog,
+) ([]DemuxCount, *CleanStats, error) {
+	if threads <= 0 {
+		threads = AvailableCPU()
+	}
+	slog.Info("threads", "count", threads)
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("error create output dir: %w", err)
+	}
+	reader, closeInput, err := SmartReadFile(inputPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error open file: %w", err)
+	}
+	defer closeInput()
+	// bucket 0 is undetermined, the samples follow the sheet order
+	buckets := []string{UndeterminedSample}
+	bucketOf := map[string]int{UndeterminedSample: 0}
+	counts := []DemuxCount{{Sample: UndeterminedSample}}
+	for _, sample := range demuxer.Targets() {
+		bucketOf[sample.Name] = len(buckets)
+		buckets = append(buckets, sample.Name)
+		counts = append(counts, DemuxCount{Sample: sample.Name, Barcode: sample.Barcode()})
+	}
+
+	jobs := make(chan readChunk, threads*2)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	totals := NewCleanStats()
+	totals.Threads, totals.ChunkSize = threads, chunkSize
+	abort := newRunAbort()
+	demuxChunk := func(chunk readChunk) error {
+		outs := make([][]byte, len(buckets))
+		local := make([]DemuxCount, len(buckets))
+		stats := NewCleanStats()
+		kept := chunk.buf.kept
+		var rejectedChunk []RejectedRead
+		for _, read := range chunk.Reads {
+			name, trimmed := demuxer.Assign(read)
+			bucket := bucketOf[name]
+			local[bucket].Reads++
+			stats.ReadsIn++
+			before := len(rejectedChunk)
+			var err error
+			kept, rejectedChunk, err = cleanRead(trimmed, chunk.lines, profile, splitChimeras, stats, kept[:0], rejectedChunk)
+			if err != nil {
+				return err
+			}
+			for _, r := range rejectedChunk[before:] {
+				stats.Rejected[r.Reason]++
+			}
+			if !details {
+				rejectedChunk = rejectedChunk[:0]
+			}
+			for _, cleaned := range kept {
+				local[bucket].Kept++
+				stats.ReadsOut++
+				stats.BasesOut += int64(len(cleaned.Bases))
+				outs[bucket] = appendRecord(outs[bucket], cleaned)
+			}
+		}
+		chunk.buf.kept = kept
+		for bucket := range outs {
+			if len(outs[bucket]) > 0 {
+				if _, err := WriteTempFile(tempDir, chunkFileName(chunk.ID, fmt.Sprintf("b%04d", bucket)), outs[bucket]); err != nil {
+					return err
+				}
+			}
+		}
+		if details {
+			if err := writeRejected(tempDir, chunk.ID, rejectedChunk); err != nil {
+				return err
+			}
+		}
+		mu.Lock()
+		for bucket := range local {
+			counts[bucket].Reads += local[bucket].Reads
+			counts[bucket].Kept += local[bucket].Kept
+		}
+		mu.Unlock()
+		stats.Chunks++
+		totals.merge(stats)
+		return nil
+	}
+	run.NextPhase("Run demultiplexing on parallel threads", 4)
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for chunk := range jobs {
+				if abort.failed() {
+					chunk.buf.release()
+					continue
+				}
+				err := chunk.load()
+				slog.Debug("worker received chunk", "worker", id, "chunk", chunk.ID, "reads", len(chunk.Reads))
+				if err == nil {
+					err = demuxChunk(chunk)
+				}
+				chunk.buf.release()
+				if err != nil {
+					abort.fail(fmt.Errorf("worker %d, chunk %d: %w", id, chunk.ID, err))
+				}
+			}
+		}(i)
+	}
+	progress := NewProgress(inputPath, totals)
+	progress.Start()
+	readChunks(reader, jobs, newChunkSizer(chunkSize, false, threads), 4, progress, abort)
+	wg.Wait()
+	progress.Stop()
+	if abort.err != nil {
+		removeChunks(tempDir)
+		return nil, nil, abort.err
+	}
+
+	run.NextPhase("Generating files per sample", 5)
+	for bucket, name := range buckets {
+		pattern := filepath.Join(tempDir, fmt.Sprintf("chunk_*_b%04d.tmp", bucket))
+		outputPath := filepath.Join(outputDir, name+".fastq")
+		checksum, err := mergeFiles(pattern, outputPath)
+		if err != nil {
+			return counts, totals, err
+		}
+		if err := WriteChecksumFiles(checksum); err != nil {
+			return counts, totals, err
+		}
+		run.RecordArtifact("sample", checksum, int64(counts[bucket].Kept))
+	}
+	if details {
+		if err := mergeRejected(tempDir, filepath.Join(outputDir, "details"), ".fastq", totals, run); err != nil {
+			return counts, totals, err
+		}
+	}
+	reportPath := filepath.Join(outputDir, "demux_report.csv")
+	if err := writeDemuxReport(reportPath, counts); err != nil {
+		return counts, totals, err
+	}
+	if err := run.RecordFile("report", reportPath); err != nil {
+		return counts, totals, err
+	}
+	slog.Info("demultiplexing report written", "path", reportPath)
+	return counts, totals, nil
+}
+
+func writeDemuxReport(path string, counts []DemuxCount) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error to create report: %w", err)
+	}
+	defer f.Close()
+	writer := csv.NewWriter(f)
+	writer.Write([]string{"sample", "barcode", "reads", "kept"})
+	for _, c := range counts {
+		writer.Write([]string{c.Sample, c.Barcode, fmt.Sprint(c.Reads), fmt.Sprint(c.Kept)})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// PrintDemuxCounts shows the reads per sample on stdout.
+func PrintDemuxCounts(counts []DemuxCount) {
+	total := 0
+	for _, c := range counts {
+		total += c.Reads
+	}
+	fmt.Printf("%-24s %-36s %12s %12s %8s\n", "Sample", "Barcode", "Reads", "Kept", "%")
+	for _, c := range counts {
+		percent := 0.0
+		if total > 0 {
+			percent = float64(c.Reads) * 100 / float64(total)
+		}
+		fmt.Printf("%-24s %-36s %12d %12d %7.2f%%\n", c.Sample, c.Barcode, c.Reads, c.Kept, percent)
+	}
+	if total == 0 {
+		slog.Warn("no reads demultiplexed")
+	}
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadSampleSheet(t *testing.T) {
+	tests := []struct {
+		name    string
+		sheet   string
+		want    []DemuxSample
+		wantErr bool
+	}{
+		{"header and dual index", "sample,index,index2\nS1, acgt ,TTGA\n# comment\nS2,GGCC\n", []DemuxSample{{"S1", "ACGT", "TTGA"}, {"S2", "GGCC", ""}}, false},
+		{"no header", "S1,ACGT\n", []DemuxSample{{"S1", "ACGT", ""}}, false},
+		{"no index", "S1\n", nil, true},
+		{"empty index", "S1,\n", nil, true},
+		{"invalid name", "S 1,ACGT\n", nil, true},
+		{"undetermined", "undetermined,ACGT\n", nil, true},
+		{"duplicated", "S1,ACGT\nS1,GGCC\n", nil, true},
+		{"empty", "sample,index\n", nil, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "sheet.csv")
+		if err := os.WriteFile(path, []byte(tt.sheet), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		samples, err := LoadSampleSheet(path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(samples, tt.want) {
+			t.Errorf("%s: samples %+v, want %+v", tt.name, samples, tt.want)
+		}
+	}
+}
+
+func TestDemuxerAssign(t *testing.T) {
+	samples := []DemuxSample{{"S1", "ACGTAC", "TTGACC"}, {"S2", "GGCCAA", "TTGACC"}, {"S3", "ACGTTT", ""}}
+	tests := []struct {
+		name     string
+		inline   bool
+		read     [4]string
+		want     string
+		wantRead [4]string
+	}{
+		{"exact", false, [4]string{"@r 1:N:0:ACGTAC+TTGACC\n", "ACGT\n", "+\n", "IIII\n"}, "S1", [4]string{}},
+		{"one mismatch", false, [4]string{"@r 1:N:0:GGCCAT+TTGACC\n", "ACGT\n", "+\n", "IIII\n"}, "S2", [4]string{}},
+		{"single index", false, [4]string{"@r 1:N:0:ACGTTT\n", "ACGT\n", "+\n", "IIII\n"}, "S3", [4]string{}},
+		{"too many mismatches", false, [4]string{"@r 1:N:0:AAAAAA+TTGACC\n", "ACGT\n", "+\n", "IIII\n"}, UndeterminedSample, [4]string{}},
+		// one mismatch from S1 and S3
+		{"ambiguous", false, [4]string{"@r 1:N:0:ACGTAT+TTGACC\n", "ACGT\n", "+\n", "IIII\n"}, UndeterminedSample, [4]string{}},
+		{"no index", false, [4]string{"@r\n", "ACGT\n", "+\n", "IIII\n"}, UndeterminedSample, [4]string{}},
+		{"inline trimmed", true, [4]string{"@r\n", "GGCCAACCCCTTGACC\n", "+\n", "ABCDEFGHIJKLMNOP\n"}, "S2",
+			[4]string{"@r\n", "CCCC\n", "+\n", "GHIJ\n"}},
+		{"inline quality length", true, [4]string{"@r\n", "GGCCAACCCCTTGACC\n", "+\n", "ABC\n"}, "S2", [4]string{}},
+	}
+	for _, tt := range tests {
+		demuxer := &Demuxer{Samples: samples, Mismatches: 1, Inline: tt.inline}
+		name, read := demuxer.Assign(tt.read)
+		if tt.wantRead == ([4]string{}) {
+			tt.wantRead = tt.read
+		}
+		if name != tt.want || read != tt.wantRead {
+			t.Errorf("%s: %s %q, want %s %q", tt.name, name, read, tt.want, tt.wantRead)
+		}
+	}
+}
+
+func TestParallelDemux(t *testing.T) {
+	// one in three reads for each sample and for undetermined
+	indexes := [][]byte{[]byte("GGGG"), []byte("ACGT"), []byte("TTTT")}
+	lines := bytes.Split(syntheticReads(3000), []byte("\n"))
+	for i := 0; i+1 < len(lines); i += 4 {
+		lines[i] = append(bytes.TrimSuffix(lines[i], []byte("ACGT")), indexes[(i/4)%3]...)
+	}
+	dir := t.TempDir()
+	input := filepath.Join(dir, "reads.fastq")
+	if err := os.WriteFile(input, bytes.Join(lines, []byte("\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tempDir, outDir := t.TempDir(), filepath.Join(dir, "demux")
+	demuxer := &Demuxer{Samples: []DemuxSample{{Name: "S1", Index1: "ACGT"}, {Name: "S2", Index1: "GGGG"}}, Mismatches: 1}
+	run := NewRunLog()
+	counts, stats, err := ParallelDemux(input, outDir, 200, illuminaProfile(t), 3, tempDir, demuxer, true, false, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DemuxCount{{Sample: UndeterminedSample, Reads: 1000}, {Sample: "S1", Barcode: "ACGT", Reads: 1000}, {Sample: "S2", Barcode: "GGGG", Reads: 1000}}
+	kept := 0
+	for i, count := range counts {
+		kept += count.Kept
+		records, err := os.ReadFile(filepath.Join(outDir, count.Sample+".fastq"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := bytes.Count(records, []byte("\n")); lines != 4*count.Kept {
+			t.Errorf("%s: %d lines for %d kept reads", count.Sample, lines, count.Kept)
+		}
+		if run.artifactReads(filepath.Join(outDir, count.Sample+".fastq")) != int64(count.Kept) {
+			t.Errorf("%s: not recorded with its reads", count.Sample)
+		}
+		count.Kept = 0
+		if i >= len(want) || count != want[i] {
+			t.Errorf("count %+v", count)
+		}
+	}
+	if stats.ReadsIn != 3000 || int64(kept) != stats.ReadsOut || kept == 0 {
+		t.Errorf("%d in, %d out, %d kept on the samples", stats.ReadsIn, stats.ReadsOut, kept)
+	}
+	for _, name := range []string{"demux_report.csv", "details"} {
+		if _, err := os.Stat(filepath.Join(outDir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if left, _ := filepath.Glob(filepath.Join(tempDir, "*.tmp")); len(left) > 0 {
+		t.Errorf("temporal chunks left: %v", left)
+	}
+}
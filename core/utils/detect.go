@@ -0,0 +1,279 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultTechConfidence is the minimum probability to accept a detected technology.
+const DefaultTechConfidence = 0.7
+
+// KnownTechs are the technologies supported by the cleaners.
+var KnownTechs = []string{"Illumina", "Oxford Nanopore", "PacBio", "Ion Torrent"}
+
+// header patterns of each technology
+var (
+	// @<instrument>:<run>:<flowcell>:<lane>:<tile>:<x>:<y> [<read>:<filtered>:<control>:<index>]
+	illuminaHeader = regexp.MustCompile(`^@[A-Za-z0-9_-]+:\d+:[A-Za-z0-9_-]+:\d+:\d+:\d+:\d+(\s|$)`)
+	// old Casava: @<instrument>:<lane>:<tile>:<x>:<y>#<index>/<read>
+	illuminaOldHeader = regexp.MustCompile(`^@[A-Za-z0-9_-]+:\d+:\d+:\d+:\d+#[A-Za-z0-9]+/[12]`)
+	nanoporeHeader    = regexp.MustCompile(`(^[@>][0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})|runid=|\sch=\d+|start_time=|flow_cell_id=|basecall_model_version_id=`)
+	// movie name m64011_190830_220126/<zmw>/ccs or /<start>_<end>
+	pacbioHeader = regexp.MustCompile(`^[@>]m\d+[eUu]?_\d+_\d+/\d+(/ccs|/\d+_\d+|/|\s|$)`)
+	// @<run>:<row>:<column>, ex: @ZW1Y3:00035:00211
+	ionTorrentHeader = regexp.MustCompile(`^@[A-Z0-9]{5}:\d{5}:\d{5}(\s|$)`)
+)
+
+type TechScore struct {
+	Tech        string   `json:"name"`
+	Probability float64  `json:"confidence"`
+	Evidence    []string `json:"evidence"`
+}
+
+// TechDetection is the ranking of technologies for a sample of reads.
+type TechDetection struct {
+	Ranking []TechScore
+	Reads   int
+}
+
+func (d TechDetection) Best() TechScore {
+	if len(d.Ranking) == 0 {
+		return TechScore{}
+	}
+	return d.Ranking[0]
+}
+
+func (d TechDetection) String() string {
+	var b strings.Builder
+	for _, score := range d.Ranking {
+		fmt.Fprintf(&b, "  %-16s %5.1f%%", score.Tech, score.Probability*100)
+		if len(score.Evidence) > 0 {
+			fmt.Fprintf(&b, "  (%s)", strings.Join(score.Evidence, "; "))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// sampleRead is a parsed read of the sample, quality is empty on fasta.
+type sampleRead struct {
+	Header  string
+	Bases   string
+	Quality string
+}
+
+// parseSampleReads reads fastq (4 lines) or fasta records from the first lines of the file.
+func parseSampleReads(lines []string) []sampleRead {
+	var reads []sampleRead
+	if len(lines) > 0 && strings.HasPrefix(lines[0], ">") {
+		for _, line := range lines {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, ">") {
+				reads = append(reads, sampleRead{Header: line})
+			} else if len(reads) > 0 {
+				reads[len(reads)-1].Bases += line
+			}
+		}
+		return reads
+	}
+	for i := 0; i+3 < len(lines); i += 4 {
+		reads = append(reads, sampleRead{
+			Header:  strings.TrimSpace(lines[i]),
+			Bases:   strings.TrimSpace(lines[i+1]),
+			Quality: strings.TrimSpace(lines[i+3]),
+		})
+	}
+	return reads
+}
+
+type techEvidence struct {
+	logScore map[string]float64
+	evidence map[string][]string
+}
+
+func (e *techEvidence) add(tech string, weight float64, reason string) {
+	e.logScore[tech] += weight
+	if weight > 0 {
+		e.evidence[tech] = append(e.evidence[tech], reason)
+	}
+}
+
+// ClassifySequencingTech combines header patterns, length distribution,
+// quality alphabet and homopolymer runs of the sample into a probability per
+// technology (softmax of the evidence scores).
+func ClassifySequencingTech(lines []string) TechDetection {
+	reads := parseSampleReads(lines)
+	e := &techEvidence{logScore: map[string]float64{}, evidence: map[string][]string{}}
+	if len(reads) > 0 {
+		headerEvidence(e, reads)
+		lengthEvidence(e, reads)
+		qualityEvidence(e, reads)
+		homopolymerEvidence(e, reads)
+	}
+
+	detection := TechDetection{Reads: len(reads)}
+	maxScore := math.Inf(-1)
+	for _, tech := range KnownTechs {
+		maxScore = math.Max(maxScore, e.logScore[tech])
+	}
+	total := 0.0
+	for _, tech := range KnownTechs {
+		total += math.Exp(e.logScore[tech] - maxScore)
+	}
+	for _, tech := range KnownTechs {
+		detection.Ranking = append(detection.Ranking, TechScore{
+			Tech:        tech,
+			Probability: math.Exp(e.logScore[tech]-maxScore) / total,
+			Evidence:    e.evidence[tech],
+		})
+	}
+	sort.SliceStable(detection.Ranking, func(i, j int) bool {
+		return detection.Ranking[i].Probability > detection.Ranking[j].Probability
+	})
+	return detection
+}
+
+func headerEvidence(e *techEvidence, reads []sampleRead) {
+	counts := map[string]int{}
+	for _, read := range reads {
+		switch {
+		case illuminaHeader.MatchString(read.Header) || illuminaOldHeader.MatchString(read.Header):
+			counts["Illumina"]++
+		case pacbioHeader.MatchString(read.Header):
+			counts["PacBio"]++
+		case nanoporeHeader.MatchString(read.Header):
+			counts["Oxford Nanopore"]++
+		case ionTorrentHeader.MatchString(read.Header):
+			counts["Ion Torrent"]++
+		}
+	}
+	for tech, count := range counts {
+		fraction := float64(count) / float64(len(reads))
+		e.add(tech, 6*fraction, fmt.Sprintf("%.0f%% headers match %s format", fraction*100, tech))
+	}
+}
+
+func lengthEvidence(e *techEvidence, reads []sampleRead) {
+	lengths := make([]float64, len(reads))
+	sum := 0.0
+	for i, read := range reads {
+		lengths[i] = float64(len(read.Bases))
+		sum += lengths[i]
+	}
+	sort.Float64s(lengths)
+	median := lengths[len(lengths)/2]
+	mean := sum / float64(len(lengths))
+	variance := 0.0
+	for _, l := range lengths {
+		variance += (l - mean) * (l - mean)
+	}
+	cv := 0.0
+	if mean > 0 {
+		cv = math.Sqrt(variance/float64(len(lengths))) / mean
+	}
+
+	switch {
+	case median <= 400:
+		reason := fmt.Sprintf("short reads (median %.0f bp)", median)
+		e.add("Illumina", 1.5, reason)
+		e.add("Ion Torrent", 1.5, reason)
+		e.add("Oxford Nanopore", -2, reason)
+		e.add("PacBio", -2, reason)
+	case median >= 1000:
+		reason := fmt.Sprintf("long reads (median %.0f bp)", median)
+		e.add("Oxford Nanopore", 1.5, reason)
+		e.add("PacBio", 1.5, reason)
+		e.add("Illumina", -3, reason)
+		e.add("Ion Torrent", -3, reason)
+	}
+	if median <= 400 {
+		// Illumina cycles give the same length, Ion Torrent flows give variable lengths
+		if cv < 0.05 {
+			e.add("Illumina", 1.5, "fixed read length")
+			e.add("Ion Torrent", -1, "fixed read length")
+		} else if cv > 0.2 {
+			e.add("Ion Torrent", 1, fmt.Sprintf("variable short lengths (cv %.2f)", cv))
+		}
+	}
+}
+
+func qualityEvidence(e *techEvidence, reads []sampleRead) {
+	alphabet := map[byte]bool{}
+	sum, count, maxQ := 0, 0, 0
+	for _, read := range reads {
+		for i := 0; i < len(read.Quality); i++ {
+			alphabet[read.Quality[i]] = true
+			q := int(read.Quality[i]) - 33
+			sum += q
+			count++
+			if q > maxQ {
+				maxQ = q
+			}
+		}
+	}
+	if count == 0 {
+		return
+	}
+	mean := float64(sum) / float64(count)
+	switch {
+	case maxQ >= 60:
+		e.add("PacBio", 2, fmt.Sprintf("quality up to Q%d (HiFi)", maxQ))
+	case len(alphabet) <= 8 && maxQ <= 42:
+		e.add("Illumina", 1.5, fmt.Sprintf("binned quality (%d values)", len(alphabet)))
+	}
+	if mean < 15 {
+		reason := fmt.Sprintf("low mean quality (Q%.1f)", mean)
+		e.add("Oxford Nanopore", 1, reason)
+		e.add("PacBio", 0.5, reason)
+	}
+}
+
+// homopolymerEvidence: Ion Torrent and Nanopore have more errors on long homopolymers.
+func homopolymerEvidence(e *techEvidence, reads []sampleRead) {
+	runs, bases := 0, 0
+	for _, read := range reads {
+		bases += len(read.Bases)
+		count := 1
+		for i := 1; i < len(read.Bases); i++ {
+			if read.Bases[i] == read.Bases[i-1] {
+				count++
+				continue
+			}
+			if count >= 6 {
+				runs++
+			}
+			count = 1
+		}
+		if count >= 6 {
+			runs++
+		}
+	}
+	if bases == 0 {
+		return
+	}
+	// random sequence gives ~1 run of 6+ per kb
+	perKb := float64(runs) * 1000 / float64(bases)
+	if perKb > 3 {
+		reason := fmt.Sprintf("%.1f homopolymer runs of 6+ per kb", perKb)
+		e.add("Ion Torrent", 0.5, reason)
+		e.add("Oxford Nanopore", 0.5, reason)
+	}
+}
+
+// NormalizeTech returns the technology name for -tech values like "ont" or "OxfordNanopore".
+func NormalizeTech(name string) (string, error) {
+	key := strings.ToLower(techConfigKey(name))
+	aliases := map[string]string{"ont": "Oxford Nanopore", "nanopore": "Oxford Nanopore", "pb": "PacBio", "ion": "Ion Torrent"}
+	if tech, ok := aliases[key]; ok {
+		return tech, nil
+	}
+	for _, tech := range KnownTechs {
+		if strings.ToLower(techConfigKey(tech)) == key {
+			return tech, nil
+		}
+	}
+	return "", fmt.Errorf("unknown technology %q (available: %s)", name, strings.Join(KnownTechs, ", "))
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// sampleLines builds n reads of length bases with headers made by header.
+func sampleLines(n, length int, quality byte, header func(i int) string) []string {
+	rng := rand.New(rand.NewSource(1))
+	var lines []string
+	for i := 0; i < n; i++ {
+		bases := make([]byte, length)
+		for j := range bases {
+			bases[j] = "ACGT"[rng.Intn(4)]
+		}
+		lines = append(lines, header(i), string(bases), "+", strings.Repeat(string(quality), length))
+	}
+	return lines
+}
+
+func TestClassifySequencingTech(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"illumina", sampleLines(50, 150, 'F', func(i int) string {
+			return fmt.Sprintf("@A00123:8:H5KJ3DSXX:1:1101:%d:1000 1:N:0:ACGT", i)
+		}), "Illumina"},
+		{"nanopore", sampleLines(20, 3000, '+', func(i int) string {
+			return fmt.Sprintf("@%08x-1111-2222-3333-444455556666 runid=abc ch=%d start_time=2024-01-01T00:00:00Z", i, i)
+		}), "Oxford Nanopore"},
+		{"pacbio", sampleLines(20, 3000, '~', func(i int) string {
+			return fmt.Sprintf("@m64011_190830_220126/%d/ccs", i)
+		}), "PacBio"},
+		{"ion torrent", sampleLines(50, 200, '5', func(i int) string {
+			return fmt.Sprintf("@ZW1Y3:%05d:00211", i)
+		}), "Ion Torrent"},
+	}
+	for _, tt := range tests {
+		detection := ClassifySequencingTech(tt.lines)
+		checkSoftmax(t, tt.name, detection)
+		if best := detection.Best(); best.Tech != tt.want || best.Probability < DefaultTechConfidence {
+			t.Errorf("%s: detected %s (%.2f), want %s over %.2f", tt.name, best.Tech, best.Probability, tt.want, DefaultTechConfidence)
+		}
+	}
+}
+
+func TestClassifyWithoutEvidence(t *testing.T) {
+	// without reads all the scores are 0 and the softmax is uniform
+	detection := ClassifySequencingTech(nil)
+	checkSoftmax(t, "empty", detection)
+	for _, score := range detection.Ranking {
+		if math.Abs(score.Probability-1/float64(len(KnownTechs))) > 1e-12 {
+			t.Errorf("%s: probability %g, want uniform", score.Tech, score.Probability)
+		}
+	}
+}
+
+// checkSoftmax checks that the ranking has every technology once, sorted,
+// with probabilities that add up to 1.
+func checkSoftmax(t *testing.T, name string, detection TechDetection) {
+	t.Helper()
+	if len(detection.Ranking) != len(KnownTechs) {
+		t.Fatalf("%s: %d technologies ranked, want %d", name, len(detection.Ranking), len(KnownTechs))
+	}
+	total := 0.0
+	seen := map[string]bool{}
+	for i, score := range detection.Ranking {
+		if score.Probability < 0 || score.Probability > 1 || math.IsNaN(score.Probability) {
+			t.Errorf("%s: %s has probability %g", name, score.Tech, score.Probability)
+		}
+		if i > 0 && score.Probability > detection.Ranking[i-1].Probability {
+			t.Errorf("%s: ranking not sorted at %s", name, score.Tech)
+		}
+		seen[score.Tech] = true
+		total += score.Probability
+	}
+	if len(seen) != len(KnownTechs) || math.Abs(total-1) > 1e-9 {
+		t.Errorf("%s: probabilities add up to %g over %d technologies", name, total, len(seen))
+	}
+}
+
+func TestNormalizeTech(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"ont", "Oxford Nanopore"},
+		{"OxfordNanopore", "Oxford Nanopore"},
+		{"illumina", "Illumina"},
+		{"PB", "PacBio"},
+		{"Ion Torrent", "Ion Torrent"},
+		{"sanger", ""},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeTech(tt.in)
+		if got != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("NormalizeTech(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
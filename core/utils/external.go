@@ -0,0 +1,381 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"MARIA/maria"
+)
+
+var (
+	// PluginTimeout is the time an external plugin has to answer a request
+	// (except after_merge), the process is killed and the run fails after it.
+	PluginTimeout = 60 * time.Second
+	// PluginProcesses is the size of the pool of each external plugin, 0 starts
+	// one process per worker thread.
+	PluginProcesses = 0
+)
+
+// externalPlugin runs an executable plugin (any language) as a pool of
+// processes. The protocol is JSON lines on stdin/stdout, MARIA writes one
+// request per line and waits one response per line:
+//
+//	{"type":"init","abi":1,"config":{"min":"3"}}    -> {"hooks":["reads","after_merge"]}
+//	{"type":"before_run","run":{"input":...}}       -> {}
+//	{"type":"reads","chunk":7,"reads":[{"id":"@r1","seq":"ACGT","plus":"+","qual":"IIII"}]}
+//	                                                -> {"reads":[...]}
+//	{"type":"after_merge","path":"clean.fastq"}     -> {}
+//	{"type":"close"}                                -> {}
+//
+// A response with "error" stops the run. A process that exits is replaced by
+// a new one (init and before_run) and the batch is sent again, the run stops
+// if the new process fails too or on a timeout. The reads of a chunk are sent as one
+// batch after the per-read hooks of the .so plugins; the plugin returns the
+// reads to keep, in any number, and a read that is not a record of the input
+// format fails the chunk. "hooks" tells which requests the plugin wants
+// (all when missing), init, before_run and close are always sent. stderr of
+// the plugin goes to the stderr of MARIA, stdout is only for the protocol.
+type externalPlugin struct {
+	maria.Base
+	name   string
+	path   string
+	config maria.Config
+	hooks  map[string]bool
+	run    *externalRun
+	mu     sync.Mutex // guards procs when a process is replaced
+	procs  []*externalProcess
+	pool   chan *externalProcess
+}
+
+type externalRequest struct {
+	Type   string          `json:"type"`
+	ABI    int             `json:"abi,omitempty"`
+	Config maria.Config    `json:"config,omitempty"`
+	Run    *externalRun    `json:"run,omitempty"`
+	Chunk  *int            `json:"chunk,omitempty"`
+	Reads  *[]externalRead `json:"reads,omitempty"`
+	Path   string          `json:"path,omitempty"`
+}
+
+type externalResponse struct {
+	Error string         `json:"error"`
+	Hooks []string       `json:"hooks"`
+	Reads []externalRead `json:"reads"`
+}
+
+type externalRun struct {
+	Input     string `json:"input"`
+	Output    string `json:"output"`
+	Tech      string `json:"tech"`
+	Profile   string `json:"profile"`
+	Threads   int    `json:"threads"`
+	ChunkSize int    `json:"chunk_size"`
+}
+
+type externalRead struct {
+	ID      string `json:"id"`
+	Bases   string `json:"seq"`
+	Plus    string `json:"plus,omitempty"`
+	Quality string `json:"qual,omitempty"`
+}
+
+func newExternalPlugin(name, path string) *externalPlugin {
+	return &externalPlugin{name: name, path: path}
+}
+
+// Init starts the first process to know the hooks of the plugin, the rest of
+// the pool is started on BeforeRun when the threads are known.
+func (e *externalPlugin) Init(config maria.Config) error {
+	e.config = config
+	proc, hooks, err := e.start()
+	if err != nil {
+		return err
+	}
+	e.procs = append(e.procs, proc)
+	e.hooks = map[string]bool{"reads": true, "after_merge": true}
+	if hooks != nil {
+		e.hooks = map[string]bool{}
+		for _, hook := range hooks {
+			e.hooks[hook] = true
+		}
+	}
+	return nil
+}
+
+// start runs a process of the plugin and sends init.
+func (e *externalPlugin) start() (*externalProcess, []string, error) {
+	proc, err := startExternalProcess(e.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := proc.call(externalRequest{Type: "init", ABI: maria.ABIVersion, Config: e.config}, PluginTimeout)
+	if err != nil {
+		proc.stop()
+		return nil, nil, fmt.Errorf("init: %w", err)
+	}
+	return proc, resp.Hooks, nil
+}
+
+func (e *externalPlugin) BeforeRun(info maria.RunInfo) error {
+	size := PluginProcesses
+	if size <= 0 {
+		size = info.Threads
+	}
+	if !e.hooks["reads"] {
+		size = 1
+	}
+	for len(e.procs) < size {
+		proc, _, err := e.start()
+		if err != nil {
+			return err
+		}
+		e.procs = append(e.procs, proc)
+	}
+	e.run = &externalRun{Input: info.Input, Output: info.Output, Tech: info.Tech, Profile: info.Profile, Threads: info.Threads, ChunkSize: info.ChunkSize}
+	e.pool = make(chan *externalProcess, len(e.procs))
+	for _, proc := range e.procs {
+		if _, err := proc.call(externalRequest{Type: "before_run", Run: e.run}, PluginTimeout); err != nil {
+			return fmt.Errorf("before_run: %w", err)
+		}
+		e.pool <- proc
+	}
+	slog.Debug("external plugin started", "name", e.name, "processes", len(e.procs))
+	return nil
+}
+
+// respawn replaces a broken process of the pool by a new one ready for the
+// requests of the run.
+func (e *externalPlugin) respawn(old *externalProcess) (*externalProcess, error) {
+	old.wait()
+	proc, _, err := e.start()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := proc.call(externalRequest{Type: "before_run", Run: e.run}, PluginTimeout); err != nil {
+		proc.stop()
+		return nil, fmt.Errorf("before_run: %w", err)
+	}
+	e.mu.Lock()
+	for i, p := range e.procs {
+		if p == old {
+			e.procs[i] = proc
+		}
+	}
+	e.mu.Unlock()
+	slog.Warn("external plugin process restarted", "name", e.name)
+	return proc, nil
+}
+
+// ProcessChunk sends the chunk to a free process of the pool, a process that
+// exits is replaced and the chunk sent once more.
+func (e *externalPlugin) ProcessChunk(chunk *maria.Chunk) error {
+	if len(chunk.Reads) == 0 {
+		return nil
+	}
+	fasta := strings.HasPrefix(chunk.Reads[0].ID, ">")
+	reads := make([]externalRead, len(chunk.Reads))
+	for i, read := range chunk.Reads {
+		reads[i] = externalRead(read)
+	}
+	proc := <-e.pool
+	defer func() { e.pool <- proc }()
+	req := externalRequest{Type: "reads", Chunk: &chunk.ID, Reads: &reads}
+	resp, err := proc.call(req, PluginTimeout)
+	// a chunk that timed out is not sent again, the run stops
+	if err != nil && proc.broken && !proc.killed {
+		restarted, startErr := e.respawn(proc)
+		if startErr != nil {
+			return fmt.Errorf("%w, the process can't be restarted: %v", err, startErr)
+		}
+		proc = restarted
+		if resp, err = proc.call(req, PluginTimeout); err != nil {
+			return fmt.Errorf("restarted process failed too: %w", err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for i, read := range resp.Reads {
+		if err := read.check(fasta); err != nil {
+			return fmt.Errorf("plugin %s returned an invalid read %d on chunk %d: %w", e.name, i, chunk.ID, err)
+		}
+	}
+	chunk.Reads = chunk.Reads[:0]
+	for _, read := range resp.Reads {
+		chunk.Reads = append(chunk.Reads, maria.Read(read))
+	}
+	return nil
+}
+
+// check tells if a read returned by a plugin can be written as a record of
+// the input format: a FASTQ read needs the plus line and a quality of the
+// length of the bases, a FASTA read has only the header and the bases.
+func (r externalRead) check(fasta bool) error {
+	header := "@"
+	if fasta {
+		header = ">"
+	}
+	switch {
+	case !strings.HasPrefix(r.ID, header):
+		return fmt.Errorf("id %q does not start with %s", r.ID, header)
+	case strings.ContainsAny(r.ID+r.Bases+r.Plus+r.Quality, "\n\r"):
+		return fmt.Errorf("%s has a line break", r.ID)
+	case fasta:
+		return nil
+	case !strings.HasPrefix(r.Plus, "+"):
+		return fmt.Errorf("%s has no plus line", r.ID)
+	case len(r.Quality) != len(r.Bases):
+		return fmt.Errorf("%s has %d bases and %d qualities", r.ID, len(r.Bases), len(r.Quality))
+	}
+	return nil
+}
+
+// AfterMerge has no timeout, the plugin can take the time it needs on the
+// output file.
+func (e *externalPlugin) AfterMerge(outputPath string) error {
+	if !e.hooks["after_merge"] || len(e.procs) == 0 {
+		return nil
+	}
+	proc := e.procs[0]
+	if proc.broken {
+		restarted, err := e.respawn(proc)
+		if err != nil {
+			return fmt.Errorf("plugin process exited and can't be restarted: %w", err)
+		}
+		proc = restarted
+	}
+	_, err := proc.call(externalRequest{Type: "after_merge", Path: outputPath}, 0)
+	return err
+}
+
+// Close stops all the processes, the first error is returned.
+func (e *externalPlugin) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var first error
+	for _, proc := range e.procs {
+		if err := proc.stop(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// externalProcess is a running process of an external plugin, only one
+// request is in flight at a time.
+type externalProcess struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	waited  sync.Once
+	waitErr error
+	broken  bool // crashed or killed, no more requests are sent
+	killed  bool // killed on a timeout
+}
+
+func startExternalProcess(path string) (*externalProcess, error) {
+	cmd := exec.Command(path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("can't start %s: %w", path, err)
+	}
+	return &externalProcess{cmd: cmd, stdin: stdin, stdout: bufio.NewReaderSize(stdout, 1<<20)}, nil
+}
+
+// wait reaps the process once and returns its exit status.
+func (p *externalProcess) wait() error {
+	p.waited.Do(func() { p.waitErr = p.cmd.Wait() })
+	return p.waitErr
+}
+
+// call writes a request and reads its response, a process that does not
+// answer in timeout (0 waits forever) is killed.
+func (p *externalProcess) call(req externalRequest, timeout time.Duration) (externalResponse, error) {
+	if p.broken {
+		return externalResponse{}, errors.New("plugin process is not running")
+	}
+	type result struct {
+		resp   externalResponse
+		err    error
+		broken bool
+	}
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		r.resp, r.broken, r.err = p.exchange(req)
+		done <- r
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case r := <-done:
+		p.broken = r.broken
+		return r.resp, r.err
+	case <-expired:
+		p.broken, p.killed = true, true
+		p.cmd.Process.Kill()
+		p.wait()
+		return externalResponse{}, fmt.Errorf("no response to %s after %s, plugin process killed", req.Type, timeout)
+	}
+}
+
+// exchange reports broken when the process can't be used anymore.
+func (p *externalProcess) exchange(req externalRequest) (externalResponse, bool, error) {
+	var resp externalResponse
+	line, err := json.Marshal(req)
+	if err != nil {
+		return resp, false, fmt.Errorf("error encode %s: %w", req.Type, err)
+	}
+	if _, err := p.stdin.Write(append(line, '\n')); err != nil {
+		return resp, true, fmt.Errorf("plugin process exited (%v): %w", p.wait(), err)
+	}
+	data, err := p.stdout.ReadBytes('\n')
+	if err == io.EOF {
+		return resp, true, fmt.Errorf("plugin process exited (%v) without answering %s", p.wait(), req.Type)
+	}
+	if err != nil {
+		return resp, true, fmt.Errorf("error reading plugin response: %w", err)
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return resp, false, fmt.Errorf("invalid response to %s: %w", req.Type, err)
+	}
+	if resp.Error != "" {
+		return resp, false, errors.New(resp.Error)
+	}
+	return resp, false, nil
+}
+
+// stop sends close and waits the process, a broken process is only reaped.
+func (p *externalProcess) stop() error {
+	if p.broken {
+		p.wait()
+		return nil
+	}
+	_, err := p.call(externalRequest{Type: "close"}, PluginTimeout)
+	p.stdin.Close()
+	if waitErr := p.wait(); err == nil && waitErr != nil {
+		err = fmt.Errorf("plugin process exited: %w", waitErr)
+	}
+	return err
+}
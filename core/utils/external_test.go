@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"MARIA/maria"
+)
+
+const testPluginEnv = "MARIA_TEST_PLUGIN"
+
+// runTestPlugin answers the external plugin protocol on stdin and stdout:
+// echo returns the reads, drop keeps one in two, badqual cuts the quality of
+// the first read, error answers an error, crash exits on the first reads
+// request of the test (MARIA_TEST_PLUGIN_MARKER is created) and hang never
+// answers the reads.
+func runTestPlugin(mode string) int {
+	in := bufio.NewScanner(os.Stdin)
+	in.Buffer(nil, 1<<26)
+	out := json.NewEncoder(os.Stdout)
+	for in.Scan() {
+		var req externalRequest
+		if err := json.Unmarshal(in.Bytes(), &req); err != nil {
+			return 1
+		}
+		resp := externalResponse{}
+		switch req.Type {
+		case "init":
+			resp.Hooks = []string{"reads"}
+		case "reads":
+			resp.Reads = *req.Reads
+			switch mode {
+			case "drop":
+				var kept []externalRead
+				for i, read := range resp.Reads {
+					if i%2 == 0 {
+						kept = append(kept, read)
+					}
+				}
+				resp.Reads = kept
+			case "badqual":
+				resp.Reads[0].Quality = resp.Reads[0].Quality[1:]
+			case "error":
+				resp.Error = "no reads today"
+			case "crash":
+				marker := os.Getenv(testPluginEnv + "_MARKER")
+				if _, err := os.Stat(marker); err != nil {
+					os.WriteFile(marker, nil, 0o644)
+					return 2
+				}
+			case "hang":
+				time.Sleep(time.Minute)
+			}
+		}
+		if err := out.Encode(resp); err != nil || req.Type == "close" {
+			return 0
+		}
+	}
+	return 0
+}
+
+// startTestPlugin runs the test binary as an external plugin of one process.
+func startTestPlugin(t *testing.T, mode string) *externalPlugin {
+	t.Helper()
+	t.Setenv(testPluginEnv, mode)
+	t.Setenv(testPluginEnv+"_MARKER", filepath.Join(t.TempDir(), "crashed"))
+	p := newExternalPlugin("test", os.Args[0])
+	if err := p.Init(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.BeforeRun(maria.RunInfo{Threads: 1}); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func testPluginReads() []maria.Read {
+	return []maria.Read{
+		{ID: "@r1", Bases: "ACGT", Plus: "+", Quality: "IIII"},
+		{ID: "@r2", Bases: "GGCA", Plus: "+", Quality: "FFFF"},
+		{ID: "@r3", Bases: "TTAC", Plus: "+", Quality: "####"},
+	}
+}
+
+func TestExternalPlugin(t *testing.T) {
+	saved := PluginTimeout
+	defer func() { PluginTimeout = saved }()
+	PluginTimeout = 2 * time.Second
+	reads := testPluginReads()
+	tests := []struct {
+		mode    string
+		want    []maria.Read
+		wantErr string
+	}{
+		{"echo", reads, ""},
+		{"drop", []maria.Read{reads[0], reads[2]}, ""},
+		// the process is restarted and the chunk sent again
+		{"crash", reads, ""},
+		{"badqual", nil, "plugin test returned an invalid read 0 on chunk 7"},
+		{"error", nil, "no reads today"},
+		{"hang", nil, "plugin process killed"},
+	}
+	for _, tt := range tests {
+		if tt.mode == "hang" {
+			PluginTimeout = 200 * time.Millisecond
+		}
+		p := startTestPlugin(t, tt.mode)
+		chunk := &maria.Chunk{ID: 7, Reads: append([]maria.Read(nil), reads...)}
+		err := p.ProcessChunk(chunk)
+		p.Close()
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error %v, want %q", tt.mode, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.mode, err)
+			continue
+		}
+		if !reflect.DeepEqual(chunk.Reads, tt.want) {
+			t.Errorf("%s: reads %+v, want %+v", tt.mode, chunk.Reads, tt.want)
+		}
+	}
+}
+
+func TestExternalReadCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		read    externalRead
+		fasta   bool
+		wantErr bool
+	}{
+		{"fastq", externalRead{ID: "@r1", Bases: "ACGT", Plus: "+", Quality: "IIII"}, false, false},
+		{"fasta", externalRead{ID: ">r1", Bases: "ACGT"}, true, false},
+		{"no id", externalRead{Bases: "ACGT", Plus: "+", Quality: "IIII"}, false, true},
+		{"fasta id on fastq", externalRead{ID: ">r1", Bases: "ACGT", Plus: "+", Quality: "IIII"}, false, true},
+		{"no plus", externalRead{ID: "@r1", Bases: "ACGT", Quality: "IIII"}, false, true},
+		{"no quality", externalRead{ID: "@r1", Bases: "ACGT", Plus: "+"}, false, true},
+		{"short quality", externalRead{ID: "@r1", Bases: "ACGT", Plus: "+", Quality: "III"}, false, true},
+		{"line break", externalRead{ID: "@r1", Bases: "AC\nGT", Plus: "+", Quality: "IIIII"}, false, true},
+	}
+	for _, tt := range tests {
+		if err := tt.read.check(tt.fasta); (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package utils
 
 import (
 	"encoding/json"
-	"os"
+	"fmt"
+	"io/fs"
+	"math"
+	"sort"
 	"strings"
 )
 
@@ -13,16 +16,44 @@ type Sequence struct {
 	Quality string
 }
 
+// fasta reports if the read is a FASTA record, a '>' header without plus and
+// quality lines.
+func (s Sequence) fasta() bool {
+	return strings.HasPrefix(s.ID, ">")
+}
+
 type QualityThresholds map[string]struct {
 	Threshold   int `json:"threshold"`
 	Minbases    int `json:"minbases"`
 	Homo        int `json:"homopolymer"`
 	MaxBadBases int `json:"maxBadBases"`
+	PolyG       int `json:"polyG"`
+}
+
+// RejectReason is the filter that discards a read, empty when the read passes.
+type RejectReason string
+
+const (
+	ReasonInvalid     RejectReason = "invalid"
+	ReasonAdapterOnly RejectReason = "adapter_only"
+	ReasonLowQuality  RejectReason = "low_quality"
+	ReasonTooShort    RejectReason = "too_short"
+	ReasonHomopolymer RejectReason = "homopolymer"
+)
+
+// RejectReasons in the order the filters are applied.
+var RejectReasons = []RejectReason{ReasonInvalid, ReasonAdapterOnly, ReasonLowQuality, ReasonTooShort, ReasonHomopolymer}
+
+// RejectedRead is a discarded read with the filter that rejected it.
+type RejectedRead struct {
+	Seq    Sequence
+	Reason RejectReason
 }
 
 // Recorta cualquier adaptador encontrado en la lista de `adapters`.
 // Utiliza strings.Index (usa Boyer-Moore internamente).
-func trimAdapters(seq Sequence, adapters []string) Sequence {
+// Devuelve también el adaptador encontrado (vacío si no hay).
+func trimAdapters(seq Sequence, adapters []string) (Sequence, string) {
 	for _, adapter := range adapters {
 		pos := strings.Index(seq.Bases, adapter)
 		if pos != -1 {
@@ -30,12 +61,96 @@ func trimAdapters(seq Sequence, adapters []string) Sequence {
 			if len(seq.Quality) > pos {
 				seq.Quality = seq.Quality[:pos]
 			}
-			break // cortar al primer adaptador encontrado
+			return seq, adapter // cortar al primer adaptador encontrado
 		}
 	}
+	return seq, ""
+}
+
+// trimPolyG removes the 3' poly-G tail of two color instruments (no signal is
+// read as G), allowing one mismatch each 8 bases like fastp.
+func trimPolyG(seq Sequence, minLen int) Sequence {
+	end := len(seq.Bases)
+	cut, mismatches := end, 0
+	for i := end - 1; i >= 0; i-- {
+		if seq.Bases[i] != 'G' {
+			mismatches++
+			if mismatches > (end-i)/8 {
+				break
+			}
+			continue
+		}
+		cut = i
+	}
+	if minLen <= 0 || end-cut < minLen {
+		return seq
+	}
+	seq.Bases = seq.Bases[:cut]
+	if len(seq.Quality) > cut {
+		seq.Quality = seq.Quality[:cut]
+	}
 	return seq
 }
 
+// splitAtAdapters cuts the read on every internal adapter found on any strand
+// (ligation chimeras), each piece keeps its own quality and gets the id
+// readid_1, readid_2... The adapters are removed and empty pieces discarded,
+// a read that is only adapters has no pieces.
+func splitAtAdapters(seq Sequence, adapters []string) []Sequence {
+	type hit struct{ start, end int }
+	var hits []hit
+	for _, adapter := range adapters {
+		for _, query := range []string{adapter, reverseComplement(adapter)} {
+			for from := 0; ; {
+				pos := strings.Index(seq.Bases[from:], query)
+				if pos == -1 {
+					break
+				}
+				hits = append(hits, hit{from + pos, from + pos + len(query)})
+				from += pos + len(query)
+			}
+		}
+	}
+	if len(hits) == 0 {
+		return []Sequence{seq}
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].start < hits[j].start })
+
+	var pieces []Sequence
+	from := 0
+	for _, h := range append(hits, hit{len(seq.Bases), len(seq.Bases)}) {
+		if h.start > from {
+			piece := seq
+			piece.Bases = seq.Bases[from:h.start]
+			if len(seq.Quality) >= h.start {
+				piece.Quality = seq.Quality[from:h.start]
+			}
+			pieces = append(pieces, piece)
+		}
+		if h.end > from {
+			from = h.end
+		}
+	}
+	// one piece: adapters only on the ends, it is not a chimera; none: the
+	// read is only adapters and the caller rejects it
+	if len(pieces) < 2 {
+		return pieces
+	}
+	for i := range pieces {
+		pieces[i].ID = subReadID(seq.ID, i+1)
+	}
+	return pieces
+}
+
+// subReadID adds the piece number to the read name: "@id desc" -> "@id_2 desc".
+func subReadID(id string, n int) string {
+	name, desc, found := strings.Cut(id, " ")
+	if found {
+		return fmt.Sprintf("%s_%d %s", name, n, desc)
+	}
+	return fmt.Sprintf("%s_%d", name, n)
+}
+
 // valid quality of nucleotids with fastq
 // detectPhredOffset detects the Phred quality score offset (33 or 64) from the quality string.
 func detectPhredOffset(qual string) int {
@@ -75,6 +190,96 @@ func validateQuality(quality string, threshold int, maxBadBases int) bool {
 	return true
 }
 
+// phredAccuracy[q] is the probability of a correct base call for the score q.
+var phredAccuracy = func() [94]float64 {
+	var table [94]float64
+	for q := range table {
+		table[q] = 1 - math.Pow(10, -float64(q)/10)
+	}
+	return table
+}()
+
+// meanAccuracy returns the mean probability of correct base calls of the read (0-1).
+func meanAccuracy(quality string) float64 {
+	if len(quality) == 0 {
+		return 0
+	}
+	offset := detectPhredOffset(quality)
+	sum := 0.0
+	for i := 0; i < len(quality); i++ {
+		score := decodePhred(quality[i], offset)
+		if score < 0 {
+			score = 0
+		} else if score >= len(phredAccuracy) {
+			score = len(phredAccuracy) - 1
+		}
+		sum += phredAccuracy[score]
+	}
+	return sum / float64(len(quality))
+}
+
+// readScore weights the length with the mean quality (expected correct bases),
+// reads without quality (fasta) are scored by length.
+func readScore(bases, quality string) float64 {
+	if quality == "" {
+		return float64(len(bases))
+	}
+	return float64(len(bases)) * meanAccuracy(quality)
+}
+
+// invalidFilter rejects malformed records: quality of other length than the
+// bases (an empty quality too, except on FASTA) or characters out of the IUPAC
+// nucleotide codes.
+func invalidFilter(seq Sequence) RejectReason {
+	if len(seq.Quality) != len(seq.Bases) && !(seq.fasta() && seq.Quality == "") {
+		return ReasonInvalid
+	}
+	for i := 0; i < len(seq.Bases); i++ {
+		if !iupacBases[seq.Bases[i]] {
+			return ReasonInvalid
+		}
+	}
+	return ""
+}
+
+// iupacBases marks the IUPAC nucleotide codes, upper and lower case.
+var iupacBases = func() [256]bool {
+	var table [256]bool
+	for _, c := range []byte("ACGTUNRYKMSWBDHVacgtunrykmswbdhv") {
+		table[c] = true
+	}
+	return table
+}()
+
+// adapterOnlyFilter rejects reads left without bases after trimming adapters.
+func adapterOnlyFilter(original, trimmed Sequence) RejectReason {
+	if original.Bases != "" && trimmed.Bases == "" {
+		return ReasonAdapterOnly
+	}
+	return ""
+}
+
+func qualityFilter(seq Sequence, threshold int, maxBadBases int) RejectReason {
+	if !validateQuality(seq.Quality, threshold, maxBadBases) {
+		return ReasonLowQuality
+	}
+	return ""
+}
+
+func lengthFilter(seq Sequence, minLen int) RejectReason {
+	if !isValidLength(seq.Bases, minLen) {
+		return ReasonTooShort
+	}
+	return ""
+}
+
+func homopolymerFilter(seq Sequence, maxLen int) RejectReason {
+	if hasHomopolymer(seq.Bases, maxLen) {
+		return ReasonHomopolymer
+	}
+	return ""
+}
+
 func isValidLength(seq string, minLen int) bool {
 	return len(seq) >= minLen
 }
@@ -94,8 +299,8 @@ func hasHomopolymer(seq string, maxLen int) bool {
 	return false
 }
 
-func loadAdapters(filename string) (map[string][]string, error) {
-	data, err := os.ReadFile(filename)
+func loadAdapters(fsys fs.FS, filename string) (map[string][]string, error) {
+	data, err := fs.ReadFile(fsys, filename)
 	if err != nil {
 		return nil, err
 	}
@@ -107,8 +312,8 @@ func loadAdapters(filename string) (map[string][]string, error) {
 	return adapters, nil
 }
 
-func loadQualities(filename string) (QualityThresholds, error) {
-	data, err := os.ReadFile(filename)
+func loadQualities(fsys fs.FS, filename string) (QualityThresholds, error) {
+	data, err := fs.ReadFile(fsys, filename)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestSplitAtAdapters(t *testing.T) {
+	adapters := []string{"AAAACCCC"}
+	tests := []struct {
+		name  string
+		bases string
+		id    string
+		want  []string // id:bases of the pieces
+	}{
+		{"no adapter", "ACGTACGTAC", "@r", []string{"@r:ACGTACGTAC"}},
+		{"internal", "ACGTAAAACCCCTTGA", "@r", []string{"@r_1:ACGT", "@r_2:TTGA"}},
+		{"reverse strand", "ACGTGGGGTTTTTTGA", "@r", []string{"@r_1:ACGT", "@r_2:TTGA"}},
+		{"description", "ACGTAAAACCCCTTGA", "@r runid=x", []string{"@r_1 runid=x:ACGT", "@r_2 runid=x:TTGA"}},
+		{"three pieces", "ACAAAACCCCGTGGGGTTTTTA", "@r", []string{"@r_1:AC", "@r_2:GT", "@r_3:TA"}},
+		// adapters on the ends only trim, it is not a chimera
+		{"on the ends", "AAAACCCCACGTGGGGTTTT", "@r", []string{"@r:ACGT"}},
+		{"adjacent", "ACAAAACCCCGGGGTTTTGT", "@r", []string{"@r_1:AC", "@r_2:GT"}},
+		{"only adapters", "AAAACCCCGGGGTTTT", "@r", nil},
+	}
+	for _, tt := range tests {
+		seq := Sequence{ID: tt.id, Bases: tt.bases, Plus: "+", Quality: strings.ToLower(tt.bases)}
+		var got []string
+		for _, piece := range splitAtAdapters(seq, adapters) {
+			if piece.Quality != strings.ToLower(piece.Bases) {
+				t.Errorf("%s: piece %s has the quality %s", tt.name, piece.Bases, piece.Quality)
+			}
+			got = append(got, piece.ID+":"+piece.Bases)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: pieces %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCleanReadSplitChimeras(t *testing.T) {
+	profile := illuminaProfile(t)
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) string {
+		bases := make([]byte, n)
+		for i := range bases {
+			bases[i] = "ACGT"[rng.Intn(4)]
+		}
+		return string(bases)
+	}
+	adapter := profile.Adapters[0]
+	record := func(bases string) [4]string {
+		return [4]string{"@r desc\n", bases + "\n", "+\n", strings.Repeat("I", len(bases)) + "\n"}
+	}
+	tests := []struct {
+		name     string
+		bases    string
+		kept     []string
+		rejected RejectReason
+	}{
+		{"chimera", random(100) + adapter + random(100), []string{"@r_1 desc", "@r_2 desc"}, ""},
+		{"adapter only", adapter + reverseComplement(adapter), nil, ReasonAdapterOnly},
+		// the first piece is too short
+		{"short piece", random(10) + adapter + random(100), []string{"@r_2 desc"}, ReasonTooShort},
+	}
+	for _, tt := range tests {
+		stats := NewCleanStats()
+		kept, rejected, err := cleanRead(record(tt.bases), 4, profile, true, stats, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, seq := range kept {
+			ids = append(ids, seq.ID)
+			if len(seq.Bases) != 100 {
+				t.Errorf("%s: %s has %d bases", tt.name, seq.ID, len(seq.Bases))
+			}
+		}
+		if strings.Join(ids, ",") != strings.Join(tt.kept, ",") {
+			t.Errorf("%s: kept %v, want %v", tt.name, ids, tt.kept)
+		}
+		if tt.rejected == "" && len(rejected) > 0 || tt.rejected != "" && (len(rejected) != 1 || rejected[0].Reason != tt.rejected) {
+			t.Errorf("%s: rejected %+v, want %s", tt.name, rejected, tt.rejected)
+		}
+		if stats.BasesIn != int64(len(tt.bases)) {
+			t.Errorf("%s: %d bases in, want %d", tt.name, stats.BasesIn, len(tt.bases))
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package utils
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	plotWidth  = 640
+	plotHeight = 260
+	plotMargin = 40
+)
+
+var (
+	colorBefore = "#9e9e9e"
+	colorAfter  = "#1f77b4"
+)
+
+type plotSeries struct {
+	Name   string
+	Color  string
+	Values []float64
+}
+
+// svgPlot draws series of values over the same labels as lines (or bars when
+// bars is true) in an inline SVG, no javascript needed to open the report.
+func svgPlot(title, yLabel string, labels []string, series []plotSeries, bars bool) template.HTML {
+	var maxY float64
+	for _, s := range series {
+		for _, v := range s.Values {
+			if v > maxY {
+				maxY = v
+			}
+		}
+	}
+	if maxY == 0 {
+		maxY = 1
+	}
+	innerW := float64(plotWidth - 2*plotMargin)
+	innerH := float64(plotHeight - 2*plotMargin)
+	n := len(labels)
+	if n == 0 {
+		n = 1
+	}
+	step := innerW / float64(n)
+	x := func(i int) float64 { return plotMargin + step*(float64(i)+0.5) }
+	y := func(v float64) float64 { return plotMargin + innerH - v/maxY*innerH }
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg viewBox="0 0 %d %d" class="plot"><text x="%d" y="20" class="title">%s</text>`, plotWidth, plotHeight, plotWidth/2, template.HTMLEscapeString(title))
+	fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" class="axis"/>`, plotMargin, plotHeight-plotMargin, plotWidth-plotMargin, plotHeight-plotMargin)
+	fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" class="axis"/>`, plotMargin, plotMargin, plotMargin, plotHeight-plotMargin)
+	for _, fraction := range []float64{0, 0.5, 1} {
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" class="tick" text-anchor="end">%s</text>`, plotMargin-4, y(maxY*fraction)+4, formatTick(maxY*fraction))
+	}
+	fmt.Fprintf(&b, `<text x="12" y="%d" class="tick" transform="rotate(-90 12 %d)" text-anchor="middle">%s</text>`, plotHeight/2, plotHeight/2, template.HTMLEscapeString(yLabel))
+	// at most 8 labels on the x axis
+	every := (len(labels) + 7) / 8
+	for i, label := range labels {
+		if every > 0 && i%every == 0 {
+			fmt.Fprintf(&b, `<text x="%.1f" y="%d" class="tick" text-anchor="middle">%s</text>`, x(i), plotHeight-plotMargin+14, template.HTMLEscapeString(label))
+		}
+	}
+	for si, s := range series {
+		if bars {
+			width := step / float64(len(series)) * 0.8
+			for i, v := range s.Values {
+				left := plotMargin + step*float64(i) + step*0.1 + width*float64(si)
+				fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s %s: %s</title></rect>`,
+					left, y(v), width, plotMargin+innerH-y(v), s.Color, template.HTMLEscapeString(s.Name), template.HTMLEscapeString(labels[i]), formatTick(v))
+			}
+			continue
+		}
+		points := make([]string, len(s.Values))
+		for i, v := range s.Values {
+			points[i] = fmt.Sprintf("%.1f,%.1f", x(i), y(v))
+		}
+		fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`, strings.Join(points, " "), s.Color)
+	}
+	for i, s := range series {
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/><text x="%d" y="%d" class="tick">%s</text>`,
+			plotWidth-plotMargin-110, plotMargin+i*14, s.Color, plotWidth-plotMargin-96, plotMargin+i*14+9, template.HTMLEscapeString(s.Name))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// svgBoxplot draws the quality per position: whiskers p10-p90, box q1-q3,
+// median and mean line.
+func svgBoxplot(title string, positions []PositionQC, color string) template.HTML {
+	innerW := float64(plotWidth - 2*plotMargin)
+	innerH := float64(plotHeight - 2*plotMargin)
+	maxY := 42.0
+	for _, p := range positions {
+		if float64(p.P90) > maxY {
+			maxY = float64(p.P90)
+		}
+	}
+	n := len(positions)
+	if n == 0 {
+		n = 1
+	}
+	step := innerW / float64(n)
+	y := func(v float64) float64 { return plotMargin + innerH - v/maxY*innerH }
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg viewBox="0 0 %d %d" class="plot"><text x="%d" y="20" class="title">%s</text>`, plotWidth, plotHeight, plotWidth/2, template.HTMLEscapeString(title))
+	// quality zones like FastQC
+	fmt.Fprintf(&b, `<rect x="%d" y="%.1f" width="%.1f" height="%.1f" fill="#e6f4e6"/>`, plotMargin, y(maxY), innerW, y(28)-y(maxY))
+	fmt.Fprintf(&b, `<rect x="%d" y="%.1f" width="%.1f" height="%.1f" fill="#f8f3dc"/>`, plotMargin, y(28), innerW, y(20)-y(28))
+	fmt.Fprintf(&b, `<rect x="%d" y="%.1f" width="%.1f" height="%.1f" fill="#f8e1e1"/>`, plotMargin, y(20), innerW, y(0)-y(20))
+	fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" class="axis"/>`, plotMargin, plotHeight-plotMargin, plotWidth-plotMargin, plotHeight-plotMargin)
+	for _, q := range []float64{0, 20, 28, maxY} {
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" class="tick" text-anchor="end">%s</text>`, plotMargin-4, y(q)+4, formatTick(q))
+	}
+	every := (len(positions) + 7) / 8
+	means := make([]string, len(positions))
+	for i, p := range positions {
+		center := plotMargin + step*(float64(i)+0.5)
+		half := step * 0.35
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#555"/>`, center, y(float64(p.P10)), center, y(float64(p.P90)))
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s" fill-opacity="0.6"><title>%s: median %d, Q1 %d, Q3 %d</title></rect>`,
+			center-half, y(float64(p.Q3)), 2*half, y(float64(p.Q1))-y(float64(p.Q3)), color, p.Position, p.Median, p.Q1, p.Q3)
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#c00"/>`, center-half, y(float64(p.Median)), center+half, y(float64(p.Median)))
+		means[i] = fmt.Sprintf("%.1f,%.1f", center, y(p.Mean))
+		if every > 0 && i%every == 0 {
+			fmt.Fprintf(&b, `<text x="%.1f" y="%d" class="tick" text-anchor="middle">%s</text>`, center, plotHeight-plotMargin+14, p.Position)
+		}
+	}
+	fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="#333" stroke-width="1.5"/>`, strings.Join(means, " "))
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+func formatTick(v float64) string {
+	switch {
+	case v >= 1e9:
+		return fmt.Sprintf("%.1fG", v/1e9)
+	case v >= 1e6:
+		return fmt.Sprintf("%.1fM", v/1e6)
+	case v >= 1e3:
+		return fmt.Sprintf("%.1fk", v/1e3)
+	case v == float64(int64(v)):
+		return fmt.Sprint(int64(v))
+	default:
+		return fmt.Sprintf("%.2f", v)
+	}
+}
+
+// lengthSeries aligns the length histograms of before and after on the same bins.
+func lengthSeries(before, after []LengthCount) ([]string, []float64, []float64) {
+	index := map[string]int{}
+	var labels []string
+	for _, list := range [][]LengthCount{before, after} {
+		for _, l := range list {
+			if _, ok := index[l.Length]; !ok {
+				index[l.Length] = len(labels)
+				labels = append(labels, l.Length)
+			}
+		}
+	}
+	// bins keep the order of the position bins
+	sort.SliceStable(labels, func(i, j int) bool { return lengthStart(labels[i]) < lengthStart(labels[j]) })
+	for i, label := range labels {
+		index[label] = i
+	}
+	beforeValues, afterValues := make([]float64, len(labels)), make([]float64, len(labels))
+	for _, l := range before {
+		beforeValues[index[l.Length]] = float64(l.Reads)
+	}
+	for _, l := range after {
+		afterValues[index[l.Length]] = float64(l.Reads)
+	}
+	return labels, beforeValues, afterValues
+}
+
+func lengthStart(label string) int {
+	var start int
+	fmt.Sscanf(label, "%d", &start)
+	return start
+}
+
+func percentOfReads(hist []int64) []float64 {
+	var total int64
+	for _, count := range hist {
+		total += count
+	}
+	values := make([]float64, len(hist))
+	for i, count := range hist {
+		if total > 0 {
+			values[i] = float64(count) * 100 / float64(total)
+		}
+	}
+	return values
+}
+
+type htmlRow struct {
+	Name  string
+	Value string
+}
+
+type htmlReport struct {
+	Report   *RunReport
+	Summary  []htmlRow
+	Tech     []htmlRow
+	System   []htmlRow
+	Plots    []template.HTML
+	Phases   []PhaseTiming
+	Evidence []string
+}
+
+// WriteHTML saves a self-contained HTML report (inline CSS and SVG, no
+// external resources) for the people that do not read JSON. Call it after
+// Write so the timings are closed.
+func (r *RunReport) WriteHTML(path string) error {
+	page := htmlReport{Report: r, Phases: r.Phases, Evidence: r.Technology.Evidence}
+	page.Tech = []htmlRow{
+		{"Technology", r.Technology.Tech},
+		{"Confidence", fmt.Sprintf("%.1f%%", r.Technology.Probability*100)},
+		{"Profile", r.Profile.Name},
+		{"Adapters", strings.Join(r.Profile.Adapters, ", ")},
+	}
+	page.System = []htmlRow{
+		{"Cores", fmt.Sprint(r.System.Cores)},
+		{"RAM", fmt.Sprintf("%.1f GB", float64(r.System.RAM)/1e9)},
+		{"Usable RAM", fmt.Sprintf("%.1f GB", float64(r.System.UsableRAM)/1e9)},
+		{"NVMe", fmt.Sprint(r.System.NVMe)},
+		{"Cache on disk", fmt.Sprint(r.System.DiskCache)},
+		{"Wall clock", fmt.Sprintf("%.1f s", r.WallClockSeconds)},
+	}
+	for _, input := range r.Inputs {
+		page.Summary = append(page.Summary, htmlRow{"Input", fmt.Sprintf("%s (%d bytes, sha256 %s)", input.Path, input.Size, input.SHA256)})
+	}
+	page.Summary = append(page.Summary, htmlRow{"Output", r.Output})
+
+	if stats := r.Stats; stats != nil {
+		page.Summary = append(page.Summary,
+			htmlRow{"Reads in / out", fmt.Sprintf("%d / %d", stats.ReadsIn, stats.ReadsOut)},
+			htmlRow{"Bases in / out", fmt.Sprintf("%d / %d", stats.BasesIn, stats.BasesOut)},
+			htmlRow{"Trimmed bases", fmt.Sprint(stats.TrimmedBases)},
+		)
+	}
+	if qc := r.QC; qc != nil {
+		lengthsBefore, lengthsAfter := qc.Before.LengthStats, qc.After.LengthStats
+		page.Summary = append(page.Summary,
+			htmlRow{"Yield before / after", fmt.Sprintf("%d / %d bp", lengthsBefore.Yield, lengthsAfter.Yield)},
+			htmlRow{"N50 before / after", fmt.Sprintf("%d / %d bp", lengthsBefore.N50, lengthsAfter.N50)},
+			htmlRow{"Median length before / after", fmt.Sprintf("%d / %d bp", lengthsBefore.MedianLength, lengthsAfter.MedianLength)},
+			htmlRow{"Longest before / after", fmt.Sprintf("%d / %d bp", lengthsBefore.Longest, lengthsAfter.Longest)},
+		)
+		page.Plots = append(page.Plots,
+			svgBoxplot("Quality per position (before)", qc.Before.PerPosition, colorBefore),
+			svgBoxplot("Quality per position (after)", qc.After.PerPosition, colorAfter))
+		labels, before, after := lengthSeries(qc.Before.Lengths, qc.After.Lengths)
+		page.Plots = append(page.Plots, svgPlot("Length distribution", "reads", labels,
+			[]plotSeries{{"before", colorBefore, before}, {"after", colorAfter, after}}, true))
+		gcLabels := make([]string, len(qc.Before.GC))
+		for i := range gcLabels {
+			gcLabels[i] = fmt.Sprintf("%d%%", i)
+		}
+		page.Plots = append(page.Plots, svgPlot("GC distribution", "% reads", gcLabels,
+			[]plotSeries{{"before", colorBefore, percentOfReads(qc.Before.GC)}, {"after", colorAfter, percentOfReads(qc.After.GC)}}, false))
+		qualityLabels := make([]string, len(qc.Before.MeanQuality))
+		for i := range qualityLabels {
+			qualityLabels[i] = fmt.Sprintf("Q%d", i)
+		}
+		page.Plots = append(page.Plots, svgPlot("Mean quality per read", "% reads", qualityLabels,
+			[]plotSeries{{"before", colorBefore, percentOfReads(qc.Before.MeanQuality)}, {"after", colorAfter, percentOfReads(qc.After.MeanQuality)}}, false))
+	}
+	if stats := r.Stats; stats != nil && stats.ReadsIn > 0 {
+		var adapters []string
+		for adapter := range stats.AdapterHits {
+			adapters = append(adapters, adapter)
+		}
+		sort.Strings(adapters)
+		if len(adapters) > 0 {
+			values := make([]float64, len(adapters))
+			labels := make([]string, len(adapters))
+			for i, adapter := range adapters {
+				values[i] = float64(stats.AdapterHits[adapter]) * 100 / float64(stats.ReadsIn)
+				labels[i] = adapter
+				if len(adapter) > 12 {
+					labels[i] = adapter[:12] + "…"
+				}
+			}
+			page.Plots = append(page.Plots, svgPlot("Adapter content", "% reads", labels,
+				[]plotSeries{{"reads with adapter", colorAfter, values}}, true))
+		}
+		labels := make([]string, len(RejectReasons))
+		values := make([]float64, len(RejectReasons))
+		for i, reason := range RejectReasons {
+			labels[i] = string(reason)
+			values[i] = float64(stats.Rejected[reason])
+		}
+		page.Plots = append(page.Plots, svgPlot("Rejected reads by reason", "reads", labels,
+			[]plotSeries{{"rejected", "#d62728", values}}, true))
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error to create html report: %w", err)
+	}
+	defer f.Close()
+	if err := htmlTemplate.Execute(f, page); err != nil {
+		return fmt.Errorf("error write html report: %w", err)
+	}
+	return nil
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>MARIA report - {{.Report.Output}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { color: #1f77b4; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+td, th { border: 1px solid #ddd; padding: 4px 10px; text-align: left; }
+th { background: #f4f4f4; }
+.plot { width: 640px; max-width: 100%; border: 1px solid #eee; margin: 0.5em; }
+.plot .title { font-size: 14px; font-weight: bold; text-anchor: middle; }
+.plot .tick { font-size: 10px; }
+.plot .axis { stroke: #333; }
+.grid { display: flex; flex-wrap: wrap; }
+</style>
+</head>
+<body>
+<h1>MARIA run report</h1>
+<p>Started {{.Report.StartedAt.Format "2006-01-02 15:04:05"}}</p>
+<h2>Summary</h2>
+<table>{{range .Summary}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>{{end}}</table>
+<h2>Technology</h2>
+<table>{{range .Tech}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>{{end}}</table>
+{{if .Evidence}}<ul>{{range .Evidence}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<h2>System</h2>
+<table>{{range .System}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>{{end}}</table>
+<h2>Plots</h2>
+<div class="grid">{{range .Plots}}{{.}}{{end}}</div>
+{{if .Phases}}<h2>Phases</h2>
+<table><tr><th>Phase</th><th>Title</th><th>Seconds</th></tr>{{range .Phases}}<tr><td>{{.Phase}}</td><td>{{.Title}}</td><td>{{printf "%.2f" .Seconds}}</td></tr>{{end}}</table>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteHTML(t *testing.T) {
+	report := testRunReport(t)
+	report.Output = "<clean>.fastq"
+	path := filepath.Join(t.TempDir(), "report.html")
+	if err := report.WriteHTML(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(data)
+	// boxplots before and after, lengths, GC, mean quality, adapters and rejected
+	if plots := strings.Count(page, "<svg"); plots != 7 {
+		t.Errorf("%d plots, want 7", plots)
+	}
+	for _, want := range []string{"&lt;clean&gt;.fastq", "Illumina header", "Detecting technology", "Rejected reads by reason"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("report without %q", want)
+		}
+	}
+	// self-contained: nothing is loaded from outside
+	for _, external := range []string{"<script", "<link", "src=", "http://", "https://"} {
+		if strings.Contains(page, external) {
+			t.Errorf("report with %q", external)
+		}
+	}
+	// without QC and stats the report has no plots
+	report.QC, report.Stats = nil, nil
+	if err := report.WriteHTML(path); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "<svg") {
+		t.Error("plots without QC")
+	}
+}
+
+func TestLengthSeries(t *testing.T) {
+	before := []LengthCount{{"50", 1}, {"101-110", 2}, {"141-150", 5}}
+	after := []LengthCount{{"100", 3}, {"141-150", 4}}
+	labels, beforeValues, afterValues := lengthSeries(before, after)
+	if want := []string{"50", "100", "101-110", "141-150"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("labels %v, want %v", labels, want)
+	}
+	if !reflect.DeepEqual(beforeValues, []float64{1, 0, 2, 5}) || !reflect.DeepEqual(afterValues, []float64{0, 3, 0, 4}) {
+		t.Errorf("before %v, after %v", beforeValues, afterValues)
+	}
+}
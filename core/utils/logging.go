@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// SetupLogger sets the default slog logger of the run on stderr, level is
+// debug, info, warn or error and format text or json. Quiet only keeps the
+// errors and hides the progress.
+func SetupLogger(level, format string, quiet bool) error {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q, use debug, info, warn or error", level)
+	}
+	if quiet {
+		logLevel = slog.LevelError
+		ShowProgress = false
+	}
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid log format %q, use text or json", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
@@ -0,0 +1,17 @@
+package utils
+
+import (
+	"log/slog"
+	"os"
+	"testing"
+)
+
+// TestMain keeps the progress and phase logs out of the test and benchmark
+// output. With MARIA_TEST_PLUGIN the test binary is an external plugin.
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(testPluginEnv); mode != "" {
+		os.Exit(runTestPlugin(mode))
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	os.Exit(m.Run())
+}
@@ -0,0 +1,365 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"MARIA/maria"
+)
+
+// PluginDirs are the folders given with -plugin-dir, searched before the
+// folders of MARIA_PLUGIN_PATH and plugins/.
+var PluginDirs []string
+
+const pluginPathEnv = "MARIA_PLUGIN_PATH"
+
+// pluginHooks are the hooks a manifest can declare. The declared reads,
+// chunk and after_merge hooks are the only ones that run; init, before_run
+// and close always run.
+var pluginHooks = map[string]bool{"init": true, "before_run": true, "reads": true, "chunk": true, "after_merge": true, "close": true}
+
+// PluginSearchPath returns the folders where plugins are searched, in order.
+func PluginSearchPath() []string {
+	dirs := append([]string(nil), PluginDirs...)
+	for _, dir := range filepath.SplitList(os.Getenv(pluginPathEnv)) {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return append(dirs, "plugins")
+}
+
+// PluginManifest is the optional <name>.json next to a plugin (the name
+// without extension for external plugins, minLength.json for minLength.py).
+type PluginManifest struct {
+	Name        string                 `json:"name"`
+	Version     string                 `json:"version"`
+	Description string                 `json:"description,omitempty"`
+	Hooks       []string               `json:"hooks,omitempty"`
+	Params      map[string]PluginParam `json:"params,omitempty"`
+}
+
+// PluginParam is the schema of a parameter: type int, float, bool or string,
+// min and max for numbers and the allowed values for strings.
+type PluginParam struct {
+	Type        string   `json:"type"`
+	Default     any      `json:"default,omitempty"`
+	Required    bool     `json:"required,omitempty"`
+	Min         *float64 `json:"min,omitempty"`
+	Max         *float64 `json:"max,omitempty"`
+	Values      []string `json:"values,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// InstalledPlugin is a plugin found on the search path, Kind is go (.so) or
+// external (executable). Shadowed plugins have the name of a plugin found on
+// a previous folder and are never loaded.
+type InstalledPlugin struct {
+	Name     string
+	Kind     string
+	Path     string
+	Manifest *PluginManifest
+	Shadowed bool
+}
+
+// FindPlugin returns the first plugin called name on the search path,
+// <dir>/<name>.so before the executable <dir>/<name>.
+func FindPlugin(name string) (InstalledPlugin, error) {
+	dirs := PluginSearchPath()
+	for _, dir := range dirs {
+		found := InstalledPlugin{Name: name}
+		switch {
+		case fileExists(filepath.Join(dir, name+".so")):
+			found.Kind, found.Path = "go", filepath.Join(dir, name+".so")
+		case isExecutable(filepath.Join(dir, name)):
+			found.Kind, found.Path = "external", filepath.Join(dir, name)
+		default:
+			continue
+		}
+		manifest, err := loadManifest(dir, name)
+		if err != nil {
+			return found, err
+		}
+		found.Manifest = manifest
+		return found, nil
+	}
+	return InstalledPlugin{}, fmt.Errorf("plugin %s not found on %s", name, strings.Join(dirs, ", "))
+}
+
+// ListPlugins returns the plugins of all the folders of the search path.
+func ListPlugins() ([]InstalledPlugin, error) {
+	var list []InstalledPlugin
+	seen := map[string]bool{}
+	for _, dir := range PluginSearchPath() {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't read plugin folder: %w", err)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			installed := InstalledPlugin{Name: entry.Name(), Path: path}
+			switch {
+			case strings.HasSuffix(entry.Name(), ".so"):
+				installed.Name, installed.Kind = strings.TrimSuffix(entry.Name(), ".so"), "go"
+			case isExecutable(path):
+				installed.Kind = "external"
+			default:
+				continue
+			}
+			if installed.Manifest, err = loadManifest(dir, installed.Name); err != nil {
+				return nil, err
+			}
+			installed.Shadowed = seen[installed.Name]
+			seen[installed.Name] = true
+			list = append(list, installed)
+		}
+	}
+	return list, nil
+}
+
+// declaredHooks returns the hooks of the manifest, nil without manifest or
+// when it does not declare them.
+func (p InstalledPlugin) declaredHooks() map[string]bool {
+	if p.Manifest == nil || len(p.Manifest.Hooks) == 0 {
+		return nil
+	}
+	hooks := map[string]bool{}
+	for _, hook := range p.Manifest.Hooks {
+		hooks[hook] = true
+	}
+	return hooks
+}
+
+// loadManifest returns nil without manifest.
+func loadManifest(dir, name string) (*PluginManifest, error) {
+	path := filepath.Join(dir, strings.TrimSuffix(name, filepath.Ext(name))+".json")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read manifest of plugin %s: %w", name, err)
+	}
+	var manifest PluginManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	for _, hook := range manifest.Hooks {
+		if !pluginHooks[hook] {
+			return nil, fmt.Errorf("manifest %s: unknown hook %q", path, hook)
+		}
+	}
+	for key, param := range manifest.Params {
+		switch param.Type {
+		case "int", "float", "bool", "string":
+		default:
+			return nil, fmt.Errorf("manifest %s: parameter %s has type %q, want int, float, bool or string", path, key, param.Type)
+		}
+	}
+	return &manifest, nil
+}
+
+// pluginSpec is an entry of -plugins: name(key=value,...).
+type pluginSpec struct {
+	name   string
+	params map[string]string
+}
+
+// parsePluginList splits -plugins on the commas outside the parentheses.
+func parsePluginList(list string) ([]pluginSpec, error) {
+	var specs []pluginSpec
+	depth, start := 0, 0
+	for i := 0; i <= len(list); i++ {
+		if i < len(list) {
+			switch list[i] {
+			case '(':
+				depth++
+				continue
+			case ')':
+				if depth--; depth < 0 {
+					return nil, fmt.Errorf("unexpected ')' on plugins %q", list)
+				}
+				continue
+			case ',':
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		if depth > 0 {
+			return nil, fmt.Errorf("missing ')' on plugins %q", list)
+		}
+		spec, err := parsePluginSpec(strings.TrimSpace(list[start:i]))
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+		start = i + 1
+	}
+	return specs, nil
+}
+
+func parsePluginSpec(entry string) (pluginSpec, error) {
+	spec := pluginSpec{name: entry, params: map[string]string{}}
+	open := strings.IndexByte(entry, '(')
+	if open < 0 {
+		if entry == "" {
+			return spec, errors.New("empty plugin name on -plugins")
+		}
+		return spec, nil
+	}
+	if !strings.HasSuffix(entry, ")") || strings.Count(entry, "(") > 1 {
+		return spec, fmt.Errorf("invalid plugin %q, use name(key=value,...)", entry)
+	}
+	spec.name = strings.TrimSpace(entry[:open])
+	if spec.name == "" {
+		return spec, fmt.Errorf("invalid plugin %q, missing name", entry)
+	}
+	body := strings.TrimSpace(entry[open+1 : len(entry)-1])
+	if body == "" {
+		return spec, nil
+	}
+	for _, pair := range strings.Split(body, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			return spec, fmt.Errorf("invalid parameter %q of plugin %s, use key=value", pair, spec.name)
+		}
+		if _, repeated := spec.params[key]; repeated {
+			return spec, fmt.Errorf("parameter %s of plugin %s is repeated", key, spec.name)
+		}
+		spec.params[key] = value
+	}
+	return spec, nil
+}
+
+// config validates the parameters against the manifest and adds the
+// defaults. Without manifest the parameters are passed as given.
+func (p InstalledPlugin) config(params map[string]string) (maria.Config, error) {
+	config := maria.Config{}
+	if p.Manifest == nil {
+		for key, value := range params {
+			config[key] = value
+		}
+		return config, nil
+	}
+	for key, value := range params {
+		schema, ok := p.Manifest.Params[key]
+		if !ok {
+			return nil, fmt.Errorf("plugin %s has no parameter %s (%s)", p.Name, key, strings.Join(p.paramNames(), ", "))
+		}
+		if err := schema.validate(value); err != nil {
+			return nil, fmt.Errorf("parameter %s of plugin %s: %w", key, p.Name, err)
+		}
+		config[key] = value
+	}
+	for key, schema := range p.Manifest.Params {
+		if _, ok := config[key]; ok {
+			continue
+		}
+		if schema.Required {
+			return nil, fmt.Errorf("plugin %s requires the parameter %s", p.Name, key)
+		}
+		if schema.Default != nil {
+			config[key] = fmt.Sprint(schema.Default)
+		}
+	}
+	return config, nil
+}
+
+func (p InstalledPlugin) paramNames() []string {
+	var names []string
+	if p.Manifest != nil {
+		for key := range p.Manifest.Params {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return []string{"no parameters"}
+	}
+	return names
+}
+
+func (s PluginParam) validate(value string) error {
+	var number float64
+	var err error
+	switch s.Type {
+	case "int":
+		var n int64
+		n, err = strconv.ParseInt(value, 10, 64)
+		number = float64(n)
+	case "float":
+		number, err = strconv.ParseFloat(value, 64)
+	case "bool":
+		_, err = strconv.ParseBool(value)
+		return err
+	case "string":
+		if len(s.Values) > 0 && !slices.Contains(s.Values, value) {
+			return fmt.Errorf("%q is not one of %s", value, strings.Join(s.Values, ", "))
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%q is not %s", value, s.Type)
+	}
+	if s.Min != nil && number < *s.Min {
+		return fmt.Errorf("%s is under the minimum %g", value, *s.Min)
+	}
+	if s.Max != nil && number > *s.Max {
+		return fmt.Errorf("%s is over the maximum %g", value, *s.Max)
+	}
+	return nil
+}
+
+// PrintPlugins shows the plugins of ListPlugins.
+func PrintPlugins(list []InstalledPlugin) {
+	fmt.Printf("Search path: %s\n", strings.Join(PluginSearchPath(), string(os.PathListSeparator)))
+	if len(list) == 0 {
+		fmt.Println("No plugins installed")
+		return
+	}
+	for _, p := range list {
+		line := fmt.Sprintf("%-20s %-8s %s", p.Name, p.Kind, p.Path)
+		if p.Shadowed {
+			line += " (shadowed)"
+		}
+		fmt.Println(line)
+		if m := p.Manifest; m != nil {
+			fmt.Printf("  version %s", m.Version)
+			if len(m.Hooks) > 0 {
+				fmt.Printf(" | hooks %s", strings.Join(m.Hooks, ", "))
+			}
+			fmt.Println()
+			if m.Description != "" {
+				fmt.Printf("  %s\n", m.Description)
+			}
+			for _, key := range p.paramNames() {
+				if param, ok := m.Params[key]; ok {
+					fmt.Printf("  %s (%s", key, param.Type)
+					if param.Default != nil {
+						fmt.Printf(", default %v", param.Default)
+					}
+					if param.Required {
+						fmt.Print(", required")
+					}
+					fmt.Printf(") %s\n", param.Description)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"MARIA/maria"
+)
+
+func TestLoadManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string // empty writes no manifest
+		wantErr  bool
+		hooks    []string
+	}{
+		{"no manifest", "", false, nil},
+		{"hooks", `{"name":"p","version":"1","hooks":["reads","after_merge"]}`, false, []string{"reads", "after_merge"}},
+		{"params", `{"name":"p","params":{"min":{"type":"int","default":3}}}`, false, nil},
+		{"unknown hook", `{"name":"p","hooks":["reads","finish"]}`, true, nil},
+		{"unknown type", `{"name":"p","params":{"min":{"type":"number"}}}`, true, nil},
+		{"invalid json", `{"name":`, true, nil},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		if tt.manifest != "" {
+			if err := os.WriteFile(filepath.Join(dir, "p.json"), []byte(tt.manifest), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the manifest of an external plugin has the name without extension
+		manifest, err := loadManifest(dir, "p.py")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.manifest == "" && manifest != nil {
+			t.Errorf("%s: got a manifest", tt.name)
+		}
+		if manifest != nil && !reflect.DeepEqual(manifest.Hooks, tt.hooks) {
+			t.Errorf("%s: hooks %v, want %v", tt.name, manifest.Hooks, tt.hooks)
+		}
+	}
+}
+
+func TestPluginConfig(t *testing.T) {
+	low, high := 1.0, 100.0
+	manifest := &PluginManifest{Name: "p", Params: map[string]PluginParam{
+		"min":  {Type: "int", Default: 3, Min: &low, Max: &high},
+		"rate": {Type: "float"},
+		"gz":   {Type: "bool", Default: false},
+		"mode": {Type: "string", Values: []string{"fast", "best"}},
+		"key":  {Type: "string", Required: true},
+	}}
+	plugin := InstalledPlugin{Name: "p", Manifest: manifest}
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    maria.Config
+		wantErr bool
+	}{
+		{"defaults", map[string]string{"key": "a"}, maria.Config{"key": "a", "min": "3", "gz": "false"}, false},
+		{"all", map[string]string{"key": "a", "min": "100", "rate": "0.5", "gz": "true", "mode": "best"},
+			maria.Config{"key": "a", "min": "100", "rate": "0.5", "gz": "true", "mode": "best"}, false},
+		{"missing required", map[string]string{}, nil, true},
+		{"unknown", map[string]string{"key": "a", "max": "3"}, nil, true},
+		{"not int", map[string]string{"key": "a", "min": "2.5"}, nil, true},
+		{"under min", map[string]string{"key": "a", "min": "0"}, nil, true},
+		{"over max", map[string]string{"key": "a", "min": "101"}, nil, true},
+		{"not float", map[string]string{"key": "a", "rate": "x"}, nil, true},
+		{"not bool", map[string]string{"key": "a", "gz": "yes"}, nil, true},
+		{"not a value", map[string]string{"key": "a", "mode": "slow"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := plugin.config(tt.params)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	// without manifest the parameters are passed as given
+	got, err := InstalledPlugin{Name: "q"}.config(map[string]string{"any": "x"})
+	if err != nil || !reflect.DeepEqual(got, maria.Config{"any": "x"}) {
+		t.Errorf("without manifest: got %v, %v", got, err)
+	}
+}
+
+func TestParsePluginList(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []pluginSpec
+		wantErr bool
+	}{
+		{"a", []pluginSpec{{"a", map[string]string{}}}, false},
+		{"a, b(min=3, mode=fast),c()", []pluginSpec{
+			{"a", map[string]string{}},
+			{"b", map[string]string{"min": "3", "mode": "fast"}},
+			{"c", map[string]string{}},
+		}, false},
+		{"a(min=3", nil, true},
+		{"a)", nil, true},
+		{"a(min)", nil, true},
+		{"a(min=1,min=2)", nil, true},
+		{"(min=1)", nil, true},
+		{"a,,b", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePluginList(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v, want error %v", tt.list, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestDeclaredHooks(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest *PluginManifest
+		allowed  []string
+		denied   []string
+	}{
+		{"no manifest", nil, []string{"reads", "chunk", "after_merge"}, nil},
+		{"no hooks", &PluginManifest{Name: "p"}, []string{"reads", "chunk", "after_merge"}, nil},
+		{"declared", &PluginManifest{Name: "p", Hooks: []string{"chunk"}}, []string{"chunk"}, []string{"reads", "after_merge"}},
+	}
+	for _, tt := range tests {
+		p := namedPlugin{declared: InstalledPlugin{Manifest: tt.manifest}.declaredHooks()}
+		for _, hook := range tt.allowed {
+			if !p.allows(hook) {
+				t.Errorf("%s: %s not allowed", tt.name, hook)
+			}
+		}
+		for _, hook := range tt.denied {
+			if p.allows(hook) {
+				t.Errorf("%s: %s allowed", tt.name, hook)
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	sampleExtensions = []string{".gz", ".bz2", ".xz", ".zst", ".fastq", ".fq", ".fasta", ".fa", ".fna"}
+	// Illumina bcl2fastq/BCL Convert names: Sample_S1_L001_R1_001
+	illuminaFileSuffix = regexp.MustCompile(`_S\d+(_L\d{3})?(_[RI][12])?(_001)?$`)
+)
+
+// SampleName derives a stable sample name from the input path: file name
+// without compression and sequence extensions, and without the sample number,
+// lane and chunk of Illumina names (the read number is kept so R1 and R2 do
+// not collide).
+func SampleName(path string) string {
+	name := filepath.Base(path)
+	for trimmed := true; trimmed; {
+		trimmed = false
+		for _, ext := range sampleExtensions {
+			if strings.HasSuffix(strings.ToLower(name), ext) && len(name) > len(ext) {
+				name = name[:len(name)-len(ext)]
+				trimmed = true
+			}
+		}
+	}
+	return illuminaFileSuffix.ReplaceAllString(name, "$2")
+}
+
+// multiqcSection is a MultiQC custom content file (*_mqc.json), sections with
+// the same id on files of different samples are merged on one plot.
+type multiqcSection struct {
+	ID          string         `json:"id"`
+	SectionName string         `json:"section_name,omitempty"`
+	Description string         `json:"description,omitempty"`
+	PlotType    string         `json:"plot_type"`
+	PConfig     any            `json:"pconfig,omitempty"` // list of columns on generalstats
+	Data        map[string]any `json:"data"`
+}
+
+// multiqcSections builds the sections of a run report.
+func multiqcSections(r *RunReport) []multiqcSection {
+	sample := r.Sample
+	generalStats := map[string]any{"technology": r.Technology.Tech}
+	sections := []multiqcSection{}
+	if stats := r.Stats; stats != nil {
+		generalStats["reads_in"] = stats.ReadsIn
+		generalStats["reads_out"] = stats.ReadsOut
+		generalStats["bases_out"] = stats.BasesOut
+		if stats.ReadsIn > 0 {
+			generalStats["percent_passed"] = float64(stats.ReadsOut) * 100 / float64(stats.ReadsIn)
+		}
+		rejected := map[string]int64{"passed": stats.ReadsOut}
+		for _, reason := range RejectReasons {
+			rejected[string(reason)] = stats.Rejected[reason]
+		}
+		sections = append(sections, multiqcSection{
+			ID: "maria_filtering", SectionName: "MARIA: filtering", PlotType: "bargraph",
+			Description: "Reads passed and rejected per filter.",
+			PConfig:     map[string]any{"id": "maria_filtering_plot", "title": "MARIA: filtering", "ylab": "Reads"},
+			Data:        map[string]any{sample: rejected},
+		})
+		if len(stats.AdapterHits) > 0 {
+			adapters := map[string]int64{}
+			for adapter, hits := range stats.AdapterHits {
+				adapters[adapter] = hits
+			}
+			sections = append(sections, multiqcSection{
+				ID: "maria_adapters", SectionName: "MARIA: adapters", PlotType: "bargraph",
+				Description: "Reads trimmed per adapter.",
+				PConfig:     map[string]any{"id": "maria_adapters_plot", "title": "MARIA: adapters", "ylab": "Reads"},
+				Data:        map[string]any{sample: adapters},
+			})
+		}
+	}
+	if qc := r.QC; qc != nil {
+		generalStats["gc_after"] = qc.After.GCPercent
+		generalStats["mean_length_after"] = qc.After.MeanLength
+		quality := map[string]float64{}
+		for i, position := range qc.After.PerPosition {
+			first, _ := binRange(i)
+			quality[fmt.Sprint(first)] = position.Mean
+		}
+		lengths := map[string]int64{}
+		for _, length := range qc.After.Lengths {
+			first := lengthStart(length.Length)
+			lengths[fmt.Sprint(first)] = length.Reads
+		}
+		gc := map[string]float64{}
+		for percent, value := range percentOfReads(qc.After.GC) {
+			gc[fmt.Sprint(percent)] = value
+		}
+		sections = append(sections,
+			multiqcSection{
+				ID: "maria_quality", SectionName: "MARIA: quality per position", PlotType: "linegraph",
+				Description: "Mean quality per position after cleaning.",
+				PConfig:     map[string]any{"id": "maria_quality_plot", "title": "MARIA: quality per position", "xlab": "Position (bp)", "ylab": "Phred score", "ymin": 0},
+				Data:        map[string]any{sample: quality},
+			},
+			multiqcSection{
+				ID: "maria_lengths", SectionName: "MARIA: read lengths", PlotType: "linegraph",
+				Description: "Length distribution after cleaning.",
+				PConfig:     map[string]any{"id": "maria_lengths_plot", "title": "MARIA: read lengths", "xlab": "Length (bp)", "ylab": "Reads", "ymin": 0},
+				Data:        map[string]any{sample: lengths},
+			},
+			multiqcSection{
+				ID: "maria_gc", SectionName: "MARIA: GC content", PlotType: "linegraph",
+				Description: "GC content per read after cleaning.",
+				PConfig:     map[string]any{"id": "maria_gc_plot", "title": "MARIA: GC content", "xlab": "GC (%)", "ylab": "Reads (%)", "ymin": 0},
+				Data:        map[string]any{sample: gc},
+			})
+	}
+	if len(r.Samples) > 0 {
+		reads := map[string]int{}
+		for _, count := range r.Samples {
+			reads[count.Sample] = count.Reads
+		}
+		sections = append(sections, multiqcSection{
+			ID: "maria_demux", SectionName: "MARIA: demultiplexing", PlotType: "bargraph",
+			Description: "Reads assigned per sample.",
+			PConfig:     map[string]any{"id": "maria_demux_plot", "title": "MARIA: demultiplexing", "ylab": "Reads"},
+			Data:        map[string]any{sample: reads},
+		})
+	}
+	general := multiqcSection{
+		ID: "maria_general", PlotType: "generalstats",
+		PConfig: []map[string]any{
+			{"reads_in": map[string]any{"title": "Reads in", "description": "Reads in (MARIA)", "format": "{:,.0f}"}},
+			{"reads_out": map[string]any{"title": "Reads out", "description": "Reads after cleaning (MARIA)", "format": "{:,.0f}"}},
+			{"percent_passed": map[string]any{"title": "% Passed", "description": "Percent of reads passed (MARIA)", "suffix": "%", "max": 100, "min": 0}},
+			{"bases_out": map[string]any{"title": "Bases out", "description": "Bases after cleaning (MARIA)", "format": "{:,.0f}"}},
+			{"gc_after": map[string]any{"title": "% GC", "description": "GC content after cleaning (MARIA)", "suffix": "%", "max": 100, "min": 0}},
+			{"mean_length_after": map[string]any{"title": "Mean length", "description": "Mean read length after cleaning (MARIA)", "suffix": " bp"}},
+			{"technology": map[string]any{"title": "Technology", "description": "Detected technology (MARIA)"}},
+		},
+		Data: map[string]any{sample: generalStats},
+	}
+	return append([]multiqcSection{general}, sections...)
+}
+
+// WriteMultiQC saves the run as MultiQC custom content on dir, one
+// <sample>_maria_<section>_mqc.json file per section so the runs of several
+// samples written on the same folder aggregate on one dashboard.
+func (r *RunReport) WriteMultiQC(dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error to create folder %s: %w", dir, err)
+	}
+	var paths []string
+	for _, section := range multiqcSections(r) {
+		data, err := json.MarshalIndent(section, "", "  ")
+		if err != nil {
+			return paths, fmt.Errorf("error encode %s: %w", section.ID, err)
+		}
+		path := filepath.Join(dir, r.Sample+"_"+section.ID+"_mqc.json")
+		if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSampleName(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"data/Lib7_S3_L001_R1_001.fastq.gz", "Lib7_R1"},
+		{"Lib7_S3_R2_001.fq", "Lib7_R2"},
+		{"sample_S12.fastq", "sample"},
+		{"reads.fa.gz", "reads"},
+		{"run.ont.fastq.zst", "run.ont"},
+		{"Sample_1.fastq", "Sample_1"},
+		{".fastq", ".fastq"},
+	}
+	for _, tt := range tests {
+		if got := SampleName(tt.path); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestWriteMultiQC(t *testing.T) {
+	report := testRunReport(t)
+	dir := filepath.Join(t.TempDir(), "multiqc")
+	paths, err := report.WriteMultiQC(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := map[string]multiqcSection{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var section multiqcSection
+		if err := json.Unmarshal(data, &section); err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(path) != "Lib7_R1_"+section.ID+"_mqc.json" {
+			t.Errorf("%s has the section %s", path, section.ID)
+		}
+		if _, ok := section.Data["Lib7_R1"]; !ok {
+			t.Errorf("%s without the sample", section.ID)
+		}
+		sections[section.ID] = section
+	}
+	for _, id := range []string{"maria_general", "maria_filtering", "maria_adapters", "maria_quality", "maria_lengths", "maria_gc"} {
+		if _, ok := sections[id]; !ok {
+			t.Errorf("no section %s", id)
+		}
+	}
+	general, _ := sections["maria_general"].Data["Lib7_R1"].(map[string]any)
+	if sections["maria_general"].PlotType != "generalstats" || general["reads_in"] != float64(500) || general["technology"] != "Illumina" {
+		t.Errorf("general stats %v", general)
+	}
+	filtering, _ := sections["maria_filtering"].Data["Lib7_R1"].(map[string]any)
+	if filtering["passed"] != float64(report.Stats.ReadsOut) || len(filtering) != len(RejectReasons)+1 {
+		t.Errorf("filtering %v", filtering)
+	}
+	if _, ok := sections["maria_demux"]; ok {
+		t.Error("demux section without samples")
+	}
+
+	// demux adds the reads per sample, without QC there are no QC plots
+	report.QC = nil
+	report.Samples = []DemuxCount{{Sample: UndeterminedSample, Reads: 3}, {Sample: "S1", Reads: 7}}
+	paths, err = report.WriteMultiQC(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 4 || filepath.Base(paths[3]) != "Lib7_R1_maria_demux_mqc.json" {
+		t.Errorf("files %v", paths)
+	}
+}
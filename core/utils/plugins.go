@@ -0,0 +1,365 @@
+package utils
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"plugin"
+	"strings"
+
+	"MARIA/maria"
+)
+
+// PluginRegistry has the plugins of the run opened once at startup, the
+// symbols are resolved and their signatures validated before the reads are
+// processed. Plugins are chained in the order of -plugins.
+type PluginRegistry struct {
+	Names   []string
+	plugins []namedPlugin
+	reads   int // plugins with ProcessRead
+	chunks  int // plugins with ProcessChunk
+}
+
+// namedPlugin is a plugin of the chain with the hooks it runs: the hooks of
+// its manifest, or without them ProcessRead and ProcessChunk with -preworker.
+// Init, BeforeRun and Close always run, they open and release the plugin.
+type namedPlugin struct {
+	name       string
+	plugin     maria.Plugin
+	config     maria.Config
+	declared   map[string]bool // hooks of the manifest, nil when it has none
+	reads      bool            // ProcessRead is called
+	chunk      bool            // ProcessChunk is called
+	afterMerge bool
+}
+
+// allows reports if the manifest lets the hook run, all hooks are allowed
+// without declared hooks.
+func (p namedPlugin) allows(hook string) bool {
+	return p.declared == nil || p.declared[hook]
+}
+
+// LoadPlugins opens the plugins of the list (name or name(key=value,...))
+// found on PluginSearchPath: <dir>/<name>.so or, without .so, an executable
+// <dir>/<name> that runs as an external plugin. The parameters are checked
+// against the manifest of the plugin. A typed plugin exports MariaABI and
+// NewPlugin() maria.Plugin, MariaABI must be the maria.ABIVersion of this
+// build. The legacy plugins export Process(string) error (run on the output
+// file) and/or ProcessDataWorker([4]string) ([4]string, error) (run per read
+// with preWorker, then required). The hooks declared on the manifest decide
+// which hooks run. Returns nil when the list is empty.
+func LoadPlugins(pluginList string, preWorker bool) (*PluginRegistry, error) {
+	if strings.TrimSpace(pluginList) == "" {
+		return nil, nil
+	}
+	specs, err := parsePluginList(pluginList)
+	if err != nil {
+		return nil, err
+	}
+	registry := &PluginRegistry{}
+	for _, spec := range specs {
+		installed, err := FindPlugin(spec.name)
+		if err != nil {
+			return nil, err
+		}
+		config, err := installed.config(spec.params)
+		if err != nil {
+			return nil, err
+		}
+		if installed.Manifest == nil && len(spec.params) > 0 {
+			slog.Warn("plugin without manifest, parameters are not validated", "name", spec.name)
+		}
+		declared := installed.declaredHooks()
+		var loaded namedPlugin
+		if installed.Kind == "external" {
+			// the reads hook is known after Init
+			loaded = namedPlugin{name: spec.name, plugin: newExternalPlugin(spec.name, installed.Path), declared: declared}
+		} else {
+			p, err := plugin.Open(installed.Path)
+			if err != nil {
+				return nil, fmt.Errorf("can't open plugin %s: %w", spec.name, err)
+			}
+			loaded, err = typedPlugin(spec.name, p, declared, preWorker)
+			if err == nil && loaded.plugin == nil {
+				if len(spec.params) > 0 {
+					return nil, fmt.Errorf("plugin %s has no NewPlugin, it can't receive parameters", spec.name)
+				}
+				loaded, err = legacyPlugin(spec.name, p, declared, preWorker)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		loaded.config = config
+		registry.add(loaded)
+		attrs := []any{"name", spec.name, "path", installed.Path}
+		if installed.Manifest != nil {
+			attrs = append(attrs, "version", installed.Manifest.Version)
+		}
+		slog.Info("plugin loaded", attrs...)
+	}
+	return registry, nil
+}
+
+// add appends the plugin to the chain.
+func (r *PluginRegistry) add(p namedPlugin) {
+	r.Names = append(r.Names, p.name)
+	r.plugins = append(r.plugins, p)
+	if p.reads {
+		r.reads++
+	}
+	if p.chunk {
+		r.chunks++
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir() && info.Mode()&0o111 != 0
+}
+
+// typedPlugin returns an empty plugin when the .so has no NewPlugin.
+func typedPlugin(name string, p *plugin.Plugin, declared map[string]bool, preWorker bool) (namedPlugin, error) {
+	sym, err := p.Lookup("NewPlugin")
+	if err != nil {
+		return namedPlugin{}, nil
+	}
+	newPlugin, ok := sym.(func() maria.Plugin)
+	if !ok {
+		return namedPlugin{}, fmt.Errorf("'NewPlugin' on plugin %s has type %T, want func() maria.Plugin", name, sym)
+	}
+	abiSym, err := p.Lookup("MariaABI")
+	if err != nil {
+		return namedPlugin{}, fmt.Errorf("plugin %s has no 'MariaABI', export var MariaABI = maria.ABIVersion", name)
+	}
+	abi, ok := abiSym.(*int)
+	if !ok {
+		return namedPlugin{}, fmt.Errorf("'MariaABI' on plugin %s has type %T, want int", name, abiSym)
+	}
+	if *abi != maria.ABIVersion {
+		return namedPlugin{}, fmt.Errorf("plugin %s was built for plugin ABI %d, this MARIA uses %d: rebuild it", name, *abi, maria.ABIVersion)
+	}
+	instance := newPlugin()
+	if instance == nil {
+		return namedPlugin{}, fmt.Errorf("plugin %s returned a nil plugin", name)
+	}
+	loaded := namedPlugin{name: name, plugin: instance, declared: declared, reads: preWorker, chunk: preWorker}
+	if declared != nil {
+		loaded.reads, loaded.chunk = declared["reads"], declared["chunk"]
+	}
+	loaded.afterMerge = loaded.allows("after_merge")
+	return loaded, nil
+}
+
+// legacyPlugin wraps the Process and ProcessDataWorker functions.
+func legacyPlugin(name string, p *plugin.Plugin, declared map[string]bool, preWorker bool) (namedPlugin, error) {
+	legacy := &legacyHooks{}
+	if sym, err := p.Lookup("Process"); err == nil {
+		processFunc, ok := sym.(func(string) error)
+		if !ok {
+			return namedPlugin{}, fmt.Errorf("'Process' on plugin %s has type %T, want func(string) error", name, sym)
+		}
+		legacy.process = processFunc
+	}
+	if sym, err := p.Lookup("ProcessDataWorker"); err == nil {
+		processFunc, ok := sym.(func([4]string) ([4]string, error))
+		if !ok {
+			return namedPlugin{}, fmt.Errorf("'ProcessDataWorker' on plugin %s has type %T, want func([4]string) ([4]string, error)", name, sym)
+		}
+		legacy.worker = processFunc
+	}
+	switch {
+	case preWorker && legacy.worker == nil:
+		return namedPlugin{}, fmt.Errorf("plugin %s has no function 'ProcessDataWorker' for -preworker", name)
+	case legacy.process == nil && legacy.worker == nil:
+		return namedPlugin{}, fmt.Errorf("plugin %s has no 'NewPlugin', 'Process' or 'ProcessDataWorker'", name)
+	}
+	loaded := namedPlugin{name: name, plugin: legacy, declared: declared, reads: preWorker}
+	if declared != nil {
+		loaded.reads = declared["reads"] && legacy.worker != nil
+	}
+	loaded.afterMerge = legacy.process != nil && loaded.allows("after_merge")
+	return loaded, nil
+}
+
+// legacyHooks adapts the plugins without NewPlugin to maria.Plugin.
+type legacyHooks struct {
+	maria.Base
+	process func(string) error
+	worker  func([4]string) ([4]string, error)
+}
+
+func (l *legacyHooks) ProcessRead(read maria.Read) ([]maria.Read, error) {
+	out, err := l.worker(fromPluginRead(read))
+	if err != nil || out[0] == "" {
+		return nil, err
+	}
+	return []maria.Read{toPluginRead(out)}, nil
+}
+
+func (l *legacyHooks) AfterMerge(outputPath string) error {
+	if l.process == nil {
+		return nil
+	}
+	return l.process(outputPath)
+}
+
+func toPluginRead(read [4]string) maria.Read {
+	return maria.Read{
+		ID:      strings.TrimRight(read[0], "\r\n"),
+		Bases:   strings.TrimRight(read[1], "\r\n"),
+		Plus:    strings.TrimRight(read[2], "\r\n"),
+		Quality: strings.TrimRight(read[3], "\r\n"),
+	}
+}
+
+// fromPluginRead adds the line breaks, empty fields (fasta) stay empty.
+func fromPluginRead(read maria.Read) [4]string {
+	var out [4]string
+	for i, field := range []string{read.ID, read.Bases, read.Plus, read.Quality} {
+		if field != "" {
+			out[i] = field + "\n"
+		}
+	}
+	return out
+}
+
+// Init gives each plugin the parameters of -plugins with the defaults of its
+// manifest. The external plugins answer their hooks, only the ones allowed
+// by the manifest are kept.
+func (r *PluginRegistry) Init() error {
+	if r == nil {
+		return nil
+	}
+	for i, p := range r.plugins {
+		if err := p.plugin.Init(p.config); err != nil {
+			return fmt.Errorf("plugin %s init failed: %w", p.name, err)
+		}
+		if external, ok := p.plugin.(*externalPlugin); ok {
+			for hook := range external.hooks {
+				if !p.allows(hook) {
+					delete(external.hooks, hook)
+				}
+			}
+			// the reads of a chunk are sent as one batch
+			r.plugins[i].chunk, r.plugins[i].afterMerge = external.hooks["reads"], external.hooks["after_merge"]
+			if r.plugins[i].chunk {
+				r.chunks++
+			}
+		}
+	}
+	return nil
+}
+
+func (r *PluginRegistry) BeforeRun(info maria.RunInfo) error {
+	if r == nil {
+		return nil
+	}
+	for _, p := range r.plugins {
+		if err := p.plugin.BeforeRun(info); err != nil {
+			return fmt.Errorf("plugin %s failed before run: %w", p.name, err)
+		}
+	}
+	return nil
+}
+
+// HasReadHooks reports if reads must go through ProcessRead.
+func (r *PluginRegistry) HasReadHooks() bool {
+	return r != nil && r.reads > 0
+}
+
+// HasChunkHooks reports if chunks must go through ProcessChunk.
+func (r *PluginRegistry) HasChunkHooks() bool {
+	return r != nil && r.chunks > 0
+}
+
+// ProcessRead chains the plugins, each one receives the reads emitted by the
+// previous, and appends the reads left to kept. The reads are views on the
+// buffer of the chunk (see maria.Read), they are not copied.
+func (r *PluginRegistry) ProcessRead(seq Sequence, kept []Sequence) ([]Sequence, error) {
+	one := [1]maria.Read{maria.Read(seq)}
+	reads := one[:]
+	for _, p := range r.plugins {
+		if !p.reads {
+			continue
+		}
+		var next []maria.Read
+		for _, in := range reads {
+			out, err := p.plugin.ProcessRead(in)
+			if err != nil {
+				return kept, fmt.Errorf("plugin %s failed: %w", p.name, err)
+			}
+			// the slice of the plugin is not appended in place
+			next = append(next[:len(next):len(next)], out...)
+		}
+		if reads = next; len(reads) == 0 {
+			break
+		}
+	}
+	for _, read := range reads {
+		if read.ID != "" {
+			kept = append(kept, Sequence(read))
+		}
+	}
+	return kept, nil
+}
+
+// ProcessChunk runs the chunk hook of the plugins on the reads kept of a
+// chunk, before they are written.
+func (r *PluginRegistry) ProcessChunk(id int, seqs []Sequence) ([]Sequence, error) {
+	chunk := &maria.Chunk{ID: id, Reads: make([]maria.Read, len(seqs))}
+	for i, seq := range seqs {
+		chunk.Reads[i] = maria.Read(seq)
+	}
+	for _, p := range r.plugins {
+		if !p.chunk {
+			continue
+		}
+		if err := p.plugin.ProcessChunk(chunk); err != nil {
+			return nil, fmt.Errorf("plugin %s failed on chunk %d: %w", p.name, id, err)
+		}
+	}
+	out := seqs[:0]
+	for _, read := range chunk.Reads {
+		if read.ID != "" {
+			out = append(out, Sequence(read))
+		}
+	}
+	return out, nil
+}
+
+// AfterMerge runs the plugins on the output file.
+func (r *PluginRegistry) AfterMerge(path string) error {
+	if r == nil {
+		return nil
+	}
+	for _, p := range r.plugins {
+		if !p.afterMerge {
+			continue
+		}
+		slog.Info("executing plugin", "name", p.name)
+		if err := p.plugin.AfterMerge(path); err != nil {
+			return fmt.Errorf("plugin %s failed: %w", p.name, err)
+		}
+	}
+	return nil
+}
+
+// Close releases the plugins, all are closed and the first error is returned.
+func (r *PluginRegistry) Close() error {
+	if r == nil {
+		return nil
+	}
+	var first error
+	for _, p := range r.plugins {
+		if err := p.plugin.Close(); err != nil && first == nil {
+			first = fmt.Errorf("plugin %s close failed: %w", p.name, err)
+		}
+	}
+	return first
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"MARIA/maria"
+)
+
+func TestLoadPlugins(t *testing.T) {
+	if registry, err := LoadPlugins(" ", false); registry != nil || err != nil {
+		t.Errorf("empty list: %v, %v", registry, err)
+	}
+	dir := t.TempDir()
+	if err := os.Symlink(os.Args[0], filepath.Join(dir, "echo")); err != nil {
+		t.Fatal(err)
+	}
+	saved := PluginDirs
+	defer func() { PluginDirs = saved }()
+	PluginDirs = []string{dir}
+	t.Setenv(testPluginEnv, "echo")
+	if _, err := LoadPlugins("echo,missing", false); err == nil {
+		t.Error("want an error on a missing plugin")
+	}
+	// each plugin of the list is opened once, the chain keeps the order
+	registry, err := LoadPlugins("echo,echo", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.Close()
+	if !reflect.DeepEqual(registry.Names, []string{"echo", "echo"}) || registry.plugins[0].plugin == registry.plugins[1].plugin {
+		t.Fatalf("registry %+v", registry)
+	}
+	if err := registry.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if !registry.HasChunkHooks() || registry.HasReadHooks() {
+		t.Errorf("chunk hooks %v, read hooks %v", registry.HasChunkHooks(), registry.HasReadHooks())
+	}
+}
+
+// splitPlugin emits the two halves of a read.
+type splitPlugin struct{ maria.Base }
+
+func (splitPlugin) ProcessRead(read maria.Read) ([]maria.Read, error) {
+	half := len(read.Bases) / 2
+	return []maria.Read{
+		{ID: read.ID + "/a", Bases: read.Bases[:half], Plus: read.Plus, Quality: read.Quality[:half]},
+		{ID: read.ID + "/b", Bases: read.Bases[half:], Plus: read.Plus, Quality: read.Quality[half:]},
+	}, nil
+}
+
+// dropPlugin drops the reads with an N, fails on the reads with an X and
+// empties the ID of the reads of a chunk starting with T.
+type dropPlugin struct{ maria.Base }
+
+func (dropPlugin) ProcessRead(read maria.Read) ([]maria.Read, error) {
+	switch {
+	case strings.Contains(read.Bases, "X"):
+		return nil, errors.New("X is not a base")
+	case strings.Contains(read.Bases, "N"):
+		return nil, nil
+	}
+	return []maria.Read{read}, nil
+}
+
+func (dropPlugin) ProcessChunk(chunk *maria.Chunk) error {
+	for i := range chunk.Reads {
+		if strings.HasPrefix(chunk.Reads[i].Bases, "T") {
+			chunk.Reads[i].ID = ""
+		}
+	}
+	return nil
+}
+
+func TestPluginRegistryProcessRead(t *testing.T) {
+	registry := &PluginRegistry{}
+	registry.add(namedPlugin{name: "split", plugin: splitPlugin{}, reads: true})
+	registry.add(namedPlugin{name: "drop", plugin: dropPlugin{}, reads: true, chunk: true})
+	tests := []struct {
+		name    string
+		bases   string
+		want    []string
+		wantErr bool
+	}{
+		// each plugin receives the reads emitted by the previous
+		{"both halves", "ACGTAC", []string{"@r/a", "@r/b"}, false},
+		{"one half", "ACGNAC", []string{"@r/a"}, false},
+		{"none", "NCGNAC", nil, false},
+		{"error", "ACGXAC", nil, true},
+	}
+	for _, tt := range tests {
+		seq := Sequence{ID: "@r", Bases: tt.bases, Plus: "+", Quality: strings.Repeat("I", len(tt.bases))}
+		kept := []Sequence{{ID: "@before"}}
+		kept, err := registry.ProcessRead(seq, kept)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			if !strings.Contains(err.Error(), "plugin drop") {
+				t.Errorf("%s: error %v without the plugin", tt.name, err)
+			}
+			continue
+		}
+		var ids []string
+		for _, read := range kept[1:] {
+			ids = append(ids, read.ID)
+		}
+		if kept[0].ID != "@before" || !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("%s: kept %v, want %v", tt.name, ids, tt.want)
+		}
+	}
+	// a read without ID on a chunk is dropped
+	out, err := registry.ProcessChunk(1, []Sequence{{ID: "@a", Bases: "TTT"}, {ID: "@b", Bases: "ACG"}})
+	if err != nil || len(out) != 1 || out[0].ID != "@b" {
+		t.Errorf("chunk: %+v, %v", out, err)
+	}
+}
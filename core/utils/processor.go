@@ -2,106 +2,216 @@ package utils
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	"MARIA/maria"
 )
 
-func ParallelClean(
-	inputPath,
-	outputPath string,
-	chunkSize int,
-	tech string,
-	useDisk bool,
-	threads int,
-	tempDir string,
-	pluginList string,
-	preWorker bool,
-	details bool,
-) {
-	if threads <= 0 {
-		threads = AvailableCPU()
-	}
-	fmt.Printf("Threads: %v\n", threads)
-	reader, err := SmartReadFile(inputPath)
+// CleanOptions are the settings of ParallelClean and CleanStream.
+type CleanOptions struct {
+	Profile       Profile
+	ChunkSize     int    // reads per chunk
+	Threads       int    // 0 uses all the cores
+	TempDir       string // temporal chunks of ParallelClean
+	Plugins       string // list of -plugins
+	PreWorker     bool
+	Details       bool  // ParallelClean: rejected reads per filter on <output>_details
+	SplitChimeras bool  // split reads on internal adapters
+	TargetBases   int64 // ParallelClean: keep the best reads up to these bases, 0 keeps all
+	Sampler       *Sampler
+	QC            bool
+	AdaptChunks   bool    // ChunkSize is the initial size, it adapts to the worker throughput and the memory
+	LinesPerRead  int     // 4 on FASTQ (the default), 2 on FASTA (CheckFileFormat)
+	Run           *RunLog // ParallelClean: phases and files of the run, nil only logs the phases
+}
+
+// ParallelClean cleans inputPath on outputPath. The chunks are cleaned on
+// parallel into temporal files of TempDir and merged in order. Cancelling
+// ctx stops the run and removes the temporal files.
+func ParallelClean(ctx context.Context, inputPath, outputPath string, opts CleanOptions) (*CleanStats, error) {
+	if opts.Threads <= 0 {
+		opts.Threads = AvailableCPU()
+	}
+	slog.Info("threads", "count", opts.Threads)
+	plugins, err := startPlugins(opts, maria.RunInfo{Input: inputPath, Output: outputPath})
 	if err != nil {
-		log.Fatalf("Error open file: %v", err)
+		return nil, err
 	}
-	jobs := make(chan [][4]string, threads*2)
+	defer closePlugins(plugins)
+	reader, closeInput, err := SmartReadFile(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("error open file: %w", err)
+	}
+	defer closeInput()
+	jobs := make(chan readChunk, opts.Threads*2)
 	var wg sync.WaitGroup
-	NextPhase("Run on parallel threads", 4)
-	// Launches workers
-	startWorkers(threads, jobs, tempDir, tech, &wg, pluginList, preWorker, details)
+	stats := NewCleanStats()
+	stats.Threads, stats.ChunkSize = opts.Threads, opts.ChunkSize
+	abort := newRunAbort()
+	stop := context.AfterFunc(ctx, func() { abort.fail(ctx.Err()) })
+	defer stop()
+	sizer := newChunkSizer(opts.ChunkSize, opts.AdaptChunks, opts.Threads)
+	opts.Run.NextPhase("Run on parallel threads", 4)
+	// Launches workers, one file per chunk, the zero padded id keeps the input order on merge
+	startWorkers(opts, jobs, &wg, plugins, opts.Details, stats, sizer, abort, func(chunk cleanedChunk) error {
+		defer chunk.buf.release()
+		if _, err := WriteTempFile(opts.TempDir, chunkFileName(chunk.id, ""), chunk.out); err != nil {
+			return err
+		}
+		if opts.Details {
+			return writeRejected(opts.TempDir, chunk.id, chunk.rejected)
+		}
+		return nil
+	})
 	// process all chunks generates
-	processChunks(reader, jobs, chunkSize)
+	progress := NewProgress(inputPath, stats)
+	progress.Start()
+	readSampledChunks(reader, jobs, sizer, opts.LinesPerRead, opts.Sampler, progress, abort)
 	wg.Wait()
+	progress.Stop()
+	if abort.err != nil {
+		removeChunks(opts.TempDir)
+		return nil, abort.err
+	}
+	sizer.logFinal()
 	// generate file output
-	handleOutput(outputPath, tempDir, pluginList)
+	if err := handleOutput(outputPath, opts.TempDir, plugins, opts.TargetBases, stats, opts.Run); err != nil {
+		removeChunks(opts.TempDir)
+		return nil, err
+	}
+	if opts.Details {
+		detailsDir := strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + "_details"
+		if err := mergeRejected(opts.TempDir, detailsDir, recordExt(opts.LinesPerRead), stats, opts.Run); err != nil {
+			removeChunks(opts.TempDir)
+			return nil, fmt.Errorf("error writing details: %w", err)
+		}
+		slog.Info("rejected reads per filter written", "path", detailsDir)
+	}
+	return stats, nil
 }
 
-func DetectSequencingTech(lines []string) string {
-	for _, l := range lines {
-		line := strings.ToLower(l)
-		// Illumina: cabezal típico con @NS o patrón típico de Illumina
-		if strings.Contains(l, "@NS") || strings.Contains(l, ":1:") {
-			return "Illumina"
-			// Oxford Nanopore: típico contiene "runid" en encabezados
-		} else if strings.Contains(l, "@") && strings.Contains(l, "runid") {
-			return "Oxford Nanopore"
-			// PacBio: líneas que inician con ">m" o contienen "ccs"
-		} else if strings.HasPrefix(l, ">m") || strings.Contains(l, "ccs") {
-			return "PacBio"
-			// Ion Torrent: patron más específico, por ejemplo "S1" en id, pero cuidado
-			// Aquí puedes agregar más patrones específicos según tu data
-		} else if strings.Contains(l, "S1") ||
-			strings.Contains(l, "R_") ||
-			strings.Contains(line, "ionxpress") ||
-			strings.Contains(line, "ion") ||
-			strings.Contains(line, "thermo") ||
-			strings.Contains(line, "s1") || // usualmente lane o sample
-			strings.Contains(line, "pgm") || // modelo Ion Torrent Personal Genome Machine
-			strings.Contains(line, "s5") {
-			return "Ion Torrent"
-		}
-	}
-	return ""
-}
-
-func mergeChunks(tempDir, outputPath string) error {
-	outputFile, err := os.Create(outputPath)
+// startPlugins loads the plugins of the options and runs Init and BeforeRun,
+// info has the input and output.
+func startPlugins(opts CleanOptions, info maria.RunInfo) (*PluginRegistry, error) {
+	plugins, err := LoadPlugins(opts.Plugins, opts.PreWorker)
 	if err != nil {
-		return fmt.Errorf("error to create file: %w", err)
+		return nil, err
+	}
+	info.Tech, info.Profile, info.Threads, info.ChunkSize = opts.Profile.Tech, opts.Profile.Name, opts.Threads, opts.ChunkSize
+	if err := plugins.Init(); err == nil {
+		err = plugins.BeforeRun(info)
 	}
-	defer outputFile.Close()
-
-	files, err := filepath.Glob(filepath.Join(tempDir, "chunk_*.tmp"))
 	if err != nil {
-		return fmt.Errorf("error to list tmp files: %w", err)
+		closePlugins(plugins)
+		return nil, err
+	}
+	return plugins, nil
+}
+
+func closePlugins(plugins *PluginRegistry) {
+	if err := plugins.Close(); err != nil {
+		slog.Warn("plugin close", "error", err)
+	}
+}
+
+// runAbort keeps the first error of the workers, readChunks stops sending
+// chunks and the workers skip the rest once it fails.
+type runAbort struct {
+	once sync.Once
+	err  error
+	done chan struct{}
+}
+
+func newRunAbort() *runAbort {
+	return &runAbort{done: make(chan struct{})}
+}
+
+func (a *runAbort) fail(err error) {
+	a.once.Do(func() {
+		a.err = err
+		close(a.done)
+	})
+}
+
+func (a *runAbort) failed() bool {
+	select {
+	case <-a.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// removeChunks deletes the temporal files of a failed run.
+func removeChunks(tempDir string) {
+	files, _ := filepath.Glob(filepath.Join(tempDir, "chunk_*.tmp"))
+	for _, file := range files {
+		DeleteTempFile(file)
 	}
+}
 
-	sort.Strings(files) // sort files to merge in order
+// DetectSequencingTech returns the most probable technology of the sample, empty
+// when the classifier is not confident (see ClassifySequencingTech).
+func DetectSequencingTech(lines []string) string {
+	best := ClassifySequencingTech(lines).Best()
+	if best.Probability < DefaultTechConfidence {
+		return ""
+	}
+	return best.Tech
+}
 
+func mergeChunks(tempDir, outputPath string) (FileChecksum, error) {
+	return mergeFiles(filepath.Join(tempDir, "chunk_????????.tmp"), outputPath)
+}
+
+// mergeFiles concatenates the temporal files of the pattern in name order,
+// the output is hashed while it is written.
+func mergeFiles(pattern, outputPath string) (FileChecksum, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return FileChecksum{}, fmt.Errorf("error to list tmp files: %w", err)
+	}
+	sort.Strings(files)
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return FileChecksum{}, fmt.Errorf("error to create file: %w", err)
+	}
+	defer out.Close()
+	hashed := newChecksumWriter(out)
+	writer := bufio.NewWriter(hashed)
 	for _, file := range files {
 		data, err := os.ReadFile(file)
 		if err != nil {
-			return fmt.Errorf("error read %s: %w", file, err)
+			return FileChecksum{}, fmt.Errorf("error read %s: %w", file, err)
 		}
-		if _, err := outputFile.Write(data); err != nil {
-			return fmt.Errorf("error write ouput file: %w", err)
-		} else {
-			DeleteTempFile(file)
+		if _, err := writer.Write(data); err != nil {
+			return FileChecksum{}, fmt.Errorf("error write ouput file: %w", err)
 		}
+		DeleteTempFile(file)
 	}
-
-	return nil
+	if err := writer.Flush(); err != nil {
+		return FileChecksum{}, fmt.Errorf("error write ouput file: %w", err)
+	}
+	return hashed.checksum(outputPath), nil
 }
 
-func cleanRead(read [4]string, tech string, details bool) [4]string {
+// cleanRead appends to kept the reads that pass the filters, more than one
+// when splitChimeras cuts the read on internal adapters, and to rejected the
+// discarded ones. read has linesPerRead lines (2 on FASTA, without plus and
+// quality). The sequences are views on the lines of read, trimming only
+// reslices them.
+func cleanRead(read [4]string, linesPerRead int, profile Profile, splitChimeras bool, stats *CleanStats, kept []Sequence, rejected []RejectedRead) ([]Sequence, []RejectedRead, error) {
 	seq := Sequence{
 		ID:      strings.TrimSpace(read[0]),
 		Bases:   strings.TrimSpace(read[1]),
@@ -109,33 +219,92 @@ func cleanRead(read [4]string, tech string, details bool) [4]string {
 		Quality: strings.TrimSpace(read[3]),
 	}
 
-	var cleaned []Sequence
-	switch tech {
+	// a record of less lines (truncated input)
+	if read[linesPerRead-1] == "" {
+		stats.BasesIn += int64(len(seq.Bases))
+		return kept, append(rejected, RejectedRead{Seq: seq, Reason: ReasonInvalid}), nil
+	}
+	one := [1]Sequence{seq}
+	seqs := one[:]
+	if splitChimeras {
+		if seqs = splitAtAdapters(seq, profile.Adapters); len(seqs) == 0 {
+			stats.BasesIn += int64(len(seq.Bases))
+			return kept, append(rejected, RejectedRead{Seq: seq, Reason: ReasonAdapterOnly}), nil
+		}
+	}
+
+	from := len(kept)
+	switch profile.Tech {
 	case "Illumina":
-		cleaned, _ = cleanIllumina([]Sequence{seq}, details)
+		kept, rejected = cleanIllumina(seqs, profile, stats, kept, rejected)
 	case "Oxford Nanopore":
-		cleaned, _ = cleanNanopore([]Sequence{seq}, details)
+		kept, rejected = cleanNanopore(seqs, profile, stats, kept, rejected)
 	case "PacBio":
-		cleaned, _ = cleanPacBio([]Sequence{seq}, details)
+		kept, rejected = cleanPacBio(seqs, profile, stats, kept, rejected)
 	case "Ion Torrent":
-		cleaned, _ = cleanIonTorrent([]Sequence{seq}, details)
+		kept, rejected = cleanIonTorrent(seqs, profile, stats, kept, rejected)
 	default:
-		log.Fatalf("not found tech")
-		cleaned = []Sequence{seq} // sin limpieza si no se reconoce
+		return kept, rejected, fmt.Errorf("technology %q has no cleaning", profile.Tech)
+	}
+
+	stats.BasesIn += int64(len(seq.Bases))
+	keptBases := 0
+	for _, c := range kept[from:] {
+		keptBases += len(c.Bases)
 	}
+	// bases removed from the reads that pass (adapters, poly-G, chimeras)
+	if len(kept) > from {
+		stats.TrimmedBases += int64(len(seq.Bases) - keptBases)
+	}
+	return kept, rejected, nil
+}
+
+// writeRejected saves the rejected reads of the chunk on a temporal file per filter.
+func writeRejected(tempDir string, chunkID int, rejected []RejectedRead) error {
+	outs := map[RejectReason][]byte{}
+	for _, r := range rejected {
+		outs[r.Reason] = appendRecord(outs[r.Reason], r.Seq)
+	}
+	for reason, out := range outs {
+		if _, err := WriteTempFile(tempDir, chunkFileName(chunkID, "rejected_"+string(reason)), out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if len(cleaned) > 0 {
-		c := cleaned[0]
-		return [4]string{
-			c.ID + "\n",
-			c.Bases + "\n",
-			c.Plus + "\n",
-			c.Quality + "\n",
+// mergeRejected writes <detailsDir>/<reason><ext> and the summary of counts.
+func mergeRejected(tempDir, detailsDir, ext string, stats *CleanStats, run *RunLog) error {
+	if err := os.MkdirAll(detailsDir, 0o755); err != nil {
+		return fmt.Errorf("error create details dir: %w", err)
+	}
+	for _, reason := range RejectReasons {
+		pattern := filepath.Join(tempDir, fmt.Sprintf("chunk_*_rejected_%s.tmp", reason))
+		checksum, err := mergeFiles(pattern, filepath.Join(detailsDir, string(reason)+ext))
+		if err != nil {
+			return err
 		}
+		run.RecordArtifact("details", checksum, stats.Rejected[reason])
+	}
+	summaryPath := filepath.Join(detailsDir, "summary.csv")
+	if err := stats.writeRejectedSummary(summaryPath); err != nil {
+		return err
 	}
+	return run.RecordFile("details", summaryPath)
+}
+
+// recordExt is the extension of the files of reads: .fasta when the reads
+// have 2 lines, .fastq otherwise.
+func recordExt(linesPerRead int) string {
+	if linesPerRead == 2 {
+		return ".fasta"
+	}
+	return ".fastq"
+}
 
-	// No pass, return empty
-	return [4]string{"", "", "", ""}
+// techConfigKey is the key of the technology on the config files.
+func techConfigKey(tech string) string {
+	return strings.ReplaceAll(tech, " ", "")
 }
 
 func CheckFileFormat(filename string) (string, int) {
@@ -155,79 +324,256 @@ func CheckFileFormat(filename string) (string, int) {
 	return fileFormat, fileLines
 }
 
-func startWorkers(threads int, jobs <-chan [][4]string, tempDir, tech string, wg *sync.WaitGroup, pluginList string, preWorker bool, details bool) {
-	for i := 0; i < threads; i++ {
+// startWorkers cleans the chunks of jobs on opts.Threads workers, handle
+// receives each cleaned chunk (from several workers at the same time) and its
+// counts are merged on stats once it is handled. The time to load and clean
+// each chunk is reported to sizer.
+func startWorkers(opts CleanOptions, jobs <-chan readChunk, wg *sync.WaitGroup, plugins *PluginRegistry, keepRejected bool, stats *CleanStats, sizer *chunkSizer, abort *runAbort, handle func(cleanedChunk) error) {
+	for i := 0; i < opts.Threads; i++ {
 		wg.Add(1)
 		go func(id int) {
-			fmt.Printf("Worker %d started\n", id)
+			slog.Debug("worker started", "worker", id)
 			defer wg.Done()
+			// QC accumulators of the worker, merged when the jobs end
+			var qcBefore, qcAfter *QCStats
+			if opts.QC {
+				qcBefore, qcAfter = NewQCStats(), NewQCStats()
+				defer func() { stats.mergeQC(qcBefore, qcAfter) }()
+			}
 			for chunk := range jobs {
-				fmt.Printf("Worker %d received chunk with %d sequences\n", id, len(chunk))
-				for idx, read := range chunk {
-					cleaned := cleanRead(read, tech, details)
-					// execute prev actions to each read
-					if preWorker {
-						cleaned = ExecuteToWorkersPlugins(pluginList, cleaned)
-					}
-					if cleaned[0] == "" {
-						continue
-					}
-					WriteTempFile(tempDir, fmt.Sprintf("chunk_%d_seq_%d.tmp", id, idx), strings.Join(cleaned[:], ""))
+				// drain the jobs after a failure so the reader is not blocked
+				if abort.failed() {
+					chunk.buf.release()
+					continue
+				}
+				start := time.Now()
+				err := chunk.load()
+				slog.Debug("worker received chunk", "worker", id, "chunk", chunk.ID, "reads", len(chunk.Reads))
+				var cleaned cleanedChunk
+				if err == nil {
+					cleaned, err = cleanChunk(chunk, opts, plugins, keepRejected, qcBefore, qcAfter)
+				}
+				if err != nil {
+					chunk.buf.release()
+				} else {
+					sizer.observe(len(chunk.Reads), chunk.size(), time.Since(start))
+					err = handle(cleaned)
+				}
+				if err != nil {
+					abort.fail(fmt.Errorf("worker %d, chunk %d: %w", id, chunk.ID, err))
+					continue
 				}
+				cleaned.stats.Chunks++
+				stats.merge(cleaned.stats)
 			}
 		}(i)
 	}
 }
 
-func processChunks(reader *bufio.Reader, jobs chan<- [][4]string, chunkSize int) {
-	var chunk [][4]string
+// cleanedChunk are the reads of a chunk after the filters and the plugins,
+// out has the kept ones as records and rejected is only kept when it was
+// asked. handle owns the chunk and releases buf once it is written.
+type cleanedChunk struct {
+	id       int
+	kept     []Sequence
+	out      []byte
+	rejected []RejectedRead
+	stats    *CleanStats
+	buf      *recordBuffer
+}
 
-	for {
-		var seq [4]string
-		readLines := 0
-		for i := 0; i < 4; i++ {
-			line, err := reader.ReadString('\n')
-			if err == io.EOF {
-				if readLines > 0 {
-					chunk = append(chunk, seq)
-				}
-				if len(chunk) > 0 {
-					fmt.Printf("Sent last chunk of size %d to jobs\n", len(chunk))
-					jobs <- chunk
+// cleanChunk cleans the reads of a chunk, the kept reads and the records are
+// written on the buffer of the chunk.
+func cleanChunk(chunk readChunk, opts CleanOptions, plugins *PluginRegistry, keepRejected bool, qcBefore, qcAfter *QCStats) (cleanedChunk, error) {
+	result := cleanedChunk{id: chunk.ID, stats: NewCleanStats(), buf: chunk.buf}
+	local := result.stats
+	kept := chunk.buf.kept
+	var pieces []Sequence
+	var discarded []RejectedRead
+	for _, read := range chunk.Reads {
+		if opts.Sampler != nil && !opts.Sampler.Keep(read) {
+			continue
+		}
+		local.ReadsIn++
+		if qcBefore != nil {
+			qcBefore.Add(strings.TrimSpace(read[1]), strings.TrimSpace(read[3]))
+		}
+		from, before := len(kept), len(discarded)
+		var err error
+		kept, discarded, err = cleanRead(read, chunk.lines, opts.Profile, opts.SplitChimeras, local, kept, discarded)
+		if err != nil {
+			return result, err
+		}
+		for _, r := range discarded[before:] {
+			local.Rejected[r.Reason]++
+		}
+		if !keepRejected {
+			discarded = discarded[:0]
+		}
+		// execute prev actions to each read
+		if plugins.HasReadHooks() {
+			pieces = append(pieces[:0], kept[from:]...)
+			kept = kept[:from]
+			for _, cleaned := range pieces {
+				if kept, err = plugins.ProcessRead(cleaned, kept); err != nil {
+					return result, err
 				}
-				close(jobs)
-				return
 			}
-			if err != nil {
-				log.Println("Error reading line:", err)
-				continue
+		}
+	}
+	if plugins.HasChunkHooks() {
+		var err error
+		if kept, err = plugins.ProcessChunk(chunk.ID, kept); err != nil {
+			return result, err
+		}
+	}
+	out := chunk.buf.out
+	for _, cleaned := range kept {
+		local.ReadsOut++
+		local.BasesOut += int64(len(cleaned.Bases))
+		if qcAfter != nil {
+			qcAfter.Add(cleaned.Bases, cleaned.Quality)
+		}
+		out = appendRecord(out, cleaned)
+	}
+	chunk.buf.kept, chunk.buf.out = kept, out
+	result.kept, result.out = kept, out
+	if keepRejected {
+		result.rejected = discarded
+	}
+	return result, nil
+}
+
+// readChunk is a group of reads sent to the workers, ID keeps the input
+// order. The reads are views on buf, or on block when the worker finds them
+// (load).
+type readChunk struct {
+	ID     int
+	Reads  [][4]string
+	lines  int // per read: 4 on FASTQ, 2 on FASTA (header and sequence)
+	buf    *recordBuffer
+	block  *inputBlock
+	source *blockSource
+}
+
+// size returns the bytes of input of the chunk, the reads of a sampled
+// chunk are not on its buffer (readSampledChunks).
+func (c *readChunk) size() int {
+	if c.block != nil {
+		return len(c.block.data)
+	}
+	if len(c.buf.data) > 0 {
+		return len(c.buf.data)
+	}
+	size := 0
+	for _, read := range c.Reads {
+		size += len(read[0]) + len(read[1]) + len(read[2]) + len(read[3]) + c.lines
+	}
+	return size
+}
+
+func chunkFileName(id int, suffix string) string {
+	if suffix == "" {
+		return fmt.Sprintf("chunk_%08d.tmp", id)
+	}
+	return fmt.Sprintf("chunk_%08d_%s.tmp", id, suffix)
+}
+
+// processChunks copies the lines of reader on pooled buffers and sends a
+// chunk each sizer.size() reads, the workers release the buffers.
+func processChunks(reader *bufio.Reader, jobs chan<- readChunk, sizer *chunkSizer, progress *Progress, abort *runAbort) {
+	defer close(jobs)
+	buf := getRecordBuffer()
+	chunkID := 0
+	chunkLines := sizer.size() * 4
+	send := func() bool {
+		chunk := readChunk{ID: chunkID, Reads: buf.index(4), lines: 4, buf: buf}
+		select {
+		case jobs <- chunk:
+			slog.Debug("sent chunk to jobs", "chunk", chunkID, "reads", len(chunk.Reads))
+			chunkID++
+			buf = getRecordBuffer()
+			chunkLines = sizer.size() * 4
+			return true
+		case <-abort.done:
+			return false
+		}
+	}
+
+	for {
+		n, err := buf.readLine(reader)
+		progress.add(n)
+		if err == io.EOF {
+			if buf.lines() > 0 {
+				send()
 			}
-			seq[i] = line
-			readLines++
+			return
 		}
-		if readLines == 4 {
-			chunk = append(chunk, seq)
+		if err != nil {
+			abort.fail(fmt.Errorf("error reading input: %w", err))
+			return
 		}
-		if len(chunk) >= chunkSize {
-			fmt.Printf("Sent chunk of size %d to jobs\n", len(chunk))
-			jobs <- chunk
-			chunk = nil
+		if lines := buf.lines(); lines%4 == 0 && lines >= chunkLines && !send() {
+			return
 		}
 	}
 }
 
-func handleOutput(outputPath, tempDir, pluginList string) {
-	NextPhase("Generating file output", 5)
-	err := mergeChunks(tempDir, outputPath)
+func handleOutput(outputPath, tempDir string, plugins *PluginRegistry, targetBases int64, stats *CleanStats, run *RunLog) error {
+	run.NextPhase("Generating file output", 5)
+	checksum, err := mergeChunks(tempDir, outputPath)
 	if err != nil {
-		log.Fatalf("Error merging chunks: %v", err)
+		return fmt.Errorf("error merging chunks: %w", err)
+	}
+	slog.Info("files are merged", "path", outputPath)
+	if targetBases > 0 {
+		run.NextPhase("Selecting best reads to target bases", 6)
+		// the QC after cleaning describes the reads of the subset
+		var qcAfter *QCStats
+		if stats.QCAfter != nil {
+			qcAfter = NewQCStats()
+		}
+		reads, bases, subset, err := SubsetTargetBases(outputPath, targetBases, qcAfter)
+		if err != nil {
+			return fmt.Errorf("error selecting reads: %w", err)
+		}
+		stats.ReadsOut, stats.BasesOut = reads, bases
+		if subset.Path != "" {
+			checksum = subset
+			if qcAfter != nil {
+				stats.QCAfter = qcAfter
+			}
+		}
 	}
-	fmt.Printf("Files are merged: %v\n", outputPath)
+	run.RecordArtifact("output", checksum, stats.ReadsOut)
 
-	fmt.Println("Clean sequences complete")
-	if pluginList != "" {
-		NextPhase("Start to run plugins", 6)
-		ExecutePlugins(pluginList, outputPath)
+	slog.Info("clean sequences complete")
+	if plugins != nil {
+		run.NextPhase("Start to run plugins", 7)
+		start := time.Now()
+		if err := plugins.AfterMerge(outputPath); err != nil {
+			return err
+		}
+		// a plugin can rewrite the output in place or remove it
+		info, err := os.Stat(outputPath)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			run.forgetArtifact(outputPath)
+		case err == nil && (info.Size() != checksum.Size || !info.ModTime().Before(start)):
+			if checksum, err = ChecksumFile(outputPath); err != nil {
+				return err
+			}
+			run.RecordArtifact("output", checksum, stats.ReadsOut)
+		}
+		if err := run.recordPluginOutputs(outputPath, start, stats.ReadsOut); err != nil {
+			return fmt.Errorf("error hashing plugin outputs: %w", err)
+		}
 	}
-	fmt.Println("All phases completed.")
+	if checksum.Path != "" && fileExists(outputPath) {
+		if err := WriteChecksumFiles(checksum); err != nil {
+			return err
+		}
+	}
+	slog.Info("all phases completed")
+	return nil
 }
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParallelCleanDetails(t *testing.T) {
+	profile := illuminaProfile(t)
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) string {
+		bases := make([]byte, n)
+		for i := range bases {
+			bases[i] = "ACGT"[rng.Intn(4)]
+		}
+		return string(bases)
+	}
+	good := strings.Repeat("I", 150)
+	var input strings.Builder
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(&input, "@kept%d\n%s\n+\n%s\n", i, random(150), good)
+	}
+	want := map[string]RejectReason{
+		"@quality_length": ReasonInvalid,
+		"@not_bases":      ReasonInvalid,
+		"@adapters":       ReasonAdapterOnly,
+		"@low":            ReasonLowQuality,
+		"@short":          ReasonTooShort,
+		"@homopolymer":    ReasonHomopolymer,
+		"@truncated":      ReasonInvalid,
+	}
+	adapter := profile.Adapters[0]
+	fmt.Fprintf(&input, "@quality_length\n%s\n+\n%s\n", random(150), good[:149])
+	fmt.Fprintf(&input, "@not_bases\n%s\n+\n%s\n", random(140)+"ACGTXXACGT", good)
+	fmt.Fprintf(&input, "@adapters\n%s\n+\n%s\n", adapter+adapter, good[:2*len(adapter)])
+	fmt.Fprintf(&input, "@low\n%s\n+\n%s\n", random(150), strings.Repeat("#", 150))
+	fmt.Fprintf(&input, "@short\n%s\n+\n%s\n", random(20), good[:20])
+	fmt.Fprintf(&input, "@homopolymer\n%s\n+\n%s\n", random(60)+strings.Repeat("A", 90), good)
+	fmt.Fprintf(&input, "@truncated\n%s\n+\n", random(150))
+
+	dir := t.TempDir()
+	inputPath, outputPath := filepath.Join(dir, "reads.fastq"), filepath.Join(dir, "clean.fastq")
+	if err := os.WriteFile(inputPath, []byte(input.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := CleanOptions{Profile: profile, ChunkSize: 3, Threads: 2, TempDir: t.TempDir(), Details: true, SplitChimeras: true, LinesPerRead: 4}
+	stats, err := ParallelClean(context.Background(), inputPath, outputPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ReadsOut != 5 {
+		t.Errorf("%d reads kept, want 5", stats.ReadsOut)
+	}
+	got := map[string]RejectReason{}
+	for _, reason := range RejectReasons {
+		data, err := os.ReadFile(filepath.Join(dir, "clean_details", string(reason)+".fastq"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		records := 0
+		for i := 0; i+3 < len(lines); i += 4 {
+			got[lines[i]] = reason
+			records++
+		}
+		if int64(records) != stats.Rejected[reason] {
+			t.Errorf("%s: %d records, %d rejected", reason, records, stats.Rejected[reason])
+		}
+	}
+	for id, reason := range want {
+		if got[id] != reason {
+			t.Errorf("%s: rejected as %q, want %s", id, got[id], reason)
+		}
+	}
+	summary, err := os.ReadFile(filepath.Join(dir, "clean_details", "summary.csv"))
+	if err != nil || !strings.Contains(string(summary), "invalid,3\n") {
+		t.Errorf("summary %q, %v", summary, err)
+	}
+
+	// the rejected reads of a FASTA are FASTA
+	fasta := filepath.Join(dir, "reads.fasta")
+	if err := os.WriteFile(fasta, []byte(">long\n"+random(150)+"\n>short\n"+random(20)+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts.LinesPerRead = 2
+	if _, err := ParallelClean(context.Background(), fasta, filepath.Join(dir, "clean.fasta"), opts); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "clean_details", "too_short.fasta"))
+	if err != nil || !strings.HasPrefix(string(data), ">short\n") || strings.Count(string(data), "\n") != 2 {
+		t.Errorf("FASTA details %q, %v", data, err)
+	}
+}
@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Profile is the cleaning configuration of a technology, the sub-profile
+// (instrument or chemistry) selects the "Tech.SubProfile" entry of quality.json.
+type Profile struct {
+	Tech        string   `json:"tech"`
+	Name        string   `json:"name"` // key used on quality.json
+	Adapters    []string `json:"adapters"`
+	Threshold   int      `json:"threshold"`
+	Minbases    int      `json:"minbases"`
+	Homo        int      `json:"homopolymer"`
+	MaxBadBases int      `json:"maxBadBases"`
+	PolyG       int      `json:"polyG"` // minimum poly-G tail to trim, 0 disabled
+}
+
+// ErrUnknownSubProfile is returned when quality.json has no entry for the
+// sub-profile, a detected sub-profile can fall back to the technology entry.
+var ErrUnknownSubProfile = errors.New("sub-profile not found on quality.json")
+
+// LoadProfile reads adapters and thresholds once for all the workers, a
+// missing sub-profile is an ErrUnknownSubProfile.
+func LoadProfile(tech, subProfile string) (Profile, error) {
+	return LoadProfileFrom("config", tech, subProfile)
+}
+
+// LoadProfileFrom is LoadProfile with the adapters.json and quality.json of
+// configDir.
+func LoadProfileFrom(configDir, tech, subProfile string) (Profile, error) {
+	profile, err := LoadProfileFS(os.DirFS(configDir), tech, subProfile)
+	if err != nil {
+		return Profile{}, fmt.Errorf("%w (config folder %s)", err, configDir)
+	}
+	return profile, nil
+}
+
+// LoadProfileFS is LoadProfile with the adapters.json and quality.json of
+// fsys, e.g. the embedded defaults of the config package.
+func LoadProfileFS(fsys fs.FS, tech, subProfile string) (Profile, error) {
+	adapters, err := loadAdapters(fsys, "adapters.json")
+	if err != nil {
+		return Profile{}, fmt.Errorf("error to load adapters: %w", err)
+	}
+	qualities, err := loadQualities(fsys, "quality.json")
+	if err != nil {
+		return Profile{}, fmt.Errorf("error to load qualities: %w", err)
+	}
+	key := techConfigKey(tech)
+	name := key
+	if subProfile != "" {
+		name = key + "." + subProfile
+		if _, ok := qualities[name]; !ok {
+			return Profile{}, fmt.Errorf("%w: %s", ErrUnknownSubProfile, name)
+		}
+	}
+	quality, ok := qualities[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("technology %s not found on quality.json", key)
+	}
+	return Profile{
+		Tech:        tech,
+		Name:        name,
+		Adapters:    adapters[key],
+		Threshold:   quality.Threshold,
+		Minbases:    quality.Minbases,
+		Homo:        quality.Homo,
+		MaxBadBases: quality.MaxBadBases,
+		PolyG:       quality.PolyG,
+	}, nil
+}
+
+// instrument id (first field of the Illumina header) by sub-profile
+var illuminaInstruments = []struct {
+	SubProfile string
+	Pattern    *regexp.Regexp
+}{
+	{"NovaSeq", regexp.MustCompile(`^(A|LH)\d{5}`)},
+	{"NextSeq", regexp.MustCompile(`^(NB|NS|VH|VL)\d{5,6}`)},
+	{"NextSeq", regexp.MustCompile(`^MN\d{5}`)}, // MiniSeq, two colors like NextSeq
+	{"MiSeq", regexp.MustCompile(`^M\d{4,6}`)},
+	{"HiSeq", regexp.MustCompile(`^(D|E|J|K|SN|C)\d{3,6}`)},
+}
+
+// flowcell id (third field of the Illumina header) by sub-profile
+var illuminaFlowcells = []struct {
+	SubProfile string
+	Pattern    *regexp.Regexp
+}{
+	{"NovaSeq", regexp.MustCompile(`^[A-Z0-9]{5}D[RSMN]X[XY2357]$`)},
+	{"NextSeq", regexp.MustCompile(`^[A-Z0-9]{5}(BG|AF)X[XY2357]$`)},
+	{"MiSeq", regexp.MustCompile(`^0{9}-[A-Z0-9]{5}$`)},
+	{"HiSeq", regexp.MustCompile(`^[A-Z0-9]{5}(AC|BC|CC|BB|AL)X[XY]$`)},
+}
+
+var (
+	ontModelVersion = regexp.MustCompile(`basecall_model_version_id=\S*_(r\d+)\.`)
+	pacbioSubreads  = regexp.MustCompile(`^[@>]m\S+/\d+/\d+_\d+`)
+)
+
+// DetectSubProfile finds the instrument or chemistry of the reads, returns ""
+// when there is no evidence. Illumina: instrument id, flowcell and quality
+// bins; Nanopore: pore version of basecall_model_version_id; PacBio: ccs
+// (HiFi) or subreads (CLR) headers and quality range.
+func DetectSubProfile(tech string, lines []string) (string, string) {
+	reads := parseSampleReads(lines)
+	if len(reads) == 0 {
+		return "", ""
+	}
+	switch tech {
+	case "Illumina":
+		name, _, _ := strings.Cut(strings.TrimPrefix(reads[0].Header, "@"), " ")
+		fields := strings.Split(name, ":")
+		if len(fields) >= 7 {
+			for _, instrument := range illuminaInstruments {
+				if instrument.Pattern.MatchString(fields[0]) {
+					return instrument.SubProfile, "instrument " + fields[0]
+				}
+			}
+			for _, flowcell := range illuminaFlowcells {
+				if flowcell.Pattern.MatchString(fields[2]) {
+					return flowcell.SubProfile, "flowcell " + fields[2]
+				}
+			}
+		}
+		alphabet := qualityAlphabet(reads)
+		// NovaSeq bins: Q2, Q11, Q25, Q37
+		if len(alphabet) <= 4 && strings.Trim(alphabet, "#,:F") == "" {
+			return "NovaSeq", "quality bins " + alphabet
+		}
+		if len(alphabet) > 20 {
+			return "MiSeq", fmt.Sprintf("unbinned quality (%d values)", len(alphabet))
+		}
+	case "Oxford Nanopore":
+		for _, read := range reads {
+			if match := ontModelVersion.FindStringSubmatch(read.Header); match != nil {
+				switch match[1] {
+				case "r9":
+					return "R9", "basecall model " + match[0]
+				case "r10":
+					return "R10", "basecall model " + match[0]
+				}
+			}
+		}
+	case "PacBio":
+		ccs, subreads := 0, 0
+		for _, read := range reads {
+			if strings.Contains(read.Header, "/ccs") {
+				ccs++
+			} else if pacbioSubreads.MatchString(read.Header) {
+				subreads++
+			}
+		}
+		if ccs > subreads {
+			return "HiFi", "ccs headers"
+		}
+		if subreads > 0 {
+			return "CLR", "subreads headers"
+		}
+		if alphabet := qualityAlphabet(reads); strings.ContainsRune(alphabet, '~') {
+			return "HiFi", "quality up to Q93"
+		} else if alphabet == "!" {
+			return "CLR", "quality without values"
+		}
+	}
+	return "", ""
+}
+
+// qualityAlphabet returns the sorted characters used on the qualities.
+func qualityAlphabet(reads []sampleRead) string {
+	var seen [256]bool
+	for _, read := range reads {
+		for i := 0; i < len(read.Quality); i++ {
+			seen[read.Quality[i]] = true
+		}
+	}
+	var b strings.Builder
+	for c := 0; c < len(seen); c++ {
+		if seen[c] {
+			b.WriteByte(byte(c))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"MARIA/config"
+)
+
+func TestDetectSubProfile(t *testing.T) {
+	illumina := func(name string) func(int) string {
+		return func(i int) string { return fmt.Sprintf("@%s:%d:1101:1000 1:N:0:ACGT", name, i) }
+	}
+	tests := []struct {
+		name  string
+		tech  string
+		lines []string
+		want  string
+	}{
+		{"novaseq instrument", "Illumina", sampleLines(5, 150, 'F', illumina("A00123:8:H5KJ3DSXX:1")), "NovaSeq"},
+		{"nextseq instrument", "Illumina", sampleLines(5, 150, 'F', illumina("NB501234:8:H5KJ3BGXX:1")), "NextSeq"},
+		{"miseq instrument", "Illumina", sampleLines(5, 150, 'F', illumina("M01234:8:000000000-A1B2C:1")), "MiSeq"},
+		{"flowcell", "Illumina", sampleLines(5, 150, 'F', illumina("X9:8:H5KJ3DSXX:1")), "NovaSeq"},
+		{"quality bins", "Illumina", sampleLines(5, 150, 'F', func(i int) string { return fmt.Sprintf("@r%d", i) }), "NovaSeq"},
+		{"r10", "Oxford Nanopore", sampleLines(3, 500, '5', func(i int) string {
+			return fmt.Sprintf("@%d runid=a basecall_model_version_id=dna_r10.4.1_e8.2_400bps_hac@v4.2.0", i)
+		}), "R10"},
+		{"r9", "Oxford Nanopore", sampleLines(3, 500, '5', func(i int) string {
+			return fmt.Sprintf("@%d runid=a basecall_model_version_id=dna_r9.4.1_450bps_hac", i)
+		}), "R9"},
+		{"hifi", "PacBio", sampleLines(3, 500, '~', func(i int) string { return fmt.Sprintf("@m64011_190830_220126/%d/ccs", i) }), "HiFi"},
+		{"clr", "PacBio", sampleLines(3, 500, '!', func(i int) string { return fmt.Sprintf("@m64011_190830_220126/%d/0_500", i) }), "CLR"},
+		{"no evidence", "Oxford Nanopore", sampleLines(3, 500, '5', func(i int) string { return fmt.Sprintf("@%d", i) }), ""},
+		{"no reads", "Illumina", nil, ""},
+	}
+	for _, tt := range tests {
+		if got, evidence := DetectSubProfile(tt.tech, tt.lines); got != tt.want {
+			t.Errorf("%s: got %q (%s), want %q", tt.name, got, evidence, tt.want)
+		}
+	}
+}
+
+func TestLoadProfileFS(t *testing.T) {
+	tests := []struct {
+		name       string
+		tech       string
+		subProfile string
+		want       string
+		polyG      bool
+		wantErr    error
+	}{
+		{"technology", "Illumina", "", "Illumina", false, nil},
+		{"sub-profile", "Illumina", "NovaSeq", "Illumina.NovaSeq", true, nil},
+		{"tech with space", "Oxford Nanopore", "R10", "OxfordNanopore.R10", false, nil},
+		{"unknown sub-profile", "Illumina", "NovaSek", "", false, ErrUnknownSubProfile},
+	}
+	for _, tt := range tests {
+		profile, err := LoadProfileFS(config.Files, tt.tech, tt.subProfile)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (profile.Name != tt.want || profile.Tech != tt.tech || (profile.PolyG > 0) != tt.polyG || len(profile.Adapters) == 0) {
+			t.Errorf("%s: %+v", tt.name, profile)
+		}
+	}
+	if _, err := LoadProfileFS(config.Files, "Sanger", ""); err == nil || errors.Is(err, ErrUnknownSubProfile) {
+		t.Errorf("unknown technology: error %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ShowProgress enables the progress of the runs, disabled by -quiet.
+var ShowProgress = true
+
+const (
+	progressTTYInterval = 500 * time.Millisecond
+	progressLogInterval = 30 * time.Second
+)
+
+// Progress renders the percent of the input consumed by readChunks, the
+// throughput, the kept ratio and the ETA. On a terminal (stderr) it redraws
+// one line, otherwise (logs, pipes) it logs every progressLogInterval.
+type Progress struct {
+	totalBytes int64
+	bytes      atomic.Int64
+	stats      *CleanStats // reads in and out, nil when there is no cleaning
+	start      time.Time
+	tty        bool
+	done       chan struct{}
+	finished   chan struct{}
+}
+
+// NewProgress uses the size of the input file, without size (stdin, error)
+// the percent and ETA are not shown. Returns nil when ShowProgress is off, the
+// methods accept a nil progress.
+func NewProgress(inputPath string, stats *CleanStats) *Progress {
+	if !ShowProgress {
+		return nil
+	}
+	p := &Progress{stats: stats, start: time.Now(), done: make(chan struct{}), finished: make(chan struct{})}
+	if info, err := infoFile(inputPath); err == nil {
+		p.totalBytes = info.Size()
+	}
+	if info, err := os.Stderr.Stat(); err == nil {
+		p.tty = info.Mode()&os.ModeCharDevice != 0
+	}
+	return p
+}
+
+// add counts bytes consumed from the input, nil progress is allowed.
+func (p *Progress) add(bytes int) {
+	if p != nil {
+		p.bytes.Add(int64(bytes))
+	}
+}
+
+func (p *Progress) Start() {
+	if p == nil {
+		return
+	}
+	interval := progressLogInterval
+	if p.tty {
+		interval = progressTTYInterval
+	}
+	go func() {
+		defer close(p.finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.render(false)
+			case <-p.done:
+				p.render(true)
+				return
+			}
+		}
+	}()
+}
+
+// Stop draws the final line.
+func (p *Progress) Stop() {
+	if p == nil {
+		return
+	}
+	close(p.done)
+	<-p.finished
+}
+
+func (p *Progress) render(final bool) {
+	elapsed := time.Since(p.start).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	bytes := p.bytes.Load()
+	var percent, readsPerSecond, kept float64
+	var readsIn, readsOut int64
+	var eta time.Duration
+	if p.totalBytes > 0 {
+		percent = float64(bytes) * 100 / float64(p.totalBytes)
+		if bytes > 0 && !final {
+			eta = time.Duration(float64(p.totalBytes-bytes) / float64(bytes) * elapsed * float64(time.Second)).Round(time.Second)
+		}
+	}
+	megabytesPerSecond := float64(bytes) / 1e6 / elapsed
+	if p.stats != nil {
+		readsIn, readsOut = p.stats.counts()
+		readsPerSecond = float64(readsIn) / elapsed
+		if readsIn > 0 {
+			kept = float64(readsOut) * 100 / float64(readsIn)
+		}
+	}
+	if !p.tty {
+		attrs := []any{"percent", fmt.Sprintf("%.1f", percent), "mb_per_second", fmt.Sprintf("%.1f", megabytesPerSecond)}
+		if p.stats != nil {
+			attrs = append(attrs, "reads_per_second", int64(readsPerSecond), "kept_percent", fmt.Sprintf("%.1f", kept))
+		}
+		if final {
+			slog.Info("progress done", append(attrs, "elapsed", time.Duration(elapsed*float64(time.Second)).Round(time.Second))...)
+		} else {
+			slog.Info("progress", append(attrs, "eta", eta)...)
+		}
+		return
+	}
+	line := ""
+	if p.totalBytes > 0 {
+		line = fmt.Sprintf("%5.1f%% | ", percent)
+	}
+	line += fmt.Sprintf("%6.1f MB/s", megabytesPerSecond)
+	if p.stats != nil {
+		line += fmt.Sprintf(" | %8.0f reads/s", readsPerSecond)
+		if readsIn > 0 {
+			line += fmt.Sprintf(" | kept %5.1f%%", kept)
+		}
+	}
+	if final {
+		line += fmt.Sprintf(" | done in %s\n", time.Duration(elapsed*float64(time.Second)).Round(time.Second))
+	} else if eta > 0 {
+		line += fmt.Sprintf(" | ETA %s", eta)
+	}
+	fmt.Fprintf(os.Stderr, "\r\033[K%s", line)
+}
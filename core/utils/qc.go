@@ -0,0 +1,421 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	qcMaxQuality = 94
+	// distinct sequences tracked for duplication levels (like FastQC)
+	qcDupLimit = 100000
+	// bases of the start of the read used for duplication
+	qcDupPrefix = 50
+)
+
+// positionBin groups positions like FastQC so long reads keep a fixed size:
+// 1-100 exact, then groups of 10, 100 and 1000 bases.
+func positionBin(pos int) int {
+	switch {
+	case pos < 100:
+		return pos
+	case pos < 1000:
+		return 100 + (pos-100)/10
+	case pos < 10000:
+		return 190 + (pos-1000)/100
+	case pos < 100000:
+		return 280 + (pos-10000)/1000
+	default:
+		return 370
+	}
+}
+
+// binRange returns the first and last position (1-based) of the bin.
+func binRange(bin int) (int, int) {
+	switch {
+	case bin < 100:
+		return bin + 1, bin + 1
+	case bin < 190:
+		start := 100 + (bin-100)*10
+		return start + 1, start + 10
+	case bin < 280:
+		start := 1000 + (bin-190)*100
+		return start + 1, start + 100
+	case bin < 370:
+		start := 10000 + (bin-280)*1000
+		return start + 1, start + 1000
+	default:
+		return 100001, 0
+	}
+}
+
+func binLabel(bin int) string {
+	first, last := binRange(bin)
+	switch {
+	case last == 0:
+		return fmt.Sprintf("%d+", first)
+	case first == last:
+		return fmt.Sprint(first)
+	default:
+		return fmt.Sprintf("%d-%d", first, last)
+	}
+}
+
+// QCStats accumulates the QC metrics of the reads, each worker has its own
+// accumulator and they are merged at the end of the run.
+type QCStats struct {
+	Reads           int64
+	Bases           int64
+	PositionQuality [][qcMaxQuality]int64
+	PositionBases   [][5]int64 // A C G T N
+	MeanQuality     [qcMaxQuality]int64
+	Lengths         []int64 // by position bin of the length
+	GC              [101]int64
+	lengthCounts    map[int]int64 // reads by exact length, for N50
+	dupCounts       map[uint64]int64
+	dupUntracked    int64
+}
+
+func NewQCStats() *QCStats {
+	return &QCStats{lengthCounts: map[int]int64{}, dupCounts: map[uint64]int64{}}
+}
+
+func baseIndex(b byte) int {
+	switch b {
+	case 'A', 'a':
+		return 0
+	case 'C', 'c':
+		return 1
+	case 'G', 'g':
+		return 2
+	case 'T', 't', 'U', 'u':
+		return 3
+	}
+	return 4
+}
+
+func (q *QCStats) grow(bins int) {
+	for len(q.PositionBases) < bins {
+		q.PositionBases = append(q.PositionBases, [5]int64{})
+		q.PositionQuality = append(q.PositionQuality, [qcMaxQuality]int64{})
+	}
+}
+
+// Add counts a read, quality is empty on fasta.
+func (q *QCStats) Add(bases, quality string) {
+	q.Reads++
+	q.Bases += int64(len(bases))
+	if len(bases) > 0 {
+		q.grow(positionBin(len(bases)-1) + 1)
+	}
+	gc := 0
+	for i := 0; i < len(bases); i++ {
+		index := baseIndex(bases[i])
+		if index == 1 || index == 2 {
+			gc++
+		}
+		q.PositionBases[positionBin(i)][index]++
+	}
+	if len(bases) > 0 {
+		q.GC[gc*100/len(bases)]++
+	}
+	// the bin of the last base, so the label is the length (empty reads on the first)
+	lengthBin := 0
+	if len(bases) > 0 {
+		lengthBin = positionBin(len(bases) - 1)
+	}
+	for len(q.Lengths) <= lengthBin {
+		q.Lengths = append(q.Lengths, 0)
+	}
+	q.Lengths[lengthBin]++
+	q.lengthCounts[len(bases)]++
+
+	if quality != "" {
+		offset := detectPhredOffset(quality)
+		sum, n := 0, 0
+		for i := 0; i < len(quality) && i < len(bases); i++ {
+			score := decodePhred(quality[i], offset)
+			if score < 0 {
+				score = 0
+			} else if score >= qcMaxQuality {
+				score = qcMaxQuality - 1
+			}
+			sum += score
+			n++
+			q.PositionQuality[positionBin(i)][score]++
+		}
+		if n > 0 {
+			q.MeanQuality[sum/n]++
+		}
+	}
+
+	prefix := bases
+	if len(prefix) > qcDupPrefix {
+		prefix = prefix[:qcDupPrefix]
+	}
+	key := upperHash(prefix)
+	if _, ok := q.dupCounts[key]; ok || len(q.dupCounts) < qcDupLimit {
+		q.dupCounts[key]++
+	} else {
+		q.dupUntracked++
+	}
+}
+
+// upperHash is the FNV-1a hash of the upper case of s, without copying it.
+func upperHash(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (q *QCStats) Merge(other *QCStats) {
+	q.Reads += other.Reads
+	q.Bases += other.Bases
+	q.grow(len(other.PositionBases))
+	for i := range other.PositionBases {
+		for b := range other.PositionBases[i] {
+			q.PositionBases[i][b] += other.PositionBases[i][b]
+		}
+		for s := range other.PositionQuality[i] {
+			q.PositionQuality[i][s] += other.PositionQuality[i][s]
+		}
+	}
+	for s := range other.MeanQuality {
+		q.MeanQuality[s] += other.MeanQuality[s]
+	}
+	for len(q.Lengths) < len(other.Lengths) {
+		q.Lengths = append(q.Lengths, 0)
+	}
+	for i := range other.Lengths {
+		q.Lengths[i] += other.Lengths[i]
+	}
+	for i := range other.GC {
+		q.GC[i] += other.GC[i]
+	}
+	for length, count := range other.lengthCounts {
+		q.lengthCounts[length] += count
+	}
+	for key, count := range other.dupCounts {
+		if _, ok := q.dupCounts[key]; ok || len(q.dupCounts) < qcDupLimit {
+			q.dupCounts[key] += count
+		} else {
+			q.dupUntracked += count
+		}
+	}
+	q.dupUntracked += other.dupUntracked
+}
+
+// QCSummary is the JSON form of the QC metrics.
+type QCSummary struct {
+	Reads       int64             `json:"reads"`
+	Bases       int64             `json:"bases"`
+	MeanLength  float64           `json:"mean_length"`
+	GCPercent   float64           `json:"gc_percent"`
+	NPercent    float64           `json:"n_percent"`
+	PerPosition []PositionQC      `json:"per_position"`
+	MeanQuality []int64           `json:"mean_quality_histogram"` // reads by mean Phred score
+	Lengths     []LengthCount     `json:"length_histogram"`
+	GC          []int64           `json:"gc_histogram"` // reads by GC percent
+	Duplication DuplicationLevels `json:"duplication"`
+	LengthStats LengthStats       `json:"length_stats"`
+}
+
+// PositionQC is the quality boxplot and base composition of a position (or group).
+type PositionQC struct {
+	Position string     `json:"position"`
+	Mean     float64    `json:"mean"`
+	Median   int        `json:"median"`
+	Q1       int        `json:"q1"`
+	Q3       int        `json:"q3"`
+	P10      int        `json:"p10"`
+	P90      int        `json:"p90"`
+	Bases    [5]float64 `json:"bases_percent"` // A C G T N
+}
+
+type LengthCount struct {
+	Length string `json:"length"`
+	Reads  int64  `json:"reads"`
+}
+
+type DuplicationLevels struct {
+	// percent of the reads that remain after removing duplicates
+	DistinctPercent float64          `json:"distinct_percent"`
+	Levels          []DuplicateLevel `json:"levels"`
+}
+
+type DuplicateLevel struct {
+	Level   string  `json:"level"`
+	Percent float64 `json:"percent"` // percent of tracked reads on this level
+}
+
+// percentile of a histogram of scores.
+func histogramPercentile(hist [qcMaxQuality]int64, total int64, fraction float64) int {
+	target := int64(float64(total) * fraction)
+	var cumulative int64
+	for score, count := range hist {
+		cumulative += count
+		if cumulative > target {
+			return score
+		}
+	}
+	return qcMaxQuality - 1
+}
+
+func (q *QCStats) Summary() QCSummary {
+	summary := QCSummary{Reads: q.Reads, Bases: q.Bases, MeanQuality: q.MeanQuality[:], GC: q.GC[:]}
+	if q.Reads > 0 {
+		summary.MeanLength = float64(q.Bases) / float64(q.Reads)
+	}
+	var gc, n int64
+	for i := range q.PositionBases {
+		position := PositionQC{Position: binLabel(i)}
+		var baseTotal int64
+		for _, count := range q.PositionBases[i] {
+			baseTotal += count
+		}
+		for b, count := range q.PositionBases[i] {
+			if baseTotal > 0 {
+				position.Bases[b] = float64(count) * 100 / float64(baseTotal)
+			}
+		}
+		gc += q.PositionBases[i][1] + q.PositionBases[i][2]
+		n += q.PositionBases[i][4]
+		var total, sum int64
+		for score, count := range q.PositionQuality[i] {
+			total += count
+			sum += int64(score) * count
+		}
+		if total > 0 {
+			hist := q.PositionQuality[i]
+			position.Mean = float64(sum) / float64(total)
+			position.Median = histogramPercentile(hist, total, 0.5)
+			position.Q1 = histogramPercentile(hist, total, 0.25)
+			position.Q3 = histogramPercentile(hist, total, 0.75)
+			position.P10 = histogramPercentile(hist, total, 0.1)
+			position.P90 = histogramPercentile(hist, total, 0.9)
+		}
+		summary.PerPosition = append(summary.PerPosition, position)
+	}
+	if q.Bases > 0 {
+		summary.GCPercent = float64(gc) * 100 / float64(q.Bases)
+		summary.NPercent = float64(n) * 100 / float64(q.Bases)
+	}
+	for bin, reads := range q.Lengths {
+		if reads > 0 {
+			summary.Lengths = append(summary.Lengths, LengthCount{Length: binLabel(bin), Reads: reads})
+		}
+	}
+	summary.Duplication = q.duplicationLevels()
+	summary.LengthStats = q.lengthStats()
+	return summary
+}
+
+// duplicationLevels uses the FastQC levels: 1-9, >10, >50, >100, >500, >1k, >5k, >10k
+func (q *QCStats) duplicationLevels() DuplicationLevels {
+	names := []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", ">10", ">50", ">100", ">500", ">1k", ">5k", ">10k"}
+	limits := []int64{10, 50, 100, 500, 1000, 5000, 10000}
+	readsPerLevel := make([]int64, len(names))
+	var tracked int64
+	for _, count := range q.dupCounts {
+		tracked += count
+		level := int(count) - 1
+		if count >= 10 {
+			level = 9
+			for i, limit := range limits[1:] {
+				if count > limit {
+					level = 10 + i
+				}
+			}
+		}
+		readsPerLevel[level] += count
+	}
+	levels := DuplicationLevels{}
+	if tracked == 0 {
+		return levels
+	}
+	levels.DistinctPercent = float64(len(q.dupCounts)) * 100 / float64(tracked)
+	for i, name := range names {
+		levels.Levels = append(levels.Levels, DuplicateLevel{Level: name, Percent: float64(readsPerLevel[i]) * 100 / float64(tracked)})
+	}
+	return levels
+}
+
+// QCReport has the metrics before and after cleaning.
+type QCReport struct {
+	Before QCSummary `json:"before"`
+	After  QCSummary `json:"after"`
+}
+
+// LengthStats are the summary of long read runs (ONT, PacBio).
+type LengthStats struct {
+	Yield        int64   `json:"yield"`
+	Reads        int64   `json:"reads"`
+	N50          int     `json:"n50"`
+	N90          int     `json:"n90"`
+	MeanLength   float64 `json:"mean_length"`
+	MedianLength int     `json:"median_length"`
+	Longest      int     `json:"longest"`
+	Yield10k     int64   `json:"yield_over_10kb"`
+	Yield20k     int64   `json:"yield_over_20kb"`
+	Yield50k     int64   `json:"yield_over_50kb"`
+}
+
+// lengthStats walks the exact lengths from the longest, Nx is the length
+// where the reads of that length or longer reach x% of the yield.
+func (q *QCStats) lengthStats() LengthStats {
+	stats := LengthStats{Yield: q.Bases, Reads: q.Reads}
+	if q.Reads == 0 {
+		return stats
+	}
+	stats.MeanLength = float64(q.Bases) / float64(q.Reads)
+	lengths := make([]int, 0, len(q.lengthCounts))
+	for length := range q.lengthCounts {
+		lengths = append(lengths, length)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(lengths)))
+	stats.Longest = lengths[0]
+	var bases, reads int64
+	for _, length := range lengths {
+		count := q.lengthCounts[length]
+		bases += int64(length) * count
+		reads += count
+		if stats.N50 == 0 && bases*2 >= q.Bases {
+			stats.N50 = length
+		}
+		if stats.N90 == 0 && bases*10 >= q.Bases*9 {
+			stats.N90 = length
+		}
+		if stats.MedianLength == 0 && reads*2 >= q.Reads {
+			stats.MedianLength = length
+		}
+		switch {
+		case length > 50000:
+			stats.Yield50k += int64(length) * count
+			fallthrough
+		case length > 20000:
+			stats.Yield20k += int64(length) * count
+			fallthrough
+		case length > 10000:
+			stats.Yield10k += int64(length) * count
+		}
+	}
+	return stats
+}
+
+func (l LengthStats) String() string {
+	return fmt.Sprintf("yield %d bp | reads %d | N50 %d | N90 %d | mean %.0f | median %d | longest %d | >10kb %d | >20kb %d | >50kb %d",
+		l.Yield, l.Reads, l.N50, l.N90, l.MeanLength, l.MedianLength, l.Longest, l.Yield10k, l.Yield20k, l.Yield50k)
+}
+
+// PrintLengthStats shows the long read summary before and after cleaning.
+func (r *QCReport) PrintLengthStats() {
+	fmt.Printf("Before: %v\n", r.Before.LengthStats)
+	fmt.Printf("After:  %v\n", r.After.LengthStats)
+}
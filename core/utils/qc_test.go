@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPositionBin(t *testing.T) {
+	tests := []struct {
+		pos   int // 0-based
+		bin   int
+		label string
+	}{
+		{0, 0, "1"},
+		{99, 99, "100"},
+		{100, 100, "101-110"},
+		{999, 189, "991-1000"},
+		{1000, 190, "1001-1100"},
+		{9999, 279, "9901-10000"},
+		{10000, 280, "10001-11000"},
+		{250000, 370, "100001+"},
+	}
+	for _, tt := range tests {
+		bin := positionBin(tt.pos)
+		if bin != tt.bin || binLabel(bin) != tt.label {
+			t.Errorf("position %d: bin %d %s, want %d %s", tt.pos, bin, binLabel(bin), tt.bin, tt.label)
+		}
+		if first, last := binRange(bin); tt.pos+1 < first || (last != 0 && tt.pos+1 > last) {
+			t.Errorf("position %d out of the bin %d-%d", tt.pos, first, last)
+		}
+	}
+}
+
+func TestQCStatsSummary(t *testing.T) {
+	qc := NewQCStats()
+	qc.Add("ACGT", "IIII")         // Q40, GC 50%
+	qc.Add("GGGGCCCC", "!!!!!!!!") // Q0, GC 100%
+	qc.Add("ACGT", "IIII")         // duplicate of the first
+	qc.Add("AANN", "")             // fasta, no quality
+	summary := qc.Summary()
+	if summary.Reads != 4 || summary.Bases != 20 || summary.MeanLength != 5 {
+		t.Errorf("reads %d, bases %d, mean length %f", summary.Reads, summary.Bases, summary.MeanLength)
+	}
+	if summary.GCPercent != 60 || summary.NPercent != 10 {
+		t.Errorf("GC %f%%, N %f%%", summary.GCPercent, summary.NPercent)
+	}
+	if summary.MeanQuality[40] != 2 || summary.MeanQuality[0] != 1 {
+		t.Errorf("mean quality 40: %d, 0: %d", summary.MeanQuality[40], summary.MeanQuality[0])
+	}
+	if summary.GC[50] != 2 || summary.GC[100] != 1 || summary.GC[0] != 1 {
+		t.Errorf("GC histogram %v", summary.GC)
+	}
+	// position 1 has the quality of 3 reads: 40, 0 and 40
+	if first := summary.PerPosition[0]; first.Position != "1" || first.Median != 40 || first.P10 != 0 || first.Bases != [5]float64{75, 0, 25, 0, 0} {
+		t.Errorf("position 1 %+v", first)
+	}
+	if len(summary.PerPosition) != 8 || summary.PerPosition[7].Mean != 0 {
+		t.Errorf("%d positions", len(summary.PerPosition))
+	}
+	want := []LengthCount{{"4", 3}, {"8", 1}}
+	if !reflect.DeepEqual(summary.Lengths, want) {
+		t.Errorf("lengths %v, want %v", summary.Lengths, want)
+	}
+	// 3 distinct of 4 reads, one on the level 2
+	if summary.Duplication.DistinctPercent != 75 || summary.Duplication.Levels[1].Percent != 50 {
+		t.Errorf("duplication %+v", summary.Duplication)
+	}
+}
+
+func TestQCStatsMerge(t *testing.T) {
+	reads := strings.Split(string(syntheticReads(200)), "\n")
+	all, first, second := NewQCStats(), NewQCStats(), NewQCStats()
+	for i := 0; i+3 < len(reads); i += 4 {
+		all.Add(reads[i+1], reads[i+3])
+		if i < 400 {
+			first.Add(reads[i+1], reads[i+3])
+		} else {
+			second.Add(reads[i+1], reads[i+3])
+		}
+	}
+	merged := NewQCStats()
+	merged.Merge(first)
+	merged.Merge(second)
+	if !reflect.DeepEqual(merged.Summary(), all.Summary()) {
+		t.Error("the merge of the workers differs from one accumulator")
+	}
+}
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// ParallelStats computes the QC metrics of a file without cleaning, the
+// chunks of readChunks are counted by the workers and
+// merged at the end.
+func ParallelStats(inputPath string, chunkSize, threads int, fasta bool) (*QCStats, error) {
+	if threads <= 0 {
+		threads = AvailableCPU()
+	}
+	reader, closeInput, err := SmartReadFile(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("error open file: %w", err)
+	}
+	defer closeInput()
+	jobs := make(chan readChunk, threads*2)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	total := NewQCStats()
+	abort := newRunAbort()
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local := NewQCStats()
+			for chunk := range jobs {
+				if abort.failed() {
+					continue
+				}
+				if err := chunk.load(); err != nil {
+					abort.fail(fmt.Errorf("chunk %d: %w", chunk.ID, err))
+					continue
+				}
+				for _, read := range chunk.Reads {
+					local.Add(strings.TrimSpace(read[1]), strings.TrimSpace(read[3]))
+				}
+				chunk.buf.release()
+			}
+			mu.Lock()
+			total.Merge(local)
+			mu.Unlock()
+		}()
+	}
+	progress := NewProgress(inputPath, nil)
+	progress.Start()
+	linesPerRead := 4
+	if fasta {
+		linesPerRead = 2
+	}
+	readChunks(reader, jobs, newChunkSizer(chunkSize, false, threads), linesPerRead, progress, abort)
+	wg.Wait()
+	progress.Stop()
+	if abort.err != nil {
+		return nil, abort.err
+	}
+	return total, nil
+}
+
+// fastaChunks sends chunks of sizer.size() fasta records, the reads are the
+// header and the sequence; the lines of a wrapped sequence are joined on the
+// buffer, without their line breaks.
+func fastaChunks(reader *bufio.Reader, jobs chan<- readChunk, sizer *chunkSizer, progress *Progress, abort *runAbort) {
+	defer close(jobs)
+	buf := getRecordBuffer()
+	chunkID, chunkReads := 0, sizer.size()
+	var offset int64
+	// send the records before the header of the last line, it starts the next buffer
+	send := func(header []byte) bool {
+		next := getRecordBuffer()
+		if header != nil {
+			next.data = append(next.data, header...)
+			next.ends = append(next.ends, len(next.data))
+		}
+		chunk := readChunk{ID: chunkID, Reads: buf.index(2), lines: 2, buf: buf}
+		select {
+		case jobs <- chunk:
+			slog.Debug("sent chunk to jobs", "chunk", chunkID, "reads", len(chunk.Reads))
+			chunkID++
+			buf, chunkReads = next, sizer.size()
+			return true
+		case <-abort.done:
+			next.release()
+			return false
+		}
+	}
+
+	for {
+		start := len(buf.data)
+		n, err := buf.readLine(reader)
+		progress.add(n)
+		offset += int64(n)
+		if err != nil && err != io.EOF {
+			abort.fail(fmt.Errorf("error reading input: %w", err))
+			buf.release()
+			return
+		}
+		if n > 0 {
+			line := buf.data[start:]
+			switch {
+			case line[0] == '>':
+				// the sequence of the previous record ends before the header
+				if len(buf.ends) > 1 {
+					buf.ends = append(buf.ends[:len(buf.ends)-1], start, len(buf.data))
+				}
+				if len(buf.ends)/2 >= chunkReads {
+					header := buf.data[start:]
+					buf.data, buf.ends = buf.data[:start], buf.ends[:len(buf.ends)-1]
+					if !send(header) {
+						return
+					}
+				}
+			case len(buf.ends) == 1 && len(bytes.TrimSpace(line)) > 0:
+				abort.fail(fmt.Errorf("input is not a fasta: line without header near byte %d", offset-int64(n)))
+				buf.release()
+				return
+			default:
+				// a sequence line is appended to the sequence without line break
+				buf.data = append(buf.data[:start], bytes.TrimSpace(line)...)
+				buf.ends = buf.ends[:len(buf.ends)-1]
+			}
+		}
+		if err == io.EOF {
+			if len(buf.ends) > 0 {
+				buf.ends = append(buf.ends, len(buf.data))
+				send(nil)
+			} else {
+				buf.release()
+			}
+			return
+		}
+	}
+}
+
+// PrintStats shows the summary of the stats subcommand.
+func PrintStats(summary QCSummary) {
+	fmt.Println(summary.LengthStats)
+	fmt.Printf("GC: %.2f%% | N: %.4f%%\n", summary.GCPercent, summary.NPercent)
+	var withQuality int64
+	for _, reads := range summary.MeanQuality {
+		withQuality += reads
+	}
+	if withQuality == 0 {
+		return
+	}
+	fmt.Println("Mean quality per read:")
+	for start := 0; start < len(summary.MeanQuality); start += 5 {
+		var reads int64
+		for score := start; score < start+5 && score < len(summary.MeanQuality); score++ {
+			reads += summary.MeanQuality[score]
+		}
+		if reads > 0 {
+			fmt.Printf("  Q%-2d-Q%-2d %12d (%.2f%%)\n", start, start+4, reads, float64(reads)*100/float64(withQuality))
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParallelStatsFasta(t *testing.T) {
+	lengths := []int{100, 2500, 40, 7000, 900}
+	var single, wrapped strings.Builder
+	for i, length := range lengths {
+		seq := strings.Repeat("ACGT", length/4)
+		single.WriteString(">r" + string(rune('a'+i)) + "\n" + seq + "\n")
+		wrapped.WriteString(">r" + string(rune('a'+i)) + " wrapped\n")
+		for len(seq) > 60 {
+			wrapped.WriteString(seq[:60] + "\n")
+			seq = seq[60:]
+		}
+		wrapped.WriteString(seq + "\n")
+	}
+	dir := t.TempDir()
+	for name, content := range map[string]string{"single.fasta": single.String(), "wrapped.fasta": wrapped.String()} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// small chunks so the records are split across them
+		for _, chunk := range []int{1, 2, 100} {
+			qc, err := ParallelStats(path, chunk, 2, true)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			stats := qc.lengthStats()
+			if stats.Reads != 5 || stats.Yield != 10540 || stats.N50 != 7000 || stats.Longest != 7000 {
+				t.Errorf("%s, chunks of %d: %+v", name, chunk, stats)
+			}
+		}
+	}
+}
+
+func TestParallelStatsNotFasta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.fasta")
+	if err := os.WriteFile(path, []byte("ACGT\n>r1\nACGT\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParallelStats(path, 10, 1, true); err == nil {
+		t.Error("want an error on a line without header")
+	}
+}
+
+func BenchmarkParallelStats(b *testing.B) {
+	const reads = 50000
+	data := syntheticReads(reads)
+	path := filepath.Join(b.TempDir(), "reads.fastq")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	reportAllocsPerRead(b, reads, func() {
+		if _, err := ParallelStats(path, 1000, 1, false); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
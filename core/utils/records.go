@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"sync"
+	"unsafe"
+)
+
+// recordBuffer is the memory of a chunk: the input lines are copied on data
+// and the reads are views on it (strings without copy), ends has the offset
+// after the '\n' of each line. The kept reads are written on out. Buffers are
+// reused by recordBuffers, so parsing, trimming (reslicing the views) and
+// writing do not allocate per read; the views are only valid until the
+// buffer is released.
+type recordBuffer struct {
+	data  []byte
+	ends  []int
+	reads [][4]string
+	kept  []Sequence
+	out   []byte
+}
+
+var recordBuffers = sync.Pool{New: func() any { return new(recordBuffer) }}
+
+func getRecordBuffer() *recordBuffer {
+	b := recordBuffers.Get().(*recordBuffer)
+	b.data, b.ends, b.reads, b.kept, b.out = b.data[:0], b.ends[:0], b.reads[:0], b.kept[:0], b.out[:0]
+	return b
+}
+
+// release gives the buffer back to the pool, nothing can use its reads after.
+func (b *recordBuffer) release() {
+	if b != nil {
+		recordBuffers.Put(b)
+	}
+}
+
+// readLine copies the next line of reader, lines longer than the buffer of
+// the reader are joined. Returns the bytes read.
+func (b *recordBuffer) readLine(reader *bufio.Reader) (int, error) {
+	n := 0
+	for {
+		line, err := reader.ReadSlice('\n')
+		b.data = append(b.data, line...)
+		n += len(line)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if n > 0 {
+			b.ends = append(b.ends, len(b.data))
+		}
+		return n, err
+	}
+}
+
+// lines returns the number of lines read.
+func (b *recordBuffer) lines() int {
+	return len(b.ends)
+}
+
+// index groups the lines by linesPerRead (4 on fastq) on reads, with their
+// line break like ReadString; a last incomplete group keeps the lines found,
+// without the blank lines at the end of the input. It is called once the
+// chunk is full because data can move while it grows.
+func (b *recordBuffer) index(linesPerRead int) [][4]string {
+	ends := b.ends
+	for len(ends)%linesPerRead != 0 && isBlankLine(b.data, ends) {
+		ends = ends[:len(ends)-1]
+	}
+	start := 0
+	for i, end := range ends {
+		if i%linesPerRead == 0 {
+			b.reads = append(b.reads, [4]string{})
+		}
+		b.reads[len(b.reads)-1][i%linesPerRead] = byteView(b.data[start:end])
+		start = end
+	}
+	return b.reads
+}
+
+// isBlankLine reports if the last line of ends only has spaces.
+func isBlankLine(data []byte, ends []int) bool {
+	start := 0
+	if len(ends) > 1 {
+		start = ends[len(ends)-2]
+	}
+	return len(bytes.TrimSpace(data[start:ends[len(ends)-1]])) == 0
+}
+
+// byteView is the string of data without copy, data must not change while
+// the string is used.
+func byteView(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	return unsafe.String(unsafe.SliceData(data), len(data))
+}
+
+// appendRecord appends the four lines of the read to out, the header and the
+// sequence on FASTA.
+func appendRecord(out []byte, seq Sequence) []byte {
+	out = append(append(out, seq.ID...), '\n')
+	out = append(append(out, seq.Bases...), '\n')
+	if seq.fasta() {
+		return out
+	}
+	out = append(append(out, seq.Plus...), '\n')
+	return append(append(out, seq.Quality...), '\n')
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestRecordBufferIndex(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        string
+		linesPerRead int
+		want         [][4]string
+	}{
+		{
+			name:         "fastq",
+			input:        "@r1\nACGT\n+\nIIII\n@r2\nGG\n+\nJJ\n",
+			linesPerRead: 4,
+			want:         [][4]string{{"@r1\n", "ACGT\n", "+\n", "IIII\n"}, {"@r2\n", "GG\n", "+\n", "JJ\n"}},
+		},
+		{
+			name:         "incomplete last read",
+			input:        "@r1\nACGT\n+\nIIII\n@r2\nGG\n",
+			linesPerRead: 4,
+			want:         [][4]string{{"@r1\n", "ACGT\n", "+\n", "IIII\n"}, {"@r2\n", "GG\n"}},
+		},
+		{
+			name:         "blank lines after the last read",
+			input:        "@r1\nACGT\n+\nIIII\n\n\n",
+			linesPerRead: 4,
+			want:         [][4]string{{"@r1\n", "ACGT\n", "+\n", "IIII\n"}},
+		},
+		{
+			name:         "fasta",
+			input:        ">r1\nACGT\n>r2\nGG",
+			linesPerRead: 2,
+			want:         [][4]string{{">r1\n", "ACGT\n"}, {">r2\n", "GG"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := getRecordBuffer()
+			defer buf.release()
+			readAllLines(t, buf, bufio.NewReader(strings.NewReader(tt.input)))
+			if got := buf.index(tt.linesPerRead); !equalReads(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordBufferLongLines(t *testing.T) {
+	// lines longer than the buffer of the reader are joined
+	long := strings.Repeat("ACGT", 100)
+	input := "@r1\n" + long + "\n+\n" + strings.Repeat("I", len(long)) + "\n"
+	buf := getRecordBuffer()
+	defer buf.release()
+	readAllLines(t, buf, bufio.NewReaderSize(strings.NewReader(input), 16))
+	reads := buf.index(4)
+	if len(reads) != 1 || reads[0][1] != long+"\n" {
+		t.Fatalf("got %q", reads)
+	}
+}
+
+func TestRecordBufferViews(t *testing.T) {
+	buf := getRecordBuffer()
+	defer buf.release()
+	readAllLines(t, buf, bufio.NewReader(strings.NewReader("@r1\nACGT\n+\nIIII\n")))
+	reads := buf.index(4)
+	// the reads point inside data, they are not copies
+	start := uintptr(unsafe.Pointer(unsafe.SliceData(buf.data)))
+	end := start + uintptr(len(buf.data))
+	for i, line := range reads[0] {
+		p := uintptr(unsafe.Pointer(unsafe.StringData(line)))
+		if p < start || p+uintptr(len(line)) > end {
+			t.Errorf("line %d is not a view on the buffer", i)
+		}
+	}
+	// so a change of the buffer is seen by the reads
+	buf.data[4] = 'T'
+	if reads[0][1] != "TCGT\n" {
+		t.Errorf("read %q does not alias the buffer", reads[0][1])
+	}
+}
+
+func TestGetRecordBufferEmpty(t *testing.T) {
+	buf := getRecordBuffer()
+	readAllLines(t, buf, bufio.NewReader(strings.NewReader("@r1\nACGT\n+\nIIII\n")))
+	buf.index(4)
+	buf.kept = append(buf.kept, Sequence{ID: "@r1"})
+	buf.out = append(buf.out, "out"...)
+	buf.release()
+	// the pool can return the same buffer, it must come back empty
+	buf = getRecordBuffer()
+	defer buf.release()
+	if len(buf.data) != 0 || buf.lines() != 0 || len(buf.reads) != 0 || len(buf.kept) != 0 || len(buf.out) != 0 {
+		t.Errorf("buffer not reset: %d bytes, %d lines, %d reads", len(buf.data), buf.lines(), len(buf.reads))
+	}
+}
+
+func TestByteView(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want string
+	}{
+		{nil, ""},
+		{[]byte{}, ""},
+		{[]byte("ACGT\n"), "ACGT\n"},
+	}
+	for _, tt := range tests {
+		if got := byteView(tt.data); got != tt.want {
+			t.Errorf("byteView(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestAppendRecord(t *testing.T) {
+	tests := []struct {
+		seq  Sequence
+		want string
+	}{
+		{Sequence{ID: "@r1", Bases: "ACGT", Plus: "+", Quality: "IIII"}, "x\n@r1\nACGT\n+\nIIII\n"},
+		// FASTA has no plus and quality lines
+		{Sequence{ID: ">r1", Bases: "ACGT"}, "x\n>r1\nACGT\n"},
+	}
+	for _, tt := range tests {
+		if got := appendRecord([]byte("x\n"), tt.seq); string(got) != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func readAllLines(t *testing.T, buf *recordBuffer, reader *bufio.Reader) {
+	t.Helper()
+	for {
+		_, err := buf.readLine(reader)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func equalReads(a, b [][4]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// RunReport is the machine readable summary of a run, written as JSON for
+// pipelines and LIMS.
+type RunReport struct {
+	Tool             string         `json:"tool"`
+	Sample           string         `json:"sample"`
+	Command          []string       `json:"command"`
+	StartedAt        time.Time      `json:"started_at"`
+	WallClockSeconds float64        `json:"wall_clock_seconds"`
+	Inputs           []FileChecksum `json:"inputs"`
+	Output           string         `json:"output"`
+	Compressed       *FileChecksum  `json:"compressed,omitempty"`
+	Technology       TechScore      `json:"technology"`
+	Profile          Profile        `json:"profile"`
+	Settings         map[string]any `json:"settings"`
+	System           SystemInfo     `json:"system"`
+	Stats            *CleanStats    `json:"stats"`
+	QC               *QCReport      `json:"qc,omitempty"`
+	Samples          []DemuxCount   `json:"samples,omitempty"`
+	Phases           []PhaseTiming  `json:"phases"`
+}
+
+// SystemInfo is the machine where the run was executed.
+type SystemInfo struct {
+	Cores     int    `json:"cores"`
+	RAM       uint64 `json:"ram_bytes"`
+	UsableRAM uint64 `json:"usable_ram_bytes"`
+	NVMe      bool   `json:"nvme"`
+	DiskCache bool   `json:"disk_cache"`
+}
+
+// Write closes the wall clock of the report and saves it on path.
+func (r *RunReport) Write(path string) error {
+	r.Tool = "MARIA"
+	r.WallClockSeconds = time.Since(r.StartedAt).Seconds()
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encode report: %w", err)
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testRunReport is the report of a cleaning of synthetic reads with QC.
+func testRunReport(t *testing.T) *RunReport {
+	t.Helper()
+	opts := CleanOptions{Profile: illuminaProfile(t), ChunkSize: 100, Threads: 2, QC: true}
+	stats, err := CleanStream(context.Background(), bytes.NewReader(syntheticReads(500)), io.Discard, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &RunReport{
+		Sample:     "Lib7_R1",
+		Command:    []string{"maria", "-in", "Lib7_R1.fastq"},
+		StartedAt:  time.Now().Add(-time.Second),
+		Output:     "clean.fastq",
+		Technology: TechScore{Tech: "Illumina", Probability: 0.98, Evidence: []string{"Illumina header"}},
+		Profile:    opts.Profile,
+		Stats:      stats,
+		QC:         stats.QCReport(),
+		Phases:     []PhaseTiming{{Phase: 1, Title: "Detecting technology", Seconds: 0.5}},
+	}
+}
+
+func TestRunReportWrite(t *testing.T) {
+	report := testRunReport(t)
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := report.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Tool             string         `json:"tool"`
+		Sample           string         `json:"sample"`
+		WallClockSeconds float64        `json:"wall_clock_seconds"`
+		Technology       TechScore      `json:"technology"`
+		Stats            map[string]any `json:"stats"`
+		QC               *QCReport      `json:"qc"`
+		Phases           []PhaseTiming  `json:"phases"`
+		Samples          []DemuxCount   `json:"samples"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Tool != "MARIA" || decoded.Sample != "Lib7_R1" || decoded.WallClockSeconds < 1 || decoded.Technology.Tech != "Illumina" {
+		t.Errorf("report %+v", decoded)
+	}
+	if decoded.Stats["reads_in"] != float64(500) || decoded.Stats["reads_out"] != float64(report.Stats.ReadsOut) {
+		t.Errorf("stats %v", decoded.Stats)
+	}
+	// every filter is on the report, also without rejected reads
+	rejected, _ := decoded.Stats["rejected"].(map[string]any)
+	for _, reason := range RejectReasons {
+		if _, ok := rejected[string(reason)]; !ok {
+			t.Errorf("no %s on the rejected reads %v", reason, rejected)
+		}
+	}
+	if decoded.QC == nil || decoded.QC.Before.Reads != 500 || len(decoded.Phases) != 1 || decoded.Samples != nil {
+		t.Errorf("qc %v, phases %v, samples %v", decoded.QC != nil, decoded.Phases, decoded.Samples)
+	}
+}
@@ -0,0 +1,281 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Sampler selects a random subset of the input reads before cleaning. The
+// random key of a read only depends on the seed and the read name (without
+// /1 /2 and the comment), so the result does not depend on the threads and
+// the mates of a pair have the same key: they are kept together on an
+// interleaved input and R1 and R2 sampled with the same seed keep the same
+// names.
+type Sampler struct {
+	Seed     int64
+	Fraction float64 // fraction mode: probability to keep each read
+	Count    int     // count mode: reads (pairs on an interleaved input) of the reservoir
+}
+
+// sampleKey is an uniform random number for the read name.
+func sampleKey(header string, seed int64) uint64 {
+	name := strings.TrimLeft(header, "@>")
+	if fields := strings.Fields(name); len(fields) > 0 {
+		name = fields[0]
+	}
+	name = strings.TrimSuffix(strings.TrimSuffix(name, "/1"), "/2")
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d:%s", seed, name)
+	// splitmix64 finalizer, fnv alone is not uniform on the high bits
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func NewFractionSampler(fraction float64, seed int64) (*Sampler, error) {
+	if fraction <= 0 || fraction > 1 {
+		return nil, fmt.Errorf("fraction must be between 0 and 1, got %v", fraction)
+	}
+	return &Sampler{Seed: seed, Fraction: fraction}, nil
+}
+
+// NewCountSampler selects exactly count reads by reservoir sampling on the
+// pass of the cleaning: the reads of the count lowest keys are kept in memory
+// while the input is read and sent to the workers at the end (see
+// readSampledChunks). The mates of an interleaved input are one entry.
+func NewCountSampler(count int, seed int64) (*Sampler, error) {
+	if count <= 0 {
+		return nil, fmt.Errorf("count must be positive, got %d", count)
+	}
+	return &Sampler{Seed: seed, Count: count}, nil
+}
+
+// NewCoverageSampler converts genome size x coverage to a fraction of the
+// input bases, estimated from the head of the file (see estimateBases) so the
+// input is not read one more time.
+func NewCoverageSampler(path string, genomeSize int64, coverage float64, seed int64) (*Sampler, error) {
+	if genomeSize <= 0 || coverage <= 0 {
+		return nil, fmt.Errorf("genome size and coverage must be positive")
+	}
+	totalBases, err := estimateBases(path)
+	if err != nil {
+		return nil, err
+	}
+	if totalBases == 0 {
+		return nil, fmt.Errorf("file without bases")
+	}
+	fraction := float64(genomeSize) * coverage / float64(totalBases)
+	if fraction >= 1 {
+		slog.Info("input under the coverage, all reads kept", "coverage", fmt.Sprintf("%.1fx", float64(totalBases)/float64(genomeSize)))
+		fraction = 1
+	}
+	return &Sampler{Seed: seed, Fraction: fraction}, nil
+}
+
+// estimateBases returns the bases of the file from the bases per byte of its
+// first chunkSampleBytes and its size, like the chunk size; a file shorter
+// than the sample is counted exactly.
+func estimateBases(path string) (int64, error) {
+	info, err := infoFile(path)
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	sample := make([]byte, chunkSampleBytes)
+	n, err := io.ReadFull(file, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, fmt.Errorf("error read file: %w", err)
+	}
+	sample = sample[:n]
+	if n < chunkSampleBytes {
+		return sampleBases(sample), nil
+	}
+	// only the complete lines of a cut sample
+	sample = sample[:bytes.LastIndexByte(sample, '\n')+1]
+	if len(sample) == 0 {
+		return 0, nil
+	}
+	bases := float64(sampleBases(sample)) / float64(len(sample)) * float64(info.Size())
+	slog.Info("input bases estimated", "bases", int64(bases), "sample_bytes", len(sample))
+	return int64(bases), nil
+}
+
+// sampleBases counts the bases of the sequence lines: the second of each
+// record on FASTQ, the lines without '>' on FASTA (wrapped or not).
+func sampleBases(data []byte) int64 {
+	fasta := len(data) > 0 && data[0] == '>'
+	var bases int64
+	for i := 0; len(data) > 0; i++ {
+		line := data
+		if end := bytes.IndexByte(data, '\n'); end >= 0 {
+			line, data = data[:end], data[end+1:]
+		} else {
+			data = nil
+		}
+		if fasta && (len(line) == 0 || line[0] != '>') || !fasta && i%4 == 1 {
+			bases += int64(len(bytes.TrimSpace(line)))
+		}
+	}
+	return bases
+}
+
+// Keep reports if the read is part of the sample, the reads of a count
+// sampler were selected by its reservoir.
+func (s *Sampler) Keep(read [4]string) bool {
+	if s.Count > 0 {
+		return true
+	}
+	key := sampleKey(read[0], s.Seed)
+	return float64(key>>11)/(1<<53) < s.Fraction
+}
+
+// readSampledChunks is readChunks for a run with sampler: the reservoir of a
+// count sampler takes the reads of the whole input and sends the kept ones in
+// input order once the input ends, the other samplers run on the workers
+// (Keep). The reads of the reservoir are copied out of their chunks, the
+// memory is the one of count reads.
+func readSampledChunks(reader *bufio.Reader, jobs chan<- readChunk, sizer *chunkSizer, linesPerRead int, sampler *Sampler, progress *Progress, abort *runAbort) {
+	if sampler == nil || sampler.Count == 0 {
+		readChunks(reader, jobs, sizer, linesPerRead, progress, abort)
+		return
+	}
+	defer close(jobs)
+	input := make(chan readChunk, 2)
+	go readChunks(reader, input, sizer, linesPerRead, progress, abort)
+	reservoir := &readReservoir{count: sampler.Count}
+	order, lines := 0, 4
+	for chunk := range input {
+		if abort.failed() {
+			chunk.buf.release()
+			continue
+		}
+		if err := chunk.load(); err != nil {
+			chunk.buf.release()
+			abort.fail(fmt.Errorf("chunk %d: %w", chunk.ID, err))
+			continue
+		}
+		lines = chunk.lines
+		for _, read := range chunk.Reads {
+			reservoir.offer(read, sampleKey(read[0], sampler.Seed), order)
+			order++
+		}
+		chunk.buf.release()
+	}
+	if abort.failed() {
+		return
+	}
+	reads := reservoir.reads()
+	slog.Info("random reads selected", "reads", len(reads), "of", order)
+	for id := 0; len(reads) > 0; id++ {
+		buf := getRecordBuffer()
+		buf.reads = append(buf.reads, reads[:min(sizer.size(), len(reads))]...)
+		reads = reads[len(buf.reads):]
+		select {
+		case jobs <- readChunk{ID: id, Reads: buf.reads, lines: lines, buf: buf}:
+		case <-abort.done:
+			buf.release()
+			return
+		}
+	}
+}
+
+// sampledRead is an entry of the reservoir: a read, or the mates of a pair
+// (consecutive reads of the same key), and its position on the input.
+type sampledRead struct {
+	key   uint64
+	order int
+	reads [][4]string
+	index int // on the heap, -1 once it is dropped
+}
+
+// readReservoir keeps the entries of the count lowest keys on a max-heap, the
+// entry of the highest key is the next to be dropped.
+type readReservoir struct {
+	count   int
+	entries []*sampledRead
+	last    *sampledRead // entry of the previous read, its mate joins it
+}
+
+func (r *readReservoir) Len() int           { return len(r.entries) }
+func (r *readReservoir) Less(i, j int) bool { return r.entries[i].key > r.entries[j].key }
+func (r *readReservoir) Swap(i, j int) {
+	r.entries[i], r.entries[j] = r.entries[j], r.entries[i]
+	r.entries[i].index, r.entries[j].index = i, j
+}
+func (r *readReservoir) Push(x any) {
+	entry := x.(*sampledRead)
+	entry.index = len(r.entries)
+	r.entries = append(r.entries, entry)
+}
+func (r *readReservoir) Pop() any {
+	entry := r.entries[len(r.entries)-1]
+	r.entries = r.entries[:len(r.entries)-1]
+	entry.index = -1
+	return entry
+}
+
+// offer adds the read when its key is one of the count lowest, a read with
+// the key of the previous one is its mate and follows it.
+func (r *readReservoir) offer(read [4]string, key uint64, order int) {
+	if r.last != nil && r.last.key == key {
+		if r.last.index >= 0 {
+			r.last.reads = append(r.last.reads, cloneRead(read))
+		}
+		return
+	}
+	if len(r.entries) == r.count && key >= r.entries[0].key {
+		r.last = &sampledRead{key: key, index: -1}
+		return
+	}
+	entry := &sampledRead{key: key, order: order, reads: [][4]string{cloneRead(read)}}
+	if len(r.entries) == r.count {
+		r.entries[0].index = -1
+		r.entries[0], entry.index = entry, 0
+		heap.Fix(r, 0)
+	} else {
+		heap.Push(r, entry)
+	}
+	r.last = entry
+}
+
+// reads returns the reads of the reservoir in input order.
+func (r *readReservoir) reads() [][4]string {
+	sort.Slice(r.entries, func(i, j int) bool { return r.entries[i].order < r.entries[j].order })
+	var reads [][4]string
+	for _, entry := range r.entries {
+		reads = append(reads, entry.reads...)
+	}
+	return reads
+}
+
+// cloneRead copies the lines of the read on one string, the read can be kept
+// after its chunk is released.
+func cloneRead(read [4]string) [4]string {
+	var b strings.Builder
+	b.Grow(len(read[0]) + len(read[1]) + len(read[2]) + len(read[3]))
+	for _, line := range read {
+		b.WriteString(line)
+	}
+	record := b.String()
+	var out [4]string
+	for i, line := range read {
+		out[i], record = record[:len(line)], record[len(line):]
+	}
+	return out
+}
@@ -0,0 +1,228 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSampleKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		a, b   string
+		seedB  int64
+		sameAs bool
+	}{
+		{"mates /1 /2", "@read7/1", "@read7/2", 11, true},
+		{"comment", "@read7 1:N:0:ACGT", "@read7 2:N:0:ACGT", 11, true},
+		{"fasta header", ">read7", "@read7", 11, true},
+		{"other read", "@read7", "@read8", 11, false},
+		{"other seed", "@read7", "@read7", 12, false},
+	}
+	for _, tt := range tests {
+		a, b := sampleKey(tt.a, 11), sampleKey(tt.b, tt.seedB)
+		if (a == b) != tt.sameAs {
+			t.Errorf("%s: keys %x and %x, want same %v", tt.name, a, b, tt.sameAs)
+		}
+	}
+}
+
+func TestSampleKeyUniform(t *testing.T) {
+	// the keys of consecutive names spread over the whole range
+	const n = 20000
+	var buckets [16]int
+	for i := 0; i < n; i++ {
+		buckets[sampleKey(fmt.Sprintf("@SRR1.%d", i), 11)>>60]++
+	}
+	for i, count := range buckets {
+		if math.Abs(float64(count)-n/16) > n/16*0.15 {
+			t.Errorf("bucket %d has %d keys, want about %d", i, count, n/16)
+		}
+	}
+}
+
+func TestFractionSampler(t *testing.T) {
+	for _, fraction := range []float64{-1, 0, 1.5} {
+		if _, err := NewFractionSampler(fraction, 1); err == nil {
+			t.Errorf("want an error on fraction %g", fraction)
+		}
+	}
+	sampler, err := NewFractionSampler(0.25, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := 0
+	for i := 0; i < 20000; i++ {
+		if sampler.Keep([4]string{fmt.Sprintf("@r%d\n", i)}) {
+			kept++
+		}
+	}
+	if kept < 4500 || kept > 5500 {
+		t.Errorf("kept %d of 20000 reads, want about 5000", kept)
+	}
+}
+
+// sampledNames runs readSampledChunks on input and returns the names of the
+// reads sent to the workers.
+func sampledNames(t *testing.T, input string, linesPerRead int, sampler *Sampler) []string {
+	t.Helper()
+	jobs := make(chan readChunk, 4)
+	abort := newRunAbort()
+	go readSampledChunks(bufio.NewReader(strings.NewReader(input)), jobs, newChunkSizer(100, false, 1), linesPerRead, sampler, nil, abort)
+	var names []string
+	for chunk := range jobs {
+		if err := chunk.load(); err != nil {
+			t.Fatal(err)
+		}
+		for _, read := range chunk.Reads {
+			names = append(names, strings.TrimSpace(read[0]))
+		}
+		chunk.buf.release()
+	}
+	if abort.err != nil {
+		t.Fatal(abort.err)
+	}
+	return names
+}
+
+func TestCountSampler(t *testing.T) {
+	if _, err := NewCountSampler(0, 11); err == nil {
+		t.Error("want an error on count 0")
+	}
+	var fastq, fasta strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&fastq, "@r%d\nACGT\n+\nIIII\n", i)
+		fmt.Fprintf(&fasta, ">r%d\nACGT\n", i)
+	}
+	tests := []struct {
+		name         string
+		input        string
+		linesPerRead int
+		count, want  int
+	}{
+		{"one read", fastq.String(), 4, 1, 1},
+		{"fastq", fastq.String(), 4, 137, 137},
+		{"fasta", fasta.String(), 2, 137, 137},
+		{"all reads", fastq.String(), 4, 1000, 1000},
+		{"over the input", fastq.String(), 4, 5000, 1000},
+	}
+	for _, tt := range tests {
+		sampler, err := NewCountSampler(tt.count, 11)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := sampledNames(t, tt.input, tt.linesPerRead, sampler)
+		if len(names) != tt.want {
+			t.Errorf("%s: kept %d reads, want %d", tt.name, len(names), tt.want)
+			continue
+		}
+		// the reads of the lowest keys, in input order
+		var want []int
+		for i := 0; i < 1000; i++ {
+			want = append(want, i)
+		}
+		sort.Slice(want, func(i, j int) bool {
+			return sampleKey(fmt.Sprintf("@r%d", want[i]), 11) < sampleKey(fmt.Sprintf("@r%d", want[j]), 11)
+		})
+		want = want[:tt.want]
+		sort.Ints(want)
+		for i, name := range names {
+			if name[1:] != fmt.Sprintf("r%d", want[i]) {
+				t.Errorf("%s: read %d is %s, want r%d", tt.name, i, name, want[i])
+				break
+			}
+		}
+	}
+}
+
+func TestCountSamplerPairs(t *testing.T) {
+	var single, interleaved strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&single, "@r%d/1\nACGT\n+\nIIII\n", i)
+		fmt.Fprintf(&interleaved, "@r%d/1\nACGT\n+\nIIII\n@r%d/2\nTTGA\n+\nIIII\n", i, i)
+	}
+	sampler, err := NewCountSampler(137, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1 := sampledNames(t, single.String(), 4, sampler)
+	pairs := sampledNames(t, interleaved.String(), 4, sampler)
+	// the count is of pairs, each mate follows the other
+	if len(r1) != 137 || len(pairs) != 2*137 {
+		t.Fatalf("%d single reads and %d interleaved reads, want 137 and 274", len(r1), len(pairs))
+	}
+	for i, name := range r1 {
+		if pairs[2*i] != name || pairs[2*i+1] != strings.TrimSuffix(name, "/1")+"/2" {
+			t.Errorf("pair %d is %s %s, want the mates of %s", i, pairs[2*i], pairs[2*i+1], name)
+			break
+		}
+	}
+	// R2 sampled alone keeps the names of R1
+	r2 := sampledNames(t, strings.ReplaceAll(single.String(), "/1\n", "/2\n"), 4, sampler)
+	for i := range r1 {
+		if strings.TrimSuffix(r1[i], "/1") != strings.TrimSuffix(r2[i], "/2") {
+			t.Errorf("read %d: %s on R1, %s on R2", i, r1[i], r2[i])
+			break
+		}
+	}
+}
+
+func TestCleanStreamCount(t *testing.T) {
+	sampler, err := NewCountSampler(300, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := CleanOptions{Profile: illuminaProfile(t), ChunkSize: 100, Threads: 4, Sampler: sampler}
+	stats, err := CleanStream(context.Background(), bytes.NewReader(syntheticReads(2000)), io.Discard, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ReadsIn != 300 {
+		t.Errorf("%d reads cleaned, want 300", stats.ReadsIn)
+	}
+}
+
+func TestEstimateBases(t *testing.T) {
+	var fastq, fasta strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&fastq, "@r%d\n%s\n+\n%s\n", i, strings.Repeat("A", i), strings.Repeat("I", i))
+		fmt.Fprintf(&fasta, ">r%d\n%s\n%s\n", i, strings.Repeat("A", 60), strings.Repeat("C", i))
+	}
+	large := syntheticReads(60000)
+	tests := []struct {
+		name      string
+		data      []byte
+		want      int64
+		tolerance float64
+	}{
+		{"fastq", []byte(fastq.String()), 4950, 0},
+		{"wrapped fasta", []byte(fasta.String()), 6000 + 4950, 0},
+		{"over the sample", large, 60000 * 150, 0.02},
+		{"empty", nil, 0, 0},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(path, tt.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := estimateBases(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(float64(got-tt.want)) > float64(tt.want)*tt.tolerance {
+			t.Errorf("%s: %d bases, want %d", tt.name, got, tt.want)
+		}
+	}
+	if _, err := estimateBases(filepath.Join(dir, "none")); err == nil {
+		t.Error("want an error without file")
+	}
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// CleanStats are the counters of a run, each worker fills its own copy per
+// chunk and merges it at the end of the chunk.
+type CleanStats struct {
+	mu           sync.Mutex
+	ReadsIn      int64                  `json:"reads_in"`
+	ReadsOut     int64                  `json:"reads_out"`
+	BasesIn      int64                  `json:"bases_in"`
+	BasesOut     int64                  `json:"bases_out"`
+	TrimmedBases int64                  `json:"trimmed_bases"`
+	Rejected     map[RejectReason]int64 `json:"rejected"`
+	AdapterHits  map[string]int64       `json:"adapter_hits"`
+	Chunks       int64                  `json:"chunks"`
+	ChunkSize    int                    `json:"chunk_size"`
+	Threads      int                    `json:"threads"`
+	QCBefore     *QCStats               `json:"-"`
+	QCAfter      *QCStats               `json:"-"`
+}
+
+func NewCleanStats() *CleanStats {
+	stats := &CleanStats{Rejected: map[RejectReason]int64{}, AdapterHits: map[string]int64{}}
+	for _, reason := range RejectReasons {
+		stats.Rejected[reason] = 0
+	}
+	return stats
+}
+
+func (s *CleanStats) countAdapter(adapter string) {
+	if adapter != "" {
+		s.AdapterHits[adapter]++
+	}
+}
+
+func (s *CleanStats) merge(other *CleanStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ReadsIn += other.ReadsIn
+	s.ReadsOut += other.ReadsOut
+	s.BasesIn += other.BasesIn
+	s.BasesOut += other.BasesOut
+	s.TrimmedBases += other.TrimmedBases
+	s.Chunks += other.Chunks
+	for reason, count := range other.Rejected {
+		s.Rejected[reason] += count
+	}
+	for adapter, count := range other.AdapterHits {
+		s.AdapterHits[adapter] += count
+	}
+}
+
+// counts returns the reads in and out merged so far.
+func (s *CleanStats) counts() (int64, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ReadsIn, s.ReadsOut
+}
+
+// mergeQC adds the QC accumulators of a worker.
+func (s *CleanStats) mergeQC(before, after *QCStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.QCBefore == nil {
+		s.QCBefore, s.QCAfter = NewQCStats(), NewQCStats()
+	}
+	s.QCBefore.Merge(before)
+	s.QCAfter.Merge(after)
+}
+
+// QCReport returns the QC summaries, nil when QC was not collected.
+func (s *CleanStats) QCReport() *QCReport {
+	if s.QCBefore == nil {
+		return nil
+	}
+	return &QCReport{Before: s.QCBefore.Summary(), After: s.QCAfter.Summary()}
+}
+
+// PrintRejected shows the discarded reads per filter.
+func (s *CleanStats) PrintRejected() {
+	fmt.Printf("Reads in: %d | Reads out: %d\n", s.ReadsIn, s.ReadsOut)
+	for _, reason := range RejectReasons {
+		fmt.Printf("  %-14s %12d\n", reason, s.Rejected[reason])
+	}
+}
+
+// writeRejectedSummary saves the counts per filter on a csv.
+func (s *CleanStats) writeRejectedSummary(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error to create summary: %w", err)
+	}
+	defer f.Close()
+	writer := csv.NewWriter(f)
+	writer.Write([]string{"reason", "reads"})
+	for _, reason := range RejectReasons {
+		writer.Write([]string{string(reason), fmt.Sprint(s.Rejected[reason])})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"MARIA/maria"
+)
+
+// orderedWriter receives the chunks of several workers and writes them in
+// the order of their id. A worker more than window chunks ahead of the next
+// one to write waits, so the memory is bounded.
+type orderedWriter struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	next    int
+	window  int
+	pending map[int]cleanedChunk
+	write   func(cleanedChunk) error
+	err     error
+}
+
+func newOrderedWriter(window int, write func(cleanedChunk) error) *orderedWriter {
+	o := &orderedWriter{window: window, pending: map[int]cleanedChunk{}, write: write}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+// put writes the chunk and the pending ones that follow it, the chunks are
+// written one at a time.
+func (o *orderedWriter) put(chunk cleanedChunk) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for chunk.id >= o.next+o.window && o.err == nil {
+		o.cond.Wait()
+	}
+	if o.err != nil {
+		return o.err
+	}
+	o.pending[chunk.id] = chunk
+	for {
+		next, ok := o.pending[o.next]
+		if !ok {
+			break
+		}
+		delete(o.pending, o.next)
+		if err := o.write(next); err != nil {
+			o.err = err
+			break
+		}
+		o.next++
+	}
+	o.cond.Broadcast()
+	return o.err
+}
+
+// fail wakes the workers waiting on put after the run failed.
+func (o *orderedWriter) fail(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err == nil {
+		o.err = err
+	}
+	o.cond.Broadcast()
+}
+
+// CleanStream cleans the reads of in and writes the kept ones on out (nil
+// discards them) in the input order, without temporal files. onRecord
+// (optional) receives the kept reads of each chunk, as written, followed by
+// the rejected ones with their reason; it is called in chunk order from one
+// goroutine and an error stops the run. The strings of the sequence are only
+// valid during the call, they are views on a reused buffer. Details and
+// TargetBases need a file, use ParallelClean.
+func CleanStream(ctx context.Context, in io.Reader, out io.Writer, opts CleanOptions, onRecord func(seq Sequence, reason RejectReason) error) (*CleanStats, error) {
+	if opts.Details || opts.TargetBases > 0 {
+		return nil, errors.New("details and target bases need an output file")
+	}
+	if opts.Threads <= 0 {
+		opts.Threads = AvailableCPU()
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 1000
+	}
+	if out == nil {
+		out = io.Discard
+	}
+	plugins, err := startPlugins(opts, maria.RunInfo{})
+	if err != nil {
+		return nil, err
+	}
+	defer closePlugins(plugins)
+	writer := bufio.NewWriterSize(out, 1<<20)
+	ordered := newOrderedWriter(opts.Threads*4, func(chunk cleanedChunk) error {
+		defer chunk.buf.release()
+		if _, err := writer.Write(chunk.out); err != nil {
+			return fmt.Errorf("error write output: %w", err)
+		}
+		if onRecord == nil {
+			return nil
+		}
+		for _, seq := range chunk.kept {
+			if err := onRecord(seq, ""); err != nil {
+				return err
+			}
+		}
+		for _, rejected := range chunk.rejected {
+			if err := onRecord(rejected.Seq, rejected.Reason); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	jobs := make(chan readChunk, opts.Threads*2)
+	var wg sync.WaitGroup
+	stats := NewCleanStats()
+	stats.Threads, stats.ChunkSize = opts.Threads, opts.ChunkSize
+	abort := newRunAbort()
+	stop := context.AfterFunc(ctx, func() { abort.fail(ctx.Err()) })
+	defer stop()
+	// wake the workers waiting for a chunk that will never be written
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-abort.done:
+			ordered.fail(abort.err)
+		case <-finished:
+		}
+	}()
+	sizer := newChunkSizer(opts.ChunkSize, opts.AdaptChunks, opts.Threads)
+	startWorkers(opts, jobs, &wg, plugins, onRecord != nil, stats, sizer, abort, ordered.put)
+	readSampledChunks(bufio.NewReaderSize(in, 1<<20), jobs, sizer, opts.LinesPerRead, opts.Sampler, nil, abort)
+	wg.Wait()
+	if abort.err != nil {
+		return nil, abort.err
+	}
+	sizer.logFinal()
+	if err := writer.Flush(); err != nil {
+		return nil, fmt.Errorf("error write output: %w", err)
+	}
+	return stats, nil
+}
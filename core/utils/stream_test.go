@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"MARIA/config"
+)
+
+// syntheticReads are 150 bp reads with Phred+33 qualities, one in five has
+// an adapter and one in ten fails the quality.
+func syntheticReads(n int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	adapter := "AGATCGGAAGAGCACACGTCTGAACTCCAGTCAC"
+	var out bytes.Buffer
+	bases := make([]byte, 150)
+	quality := make([]byte, 150)
+	for i := 0; i < n; i++ {
+		for j := range bases {
+			bases[j] = "ACGT"[rng.Intn(4)]
+			quality[j] = byte('!' + 30 + rng.Intn(10))
+		}
+		if i%5 == 0 {
+			copy(bases[100:], adapter)
+		}
+		if i%10 == 0 {
+			for j := 0; j < 10; j++ {
+				quality[rng.Intn(len(quality))] = '#'
+			}
+		}
+		fmt.Fprintf(&out, "@A00123:8:H5KJ3DSXX:1:1101:%d:1000 1:N:0:ACGT\n%s\n+\n%s\n", i, bases, quality)
+	}
+	return out.Bytes()
+}
+
+func illuminaProfile(tb testing.TB) Profile {
+	tb.Helper()
+	profile, err := LoadProfileFS(config.Files, "Illumina", "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return profile
+}
+
+func TestCleanStream(t *testing.T) {
+	data := syntheticReads(5000)
+	profile := illuminaProfile(t)
+	var first []byte
+	for _, threads := range []int{1, 4} {
+		var out bytes.Buffer
+		records := map[RejectReason]int64{}
+		opts := CleanOptions{Profile: profile, ChunkSize: 100, Threads: threads, QC: true}
+		stats, err := CleanStream(context.Background(), bytes.NewReader(data), &out, opts, func(seq Sequence, reason RejectReason) error {
+			records[reason]++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rejected := int64(0)
+		for reason, reads := range stats.Rejected {
+			rejected += reads
+			if records[reason] != reads {
+				t.Errorf("%d threads: %d records rejected as %s, stats %d", threads, records[reason], reason, reads)
+			}
+		}
+		if stats.ReadsIn != 5000 || stats.ReadsOut+rejected != stats.ReadsIn || records[""] != stats.ReadsOut {
+			t.Errorf("%d threads: %d in, %d out, %d rejected, %d kept records", threads, stats.ReadsIn, stats.ReadsOut, rejected, records[""])
+		}
+		if stats.QCBefore.Reads != 5000 || stats.QCAfter.Reads != stats.ReadsOut {
+			t.Errorf("%d threads: QC of %d and %d reads", threads, stats.QCBefore.Reads, stats.QCAfter.Reads)
+		}
+		// the output keeps the input order with any number of threads
+		if first == nil {
+			first = out.Bytes()
+		} else if !bytes.Equal(out.Bytes(), first) {
+			t.Errorf("%d threads: output differs from 1 thread", threads)
+		}
+	}
+}
+
+func TestCleanStreamFasta(t *testing.T) {
+	// the same reads as FASTA, with the sequences wrapped on 60 bases
+	var fasta bytes.Buffer
+	lines := bytes.Split(syntheticReads(1000), []byte("\n"))
+	for i := 0; i+1 < len(lines); i += 4 {
+		fasta.WriteString(">" + string(lines[i][1:]) + "\n")
+		for seq := lines[i+1]; len(seq) > 0; {
+			n := min(60, len(seq))
+			fasta.Write(seq[:n])
+			fasta.WriteString("\n")
+			seq = seq[n:]
+		}
+	}
+	var out bytes.Buffer
+	opts := CleanOptions{Profile: illuminaProfile(t), ChunkSize: 100, Threads: 4, LinesPerRead: 2}
+	stats, err := CleanStream(context.Background(), bytes.NewReader(fasta.Bytes()), &out, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without quality only the quality filter keeps all the reads
+	if stats.ReadsIn != 1000 || stats.Rejected[ReasonInvalid] != 0 || stats.Rejected[ReasonLowQuality] != 0 {
+		t.Errorf("%d in, rejected %v", stats.ReadsIn, stats.Rejected)
+	}
+	written := bytes.Split(bytes.TrimSuffix(out.Bytes(), []byte("\n")), []byte("\n"))
+	if int64(len(written)) != 2*stats.ReadsOut || written[0][0] != '>' || written[1][0] == '>' {
+		t.Errorf("%d lines written for %d reads, first %q", len(written), stats.ReadsOut, written[0])
+	}
+	// a FASTQ is not read as FASTA
+	if _, err := CleanStream(context.Background(), bytes.NewReader(syntheticReads(10)), io.Discard, opts, nil); err == nil {
+		t.Error("want an error on FASTQ read as FASTA")
+	}
+	opts.LinesPerRead = 4
+	if _, err := CleanStream(context.Background(), bytes.NewReader(fasta.Bytes()), io.Discard, opts, nil); err == nil {
+		t.Error("want an error on FASTA read as FASTQ")
+	}
+}
+
+func TestCleanStreamOptions(t *testing.T) {
+	opts := CleanOptions{Profile: illuminaProfile(t), TargetBases: 100}
+	if _, err := CleanStream(context.Background(), bytes.NewReader(nil), io.Discard, opts, nil); err == nil {
+		t.Error("want an error with target bases")
+	}
+}
+
+// The record path (parse, clean and write) with one thread, so the numbers
+// are per core:
+//
+//	go test -run - -bench CleanStream -benchmem ./core/utils
+func BenchmarkCleanStream(b *testing.B) {
+	benchmarkCleanStream(b, false)
+}
+
+func BenchmarkCleanStreamQC(b *testing.B) {
+	benchmarkCleanStream(b, true)
+}
+
+func benchmarkCleanStream(b *testing.B, qc bool) {
+	const reads = 50000
+	data := syntheticReads(reads)
+	opts := CleanOptions{Profile: illuminaProfile(b), ChunkSize: 1000, Threads: 1, QC: qc}
+	b.SetBytes(int64(len(data)))
+	reportAllocsPerRead(b, reads, func() {
+		if _, err := CleanStream(context.Background(), bytes.NewReader(data), io.Discard, opts, nil); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+// reportAllocsPerRead runs the benchmark and adds the allocations per read.
+func reportAllocsPerRead(b *testing.B, reads int, run func()) {
+	b.ReportAllocs()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		run()
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(b.N)/float64(reads), "allocs/read")
+}
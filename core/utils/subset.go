@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// score bins are logarithmic so the histogram keeps a fixed size for any file
+const (
+	scoreBinsPerLog2 = 64
+	scoreBins        = 48 * scoreBinsPerLog2
+)
+
+type scoreHistogram struct {
+	reads [scoreBins]int64
+	bases [scoreBins]int64
+}
+
+func scoreBin(score float64) int {
+	bin := int(math.Log2(score+1) * scoreBinsPerLog2)
+	if bin >= scoreBins {
+		bin = scoreBins - 1
+	}
+	return bin
+}
+
+func (h *scoreHistogram) add(score float64, bases int) {
+	bin := scoreBin(score)
+	h.reads[bin]++
+	h.bases[bin] += int64(bases)
+}
+
+// threshold returns the lowest bin fully kept and the bases that still fit
+// in the budget from the boundary bin (bin-1).
+func (h *scoreHistogram) threshold(targetBases int64) (int, int64) {
+	var total int64
+	for bin := scoreBins - 1; bin >= 0; bin-- {
+		if total+h.bases[bin] > targetBases {
+			return bin + 1, targetBases - total
+		}
+		total += h.bases[bin]
+	}
+	return 0, 0
+}
+
+// ParseBases reads a number of bases with optional suffix: 500M, 1.5G, 20k.
+func ParseBases(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(value, "BP")
+	value = strings.TrimSuffix(value, "B")
+	multiplier := 1.0
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'K':
+			multiplier = 1e3
+		case 'M':
+			multiplier = 1e6
+		case 'G':
+			multiplier = 1e9
+		case 'T':
+			multiplier = 1e12
+		}
+		if multiplier != 1 {
+			value = value[:len(value)-1]
+		}
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid number of bases %q", value)
+	}
+	return int64(number * multiplier), nil
+}
+
+// readRecord reads the next record of linesPerRead lines, io.EOF at the end
+// of file.
+func readRecord(reader *bufio.Reader, linesPerRead int) ([4]string, error) {
+	var read [4]string
+	for i := 0; i < linesPerRead; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			if err == io.EOF && i > 0 {
+				return read, fmt.Errorf("truncated record %s", strings.TrimSpace(read[0]))
+			}
+			return read, err
+		}
+		read[i] = line
+	}
+	return read, nil
+}
+
+func scoreRecord(read [4]string) (float64, int) {
+	bases := strings.TrimSpace(read[1])
+	return readScore(bases, strings.TrimSpace(read[3])), len(bases)
+}
+
+// SubsetTargetBases keeps the best reads of the file until targetBases, the
+// score weights length and mean quality (see readScore). Two streaming passes:
+// the first builds a score histogram, the second writes the reads over the
+// threshold, so the memory does not depend on the file size.
+// Returns the reads and bases kept and the checksum of the new file, empty
+// when all the reads are kept and the file is not rewritten. qc (optional)
+// receives the kept reads of a rewritten file.
+func SubsetTargetBases(path string, targetBases int64, qc *QCStats) (int64, int64, FileChecksum, error) {
+	var hist scoreHistogram
+	var totalBases, totalReads int64
+	err := scanRecords(path, func(read [4]string) error {
+		score, bases := scoreRecord(read)
+		hist.add(score, bases)
+		totalBases += int64(bases)
+		totalReads++
+		return nil
+	})
+	if err != nil {
+		return 0, 0, FileChecksum{}, err
+	}
+	if totalBases <= targetBases {
+		slog.Info("total bases under target, all reads kept", "bases", totalBases, "target", targetBases)
+		return totalReads, totalBases, FileChecksum{}, nil
+	}
+	minBin, boundaryBudget := hist.threshold(targetBases)
+
+	tmpPath := path + ".subset.tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, 0, FileChecksum{}, fmt.Errorf("error to create file: %w", err)
+	}
+	hashed := newChecksumWriter(out)
+	writer := bufio.NewWriter(hashed)
+	var keptBases, keptReads int64
+	err = scanRecords(path, func(read [4]string) error {
+		score, bases := scoreRecord(read)
+		bin := scoreBin(score)
+		if bin < minBin-1 {
+			return nil
+		}
+		if bin == minBin-1 {
+			// boundary bin, keep reads in file order while the budget allows
+			if int64(bases) > boundaryBudget {
+				return nil
+			}
+			boundaryBudget -= int64(bases)
+		}
+		keptBases += int64(bases)
+		keptReads++
+		if qc != nil {
+			qc.Add(strings.TrimSpace(read[1]), strings.TrimSpace(read[3]))
+		}
+		_, err := writer.WriteString(read[0] + read[1] + read[2] + read[3])
+		return err
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	out.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, 0, FileChecksum{}, fmt.Errorf("error write subset: %w", err)
+	}
+	slog.Info("subset", "reads", keptReads, "total_reads", totalReads, "bases", keptBases, "total_bases", totalBases, "target", targetBases)
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return 0, 0, FileChecksum{}, fmt.Errorf("error replace output with subset: %w", err)
+	}
+	return keptReads, keptBases, hashed.checksum(path), nil
+}
+
+// scanRecords calls fn with the records of the file, of 4 lines or of 2 when
+// it starts with a FASTA header (the sequences are on one line, like the
+// output of the cleaning).
+func scanRecords(path string, fn func(read [4]string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReaderSize(f, 1<<20)
+	linesPerRead := 4
+	if first, err := reader.Peek(1); err == nil && first[0] == '>' {
+		linesPerRead = 2
+	}
+	for {
+		read, err := readRecord(reader, linesPerRead)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(read); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseBases(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"1500", 1500, false},
+		{"20k", 20000, false},
+		{"500Mb", 500000000, false},
+		{"1.5G", 1500000000, false},
+		{"2TBP", 2000000000000, false},
+		{"", 0, true},
+		{"-1G", 0, true},
+		{"lots", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBases(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%q: got %d, %v; want %d, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// subsetReads are reads of 100 to 1000 bases in a mixed order and a read of
+// 1100 bases with low quality, 6600 bases in all.
+func subsetReads(fasta bool) string {
+	var out strings.Builder
+	for _, length := range []int{300, 1000, 100, 1100, 700, 900, 200, 500, 800, 400, 600} {
+		quality := byte('I')
+		if length == 1100 {
+			quality = '#'
+		}
+		bases := strings.Repeat("ACGT", length/4)
+		if fasta {
+			fmt.Fprintf(&out, ">r%d\n%s\n", length, bases)
+		} else {
+			fmt.Fprintf(&out, "@r%d\n%s\n+\n%s\n", length, bases, strings.Repeat(string(quality), length))
+		}
+	}
+	return out.String()
+}
+
+func TestSubsetTargetBases(t *testing.T) {
+	tests := []struct {
+		name   string
+		fasta  bool
+		target int64
+		want   []string // reads left in file order, nil keeps the file
+	}{
+		// the long reads with good quality win, the next one does not fit
+		{"fastq", false, 2000, []string{"@r1000", "@r900"}},
+		{"file order", false, 2750, []string{"@r1000", "@r900", "@r800"}},
+		// without quality only the length counts
+		{"fasta", true, 2500, []string{">r1000", ">r1100"}},
+		{"under target", false, 6600, nil},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "clean.fastq")
+		input := subsetReads(tt.fasta)
+		if err := os.WriteFile(path, []byte(input), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		qc := NewQCStats()
+		reads, bases, checksum, err := SubsetTargetBases(path, tt.target, qc)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.want == nil {
+			if string(data) != input || checksum.Path != "" || reads != 11 || bases != 6600 {
+				t.Errorf("%s: file rewritten or %d reads and %d bases", tt.name, reads, bases)
+			}
+			continue
+		}
+		var ids []string
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		step := 4
+		if tt.fasta {
+			step = 2
+		}
+		for i := 0; i < len(lines); i += step {
+			ids = append(ids, lines[i])
+		}
+		if strings.Join(ids, ",") != strings.Join(tt.want, ",") || reads != int64(len(tt.want)) || bases > tt.target {
+			t.Errorf("%s: kept %v (%d reads, %d bases), want %v", tt.name, ids, reads, bases, tt.want)
+		}
+		if want, _ := ChecksumFile(path); checksum != want {
+			t.Errorf("%s: checksum %+v, file %+v", tt.name, checksum, want)
+		}
+		if qc.Summary().Reads != reads {
+			t.Errorf("%s: QC of %d reads, want %d", tt.name, qc.Summary().Reads, reads)
+		}
+	}
+}
@@ -4,13 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
-	"log"
-	"math"
+	"log/slog"
 	"os"
 	"os/exec"
-	"plugin"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/shirou/gopsutil/mem"
 )
@@ -135,72 +134,41 @@ func checkDarwinRAM() bool {
 	return bytes > 4*1024*1024*1024 // 4 GB
 }
 
-func ExecutePlugins(pluginList string, cleanedFilePath string) {
-	plugins := strings.Split(pluginList, ",")
-	for _, pluginName := range plugins {
-		pluginPath := fmt.Sprintf("plugins/%s.so", pluginName)
-		fmt.Printf("Executing plugin: %s\n", pluginPath)
-
-		p, err := plugin.Open(pluginPath)
-		if err != nil {
-			log.Printf("Can't open plugin %s: %v\n", pluginName, err)
-			continue
-		}
-
-		sym, err := p.Lookup("Process")
-		if err != nil {
-			log.Printf("Plugin %s nt have function 'Process'\n", pluginName)
-			continue
-		}
-
-		processFunc, ok := sym.(func(string) error)
-		if !ok {
-			log.Printf("'Process' on plugin %s have a incorrect type\n", pluginName)
-			continue
-		}
+// PhaseTiming is the duration of a phase announced by NextPhase.
+type PhaseTiming struct {
+	Phase   int       `json:"phase"`
+	Title   string    `json:"title"`
+	Start   time.Time `json:"start"`
+	Seconds float64   `json:"seconds"`
+}
 
-		if err := processFunc(cleanedFilePath); err != nil {
-			log.Printf("Plugin %s fail: %v\n", pluginName, err)
-		}
+func (l *RunLog) NextPhase(title string, phaseCounter int) {
+	slog.Info("phase", "number", phaseCounter, "title", title)
+	if l == nil {
+		return
 	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeLastPhase(now)
+	l.phases = append(l.phases, PhaseTiming{Phase: phaseCounter, Title: title, Start: now})
 }
 
-func ExecuteToWorkersPlugins(pluginList string, cleanedSecuences [4]string) [4]string {
-	plugins := strings.Split(pluginList, ",")
-	seqs := cleanedSecuences
-	for _, pluginName := range plugins {
-		pluginPath := fmt.Sprintf("plugins/%s.so", pluginName)
-		fmt.Printf("Executing to workers plugin: %s\n", pluginPath)
-
-		p, err := plugin.Open(pluginPath)
-		if err != nil {
-			log.Printf("Can't open plugin %s: %v\n", pluginName, err)
-			continue
-		}
-
-		sym, err := p.Lookup("ProcessDataWorker")
-		if err != nil {
-			log.Printf("Plugin %s nt have function 'ProcessDataWorker'\n", pluginName)
-			continue
-		}
-
-		processFunc, ok := sym.(func([4]string) ([4]string, error))
-		if !ok {
-			log.Printf("'ProcessDataWorker' on plugin %s have a incorrect type\n", pluginName)
-			continue
-		}
-
-		if seqs, err = processFunc(cleanedSecuences); err != nil {
-			log.Printf("Plugin %s fail: %v\n", pluginName, err)
-			continue
-		}
+func (l *RunLog) closeLastPhase(now time.Time) {
+	if n := len(l.phases); n > 0 && l.phases[n-1].Seconds == 0 {
+		l.phases[n-1].Seconds = now.Sub(l.phases[n-1].Start).Seconds()
 	}
-	return seqs
 }
 
-func NextPhase(title string, phaseCounter int) {
-	fmt.Printf("\nPhase %d: %s...\n", phaseCounter, title)
-	phaseCounter++
+// PhaseTimings returns the phases of the run, the running one is closed now.
+func (l *RunLog) PhaseTimings() []PhaseTiming {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeLastPhase(time.Now())
+	return append([]PhaseTiming(nil), l.phases...)
 }
 
 func AvailableCPU() int {
@@ -215,7 +183,7 @@ func UsableRAM() uint64 {
 func AvailableRAM() uint64 {
 	vmem, err := mem.VirtualMemory()
 	if err != nil {
-		fmt.Println("Error obtain memort info:", err)
+		slog.Warn("can't obtain memory info", "error", err)
 		return 0
 	}
 	return uint64(vmem.Total)
@@ -227,7 +195,7 @@ func availableMemPerCore() float64 {
 }
 
 func targetMemPerThread() float64 {
-	totalRAMMB := AvailableRAM()
+	totalRAMMB := AvailableRAM() / 1024 / 1024
 	cores := AvailableCPU()
 	var targetMemPerThread float64
 	switch {
@@ -246,89 +214,36 @@ func targetMemPerThread() float64 {
 	return targetMemPerThread
 }
 
-func countLinesAndAvgSize(filename string, linesPerSeq int) (int, int, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return 1000, 0, err
-	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	totalLines := 0
-	totalBytes := 0
-	chunkSize := 0
-	for scanner.Scan() {
-		line := scanner.Text()
-		totalBytes += len(line) + 1 // +1 by '\n
-		totalLines++
-	}
-	if err := scanner.Err(); err != nil {
-		return 1000, 0, err
-	}
-	if totalLines == 0 {
-		return 1000, 0, nil
-	}
-	// max chunks
-	maxChunks := AvailableCPU() * 10
-	minChunkSize := totalLines / maxChunks
-	if minChunkSize > chunkSize {
-		chunkSize = minChunkSize
-	}
-	// min chunk control
-	if chunkSize < 10 {
-		chunkSize = 10
-	}
-	avgLineSize := float64(totalBytes) / float64(totalLines)
-
-	avgSeqSize := avgLineSize * float64(linesPerSeq)
-	chunkSize = int(targetMemPerThread() / avgSeqSize)
-	totalChunks := int(math.Ceil(float64(totalLines) / float64(chunkSize)))
-	return chunkSize, totalChunks, nil
-}
-
-func AutoEstimateChunks(filepath string, lines int) (int, int, float64) {
-	// read file
-	chunkSize, totalChunks, err := countLinesAndAvgSize(filepath, lines)
-	if err != nil {
-		fmt.Println("Error read file:", err)
-		return 0, 0, 0
-	}
-	return chunkSize, totalChunks, float64(availableMemPerCore()) / 1024.0 / 1024.0
-}
-
-func SmartReadFile(filepath string) (*bufio.Reader, error) {
+// SmartReadFile loads the file on memory when it fits on the usable RAM,
+// otherwise it reads from disk; call close when the reader is done.
+func SmartReadFile(filepath string) (*bufio.Reader, func() error, error) {
 	maxSize := UsableRAM()
 
 	info, err := infoFile(filepath)
 	if err != nil {
-		return nil, fmt.Errorf("error getting file info: %w", err)
+		return nil, nil, err
 	}
 
-	var reader *bufio.Reader
 	// dynamic limit based on RAM Avaiable
 	if info.Size() <= int64(maxSize) {
 		data, err := os.ReadFile(filepath)
 		if err != nil {
-			return nil, fmt.Errorf("error reading file: %w", err)
+			return nil, nil, fmt.Errorf("error reading file: %w", err)
 		}
-		reader = bufio.NewReader(bytes.NewReader(data))
-	} else {
-		// read on buffer big size file
-		file, err := os.Open(filepath)
-		if err != nil {
-			return nil, fmt.Errorf("error opening file: %w", err)
-		}
-		file.Close() // need close
-		reader = bufio.NewReader(file)
+		return bufio.NewReader(bytes.NewReader(data)), func() error { return nil }, nil
 	}
-
-	return reader, nil
+	// read on buffer big size file
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening file: %w", err)
+	}
+	return bufio.NewReaderSize(file, 1<<20), file.Close, nil
 }
 
 func infoFile(filepath string) (os.FileInfo, error) {
 	info, err := os.Stat(filepath)
 	if err != nil {
-		fmt.Println("Can't access file:", err)
-		return nil, nil
+		return nil, fmt.Errorf("can't access file: %w", err)
 	}
-	return info, err
+	return info, nil
 }
@@ -0,0 +1,70 @@
+// Package maria is the API of the MARIA plugins. A plugin is a Go package
+// main built with -buildmode=plugin that exports:
+//
+//	var MariaABI = maria.ABIVersion
+//	func NewPlugin() maria.Plugin
+//
+// MARIA checks MariaABI when the plugin is opened, a plugin built for another
+// version of this API is rejected before the run starts.
+package maria
+
+// ABIVersion changes when the Plugin interface or its types change.
+const ABIVersion = 1
+
+// Read is a sequence without the line breaks, Plus and Quality are empty on fasta.
+// The strings given to ProcessRead and ProcessChunk are views on a buffer that
+// is reused once the chunk is written: copy them (strings.Clone) to keep a
+// read after the chunk.
+type Read struct {
+	ID      string
+	Bases   string
+	Plus    string
+	Quality string
+}
+
+// Config are the parameters of the plugin given on the command line.
+type Config map[string]string
+
+// RunInfo describes the run before the reads are processed.
+type RunInfo struct {
+	Input     string
+	Output    string
+	Tech      string
+	Profile   string
+	Threads   int
+	ChunkSize int
+}
+
+// Chunk are the reads of a chunk that passed the cleaning and ProcessRead,
+// ID keeps the order of the input.
+type Chunk struct {
+	ID    int
+	Reads []Read
+}
+
+// Plugin hooks are called in this order: Init, BeforeRun, ProcessRead and
+// ProcessChunk from the workers, AfterMerge and Close. ProcessRead and
+// ProcessChunk are called from several workers at the same time and must be
+// safe for concurrent use.
+type Plugin interface {
+	Init(config Config) error
+	BeforeRun(info RunInfo) error
+	// ProcessRead transforms or filters a cleaned read: return nil to drop
+	// it, the read to keep it or several reads to emit them.
+	ProcessRead(read Read) ([]Read, error)
+	// ProcessChunk can change the reads of a chunk before they are written.
+	ProcessChunk(chunk *Chunk) error
+	AfterMerge(outputPath string) error
+	Close() error
+}
+
+// Base implements every hook without changes, embed it to only write the
+// hooks the plugin needs.
+type Base struct{}
+
+func (Base) Init(Config) error                     { return nil }
+func (Base) BeforeRun(RunInfo) error               { return nil }
+func (Base) ProcessRead(read Read) ([]Read, error) { return []Read{read}, nil }
+func (Base) ProcessChunk(*Chunk) error             { return nil }
+func (Base) AfterMerge(string) error               { return nil }
+func (Base) Close() error                          { return nil }
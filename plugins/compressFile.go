@@ -1,40 +1,67 @@
 package main
 
 import (
-	"fmt"
-	"os"
-	"os/exec"
+	"strconv"
+
+	"MARIA/core/utils"
+	"MARIA/maria"
 )
 
-// Exported function required by the system
-func Process(path string) error {
-	// this lib only compatible with linux and mac
-	zipPath := path + ".gz"
-	cmd := exec.Command("gzip", "-c", path)
-	outFile, err := os.Create(zipPath)
-	if err != nil {
-		return fmt.Errorf("no se pudo crear el archivo comprimido: %v", err)
-	}
-	defer outFile.Close()
+// MariaABI is checked by MARIA when the plugin is opened.
+var MariaABI = maria.ABIVersion
+
+// compressFile compresses the output file once the chunks are merged with
+// the parallel BGZF compression of -compress, the other hooks come from
+// maria.Base.
+type compressFile struct {
+	maria.Base
+	options utils.CompressOptions
+}
 
-	cmd.Stdout = outFile
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("falló la compresión gzip: %v", err)
+// NewPlugin is the exported constructor required by the system.
+func NewPlugin() maria.Plugin {
+	return &compressFile{}
+}
+
+// Init reads the parameters of compressFile.json: level, threads and remove.
+func (c *compressFile) Init(config maria.Config) error {
+	var err error
+	if c.options.Level, err = intParam(config, "level"); err != nil {
+		return err
+	}
+	if c.options.Threads, err = intParam(config, "threads"); err != nil {
+		return err
+	}
+	if remove := config["remove"]; remove != "" {
+		if c.options.RemoveOriginal, err = strconv.ParseBool(remove); err != nil {
+			return err
+		}
 	}
-	fmt.Println("✅ Archivo comprimido en:", zipPath)
 	return nil
 }
 
-// structure for use fasta
-// data[0]: ID = Identifier
-// data[1]: Bases = Nucleotides
-
-// structure for use fastq
-// data[0]: ID = Identifier
-// data[1]: Bases = Nucleotides
-// data[2]: Plus = Extra
-// data[3]: Quality = Quality Nucleotide on secuence
-func ProcessDataWorker(data [4]string) ([4]string, error) {
-	fmt.Printf("my secuence id: %v", data[0])
-	return data, nil
+func intParam(config maria.Config, key string) (int, error) {
+	if config[key] == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(config[key])
+}
+
+// structure of maria.Read for fasta
+// ID = Identifier
+// Bases = Nucleotides
+
+// structure of maria.Read for fastq
+// ID = Identifier
+// Bases = Nucleotides
+// Plus = Extra
+// Quality = Quality Nucleotide on secuence
+// Runs once per read, avoid prints here. Return nil to drop the read.
+func (c *compressFile) ProcessRead(read maria.Read) ([]maria.Read, error) {
+	return []maria.Read{read}, nil
+}
+
+func (c *compressFile) AfterMerge(path string) error {
+	_, err := utils.CompressFile(path, c.options)
+	return err
 }
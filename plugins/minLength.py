@@ -0,0 +1,25 @@
+#!/usr/bin/env python3
+"""External plugin example: drops the reads shorter than the parameter min.
+
+MARIA writes one JSON request per line on stdin and waits one JSON response
+per line on stdout (see "External plugins" on the README). Use stderr for
+messages, stdout is only for the protocol.
+"""
+import json
+import sys
+
+min_length = 0
+
+for line in sys.stdin:
+    request = json.loads(line)
+    kind = request["type"]
+    response = {}
+    if kind == "init":
+        min_length = int(request.get("config", {}).get("min", 0))
+        response = {"hooks": ["reads"]}
+    elif kind == "reads":
+        response = {"reads": [read for read in request["reads"] if len(read["seq"]) >= min_length]}
+    sys.stdout.write(json.dumps(response) + "\n")
+    sys.stdout.flush()
+    if kind == "close":
+        break